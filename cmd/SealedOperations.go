@@ -8,13 +8,9 @@ package main
 
 import (
 	"errors"
-	"github.com/filecoin-project/go-state-types/big"
 	"move_sectors/move_common"
-	"move_sectors/mv_utils"
 	"os"
-	"sort"
 	"strings"
-	"syscall"
 	"time"
 )
 
@@ -30,6 +26,8 @@ type SealedTask struct {
 	TotalSize     int64
 	Status        string
 	SealProofType string
+	SrcMtime      int64
+	Priority      int
 }
 
 var _ Operation = &SealedTask{}
@@ -56,6 +54,7 @@ func newSealedTask(sealedSrc, sId, oriSrc, srcIP string) (*SealedTask, error) {
 	task.SealedSrc = sealedSrc
 	task.TotalSize = totalSize
 	task.Status = StatusOnWaiting
+	task.SrcMtime = sealedSrcInfo.ModTime().Unix()
 	return task, nil
 }
 
@@ -63,17 +62,17 @@ func (t *SealedTask) canDo() bool {
 	srcComputersMapSingleton.CLock.Lock()
 	defer srcComputersMapSingleton.CLock.Unlock()
 	srcComputer := srcComputersMapSingleton.CMap[t.SrcIp]
-	var pathCurrentThread int64
-	var pathLimitThread int64
+	if srcComputer.Draining {
+		return false
+	}
 	for _, loc := range srcComputer.Paths {
-		if t.OriSrc == loc.Location {
-			pathCurrentThread = loc.CurrentThreads
-			pathLimitThread = loc.SinglePathThreadLimit
+		if t.OriSrc == strings.TrimRight(loc.Location, "/") {
+			if loc.Draining {
+				return false
+			}
+			return resourceManagerSingleton.hasFree(SideSrc, srcComputer, loc)
 		}
 	}
-	if srcComputer.CurrentThreads < srcComputer.LimitThread && pathCurrentThread < pathLimitThread {
-		return true
-	}
 	return false
 }
 
@@ -82,39 +81,11 @@ func (t *SealedTask) getBestDst() (string, string, error) {
 
 	dir, s, err := t.tryToFindGroupDir()
 	if err != nil {
-		if err.Error() == move_common.FondGroupButTooMuchThread {
+		if e := err.Error(); e == move_common.FondGroupButTooMuchThread || e == move_common.GroupDirFull {
 			return "", "", err
 		}
-		dstC, err := getOneFreeDstComputer()
-		if err != nil {
-			return "", "", err
-		}
-
-		log.Debugf("sorting dst paths")
-		paths := dstC.Paths
-		sort.Slice(paths, func(i, j int) bool {
-			var statI = new(syscall.Statfs_t)
-			_ = syscall.Statfs(paths[i].Location, statI)
-			var statJ = new(syscall.Statfs_t)
-			_ = syscall.Statfs(paths[j].Location, statJ)
-
-			iw := big.NewInt(int64(statI.Bavail*uint64(statI.Bsize)) / (paths[i].CurrentThreads + 1))
-			jw := big.NewInt(int64(statJ.Bavail*uint64(statJ.Bsize)) / (paths[j].CurrentThreads + 1))
-
-			return iw.GreaterThanEqual(jw)
-		})
-		log.Debugf("selecting dst paths for %s", t.SectorID)
-		for _, p := range paths {
-			var stat = new(syscall.Statfs_t)
-			_ = syscall.Statfs(p.Location, stat)
-			if stat.Bavail*uint64(stat.Bsize) > uint64(t.TotalSize) && p.CurrentThreads < p.SinglePathThreadLimit {
-				return p.Location, dstC.Ip, nil
-			}
-		}
-		log.Debugf("found group path for %s sealed", t.SectorID)
-		return "", "", errors.New(move_common.NoDstSuitableForNow)
+		return getBestDstByPolicy(t.getSectorID(), t.TotalSize)
 	}
-
 	return dir, s, nil
 }
 
@@ -125,19 +96,23 @@ func (t *SealedTask) fullInfo(dstOri, dstIp string) {
 	t.DstIp = dstIp
 }
 
-func (t *SealedTask) startCopy(cfg *Config, dstPath string) {
+func (t *SealedTask) startCopy(cfg *Config, run *CopyRun) {
 	log.Infof("start to copying %v", *t)
+	cur := cfg.snapshot()
 	// copying sealed
-	err := copying(t.SealedSrc, t.SealedDst, cfg.SingleThreadMBPS, cfg.Chunks)
-	freeThreads(dstPath, t.DstIp, t.SrcIp, t.OriSrc)
+	err := copying(t.SealedSrc, t.SealedDst, cur.SingleThreadMBPS, cur.Chunks, run)
+	resourceManagerSingleton.release(run.slot)
 	if err != nil {
-		if err.Error() == move_common.StoppedBySyscall {
+		run.fail(err)
+		if err.Error() == move_common.StoppedBySyscall || err.Error() == move_common.CancelledByControl {
 			log.Warn(err)
 		} else {
 			log.Error(err)
 		}
-		os.Remove(t.SealedDst)
-		os.Remove(t.SealedDst + ".tmp")
+		if !run.keepPartial() {
+			os.Remove(t.SealedDst)
+			os.Remove(t.SealedDst + ".tmp")
+		}
 		if os.Getenv("SKIP_FAILED") == "1" {
 			t.setStatus(StatusDone)
 		} else {
@@ -152,6 +127,10 @@ func (t *SealedTask) startCopy(cfg *Config, dstPath string) {
 func (t *SealedTask) tryToFindGroupDir() (string, string, error) {
 	dstComputersMapSingleton.CLock.Lock()
 	defer dstComputersMapSingleton.CLock.Unlock()
+	// the persistent placement map goes first, it also knows parts still copying
+	if dir, ip, found, err := findAssignedDir(t.getSectorID(), t.getFileType(), t.TotalSize); found {
+		return dir, ip, err
+	}
 	log.Debugf("trying to find group dir for %s sealed", t.SectorID)
 	// search cache at first
 	for _, cmp := range dstComputersMapSingleton.CMap {
@@ -159,10 +138,8 @@ func (t *SealedTask) tryToFindGroupDir() (string, string, error) {
 			dstCache := strings.TrimRight(p.Location, "/") + "/cache/" + t.getSectorID()
 			_, err := os.Stat(dstCache)
 			if err == nil {
-				if cmp.CurrentThreads < cmp.LimitThread && p.CurrentThreads < p.SinglePathThreadLimit {
-					var stat = new(syscall.Statfs_t)
-					_ = syscall.Statfs(p.Location, stat)
-					if stat.Bavail*uint64(stat.Bsize) <= uint64(t.TotalSize) {
+				if resourceManagerSingleton.hasFree(SideDst, cmp, p) {
+					if !capacityAllows(cmp, p, t.getSectorID(), t.TotalSize) {
 						log.Debugf("%v fond same group dir on %s, but disk has not enough space, will chose new dst", *t, p.Location)
 						return "", "", errors.New(move_common.NotEnoughSpace)
 					}
@@ -182,11 +159,9 @@ func (t *SealedTask) tryToFindGroupDir() (string, string, error) {
 			dstUnSealed := strings.TrimRight(p.Location, "/") + "/unsealed/" + t.getSectorID()
 			_, err := os.Stat(dstUnSealed)
 			if err == nil {
-				if cmp.CurrentThreads < cmp.LimitThread && p.CurrentThreads < p.SinglePathThreadLimit {
+				if resourceManagerSingleton.hasFree(SideDst, cmp, p) {
 
-					var stat = new(syscall.Statfs_t)
-					_ = syscall.Statfs(p.Location, stat)
-					if stat.Bavail*uint64(stat.Bsize) <= uint64(t.TotalSize) {
+					if !capacityAllows(cmp, p, t.getSectorID(), t.TotalSize) {
 						log.Debugf("%v fond same group dir on %s, but disk has not enough space, will chose new dst", *t, p.Location)
 						return "", "", errors.New(move_common.NotEnoughSpace)
 					}
@@ -248,40 +223,12 @@ func (t *SealedTask) checkSourceSize() ([]string, error) {
 }
 
 func (t *SealedTask) checkIsExistedInDst(srcPaths []string, cfg *Config) bool {
-	dstComputersMapSingleton.CLock.Lock()
-	defer dstComputersMapSingleton.CLock.Unlock()
 	sinceTime := time.Now()
-	for _, v := range dstComputersMapSingleton.CMap {
-		for _, p := range v.Paths {
-			tag := 1
-			for _, singleSealedPath := range srcPaths {
-				dst := strings.Replace(singleSealedPath, t.OriSrc, p.Location, 1)
-				statSrc, _ := os.Stat(singleSealedPath)
-				statDst, err := os.Stat(dst)
-				// if existed,check hash
-				if err == nil {
-					if statDst.Size() == statSrc.Size() {
-						srcHash, _ := recordCalLogIfNeed(mv_utils.CalFileHash, singleSealedPath, statSrc.Size(), cfg.Chunks)
-						dstHash, _ := recordCalLogIfNeed(mv_utils.CalFileHash, dst, statDst.Size(), cfg.Chunks)
-						if srcHash == dstHash && srcHash != "" && dstHash != "" {
-							tag = 1
-						} else {
-							tag = 0
-						}
-					} else {
-						tag = 0
-					}
-				} else {
-					tag = 0
-				}
-			}
-			if tag == 1 {
-				log.Debugf("src sealed file: %v already existed in dst %s,SealedTask done,check cost %v",
-					*t, p.Location, time.Now().Sub(sinceTime))
-				log.Debugf("task %v is existed in dst", *t)
-				return true
-			}
-		}
+	if loc, ok := isExistedInDst(t.OriSrc, srcPaths, cfg); ok {
+		log.Debugf("src sealed file: %v already existed in dst %s,SealedTask done,check cost %v",
+			*t, loc, time.Now().Sub(sinceTime))
+		log.Debugf("task %v is existed in dst", *t)
+		return true
 	}
 	return false
 }
@@ -291,3 +238,27 @@ func (t *SealedTask) getSrcPath() string {
 	defer taskListSingleton.TLock.Unlock()
 	return t.OriSrc
 }
+
+func (t *SealedTask) getTotalSize() int64 {
+	return t.TotalSize
+}
+
+func (t *SealedTask) getSrcMtime() int64 {
+	return t.SrcMtime
+}
+
+func (t *SealedTask) getPriority() int {
+	taskListSingleton.TLock.Lock()
+	defer taskListSingleton.TLock.Unlock()
+	return t.Priority
+}
+
+func (t *SealedTask) setPriority(p int) {
+	taskListSingleton.TLock.Lock()
+	defer taskListSingleton.TLock.Unlock()
+	t.Priority = p
+}
+
+func (t *SealedTask) getFileType() move_common.FileType {
+	return move_common.Sealed
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Adaptive tunes the thread limit of every host and path from the measured
+// throughput and latency: one more thread while a saturated path gets
+// faster, half of them when the chunk latency goes above the target
+type Adaptive struct {
+	Enabled         bool
+	IntervalSeconds int   // how often limits are tuned, default 30
+	TargetLatencyMs int   // read+write time per MiB copied taken as congestion, default 1000
+	PathMinThreads  int64 // default 1
+	PathMaxThreads  int64 // default to singlepaththreadlimit of the path
+	HostMinThreads  int   // default 1
+	HostMaxThreads  int   // default to bandwidth / singlethreadmbps
+}
+
+func checkAdaptiveConfig(a *Adaptive) error {
+	if a.IntervalSeconds < 0 || a.TargetLatencyMs < 0 || a.PathMinThreads < 0 || a.PathMaxThreads < 0 ||
+		a.HostMinThreads < 0 || a.HostMaxThreads < 0 {
+		return fmt.Errorf("adaptive values should not be negative")
+	}
+	if a.IntervalSeconds == 0 {
+		a.IntervalSeconds = 30
+	}
+	if a.TargetLatencyMs == 0 {
+		a.TargetLatencyMs = 1000
+	}
+	if a.PathMinThreads == 0 {
+		a.PathMinThreads = 1
+	}
+	if a.HostMinThreads == 0 {
+		a.HostMinThreads = 1
+	}
+	if a.PathMaxThreads > 0 && a.PathMaxThreads < a.PathMinThreads {
+		return fmt.Errorf("adaptive pathmaxthreads %d is less than pathminthreads %d", a.PathMaxThreads, a.PathMinThreads)
+	}
+	if a.HostMaxThreads > 0 && a.HostMaxThreads < a.HostMinThreads {
+		return fmt.Errorf("adaptive hostmaxthreads %d is less than hostminthreads %d", a.HostMaxThreads, a.HostMinThreads)
+	}
+	return nil
+}
+
+type adaptiveStat struct {
+	Bytes   int64
+	Chunks  int64
+	Latency time.Duration // sum of the read+write time per MiB of every chunk
+}
+
+// aimdState is what the last tuning of one host or path saw and decided
+type aimdState struct {
+	Limit      int64
+	Min        int64
+	Max        int64
+	MBPS       float64
+	Latency    time.Duration
+	Increased  bool
+	lastChange time.Time
+}
+
+type AdaptiveController struct {
+	Stats  map[string]*adaptiveStat
+	States map[string]*aimdState
+	ALock  *sync.Mutex
+}
+
+var adaptiveSingleton = AdaptiveController{
+	Stats:  make(map[string]*adaptiveStat),
+	States: make(map[string]*aimdState),
+	ALock:  new(sync.Mutex),
+}
+
+// record adds one chunk of n bytes copied through slot, cost is its read and
+// write time; short chunks are scaled to a MiB so latencies compare
+func (ac *AdaptiveController) record(slot *Slot, n int, cost time.Duration) {
+	if slot == nil || n <= 0 {
+		return
+	}
+	perMiB := cost * (1 << 20) / time.Duration(n)
+	ac.ALock.Lock()
+	defer ac.ALock.Unlock()
+	for _, key := range []string{
+		hostKey(SideSrc, slot.SrcIp),
+		pathKey(SideSrc, slot.SrcIp, slot.SrcPath),
+		hostKey(SideDst, slot.DstIp),
+		pathKey(SideDst, slot.DstIp, slot.DstPath),
+	} {
+		st, ok := ac.Stats[key]
+		if !ok {
+			st = new(adaptiveStat)
+			ac.Stats[key] = st
+		}
+		st.Bytes += int64(n)
+		st.Chunks++
+		st.Latency += perMiB
+	}
+}
+
+type adaptiveTarget struct {
+	key        string
+	configured int64
+	min        int64
+	max        int64
+}
+
+// adaptiveTargets lists every configured host and path with its bounds, a
+// schedule window caps them at its limits
+func adaptiveTargets(a Adaptive) []adaptiveTarget {
+	windowed := scheduleSingleton.window() != ""
+	targets := make([]adaptiveTarget, 0)
+	for _, side := range []string{SideSrc, SideDst} {
+		cm := &srcComputersMapSingleton
+		if side == SideDst {
+			cm = &dstComputersMapSingleton
+		}
+		cm.CLock.Lock()
+		for ip, cmp := range cm.CMap {
+			hostMax := int64(a.HostMaxThreads)
+			if hostMax == 0 || (windowed && hostMax > int64(cmp.LimitThread)) {
+				hostMax = int64(cmp.LimitThread)
+			}
+			targets = append(targets, adaptiveTarget{hostKey(side, ip), int64(cmp.LimitThread), int64(a.HostMinThreads), hostMax})
+			for _, p := range cmp.Paths {
+				pathMax := a.PathMaxThreads
+				if pathMax == 0 || (windowed && pathMax > p.SinglePathThreadLimit) {
+					pathMax = p.SinglePathThreadLimit
+				}
+				targets = append(targets, adaptiveTarget{pathKey(side, ip, p.Location), p.SinglePathThreadLimit, a.PathMinThreads, pathMax})
+			}
+		}
+		cm.CLock.Unlock()
+	}
+	return targets
+}
+
+func clampThreads(n, min, max int64) int64 {
+	if n > max {
+		n = max
+	}
+	if n < min {
+		n = min
+	}
+	return n
+}
+
+// tune runs one AIMD step on every host and path
+func (ac *AdaptiveController) tune(a Adaptive, interval time.Duration) {
+	ac.ALock.Lock()
+	stats := ac.Stats
+	ac.Stats = make(map[string]*adaptiveStat)
+	ac.ALock.Unlock()
+
+	target := time.Duration(a.TargetLatencyMs) * time.Millisecond
+	for _, t := range adaptiveTargets(a) {
+		if t.max < t.min {
+			t.max = t.min
+		}
+		cur, inUse := resourceManagerSingleton.limitAndUse(t.key, t.configured)
+		ac.ALock.Lock()
+		st, ok := ac.States[t.key]
+		if !ok {
+			st = &aimdState{}
+			ac.States[t.key] = st
+		}
+		ac.ALock.Unlock()
+
+		stat := stats[t.key]
+		var mbps float64
+		var latency time.Duration
+		if stat != nil && stat.Chunks > 0 {
+			mbps = float64(stat.Bytes) / float64(1<<20) / interval.Seconds()
+			latency = stat.Latency / time.Duration(stat.Chunks)
+		}
+		next := cur
+		switch {
+		case stat != nil && latency > target:
+			// congestion, multiplicative decrease
+			next = cur / 2
+		case stat != nil && inUse >= cur:
+			// saturated, keep adding threads while they bring throughput
+			if st.Increased && mbps < st.MBPS*1.05 {
+				next = cur - 1
+			} else {
+				next = cur + 1
+			}
+		}
+		next = clampThreads(next, t.min, t.max)
+		if next != cur {
+			resourceManagerSingleton.setLimit(t.key, next)
+			log.Infof("adaptive: %s threads %d -> %d, %.1f MB/s, chunk latency %v", t.key, cur, next, mbps, latency)
+		}
+		ac.ALock.Lock()
+		st.Increased = next > cur
+		st.Limit, st.Min, st.Max = next, t.min, t.max
+		if stat != nil {
+			st.MBPS, st.Latency = mbps, latency
+		} else {
+			st.MBPS, st.Latency = 0, 0
+		}
+		if next != cur {
+			st.lastChange = time.Now()
+		}
+		ac.ALock.Unlock()
+	}
+}
+
+// run tunes the limits until the process exits, the config may be reloaded meanwhile
+func (ac *AdaptiveController) run(cfg *Config) {
+	enabled := false
+	for !stop {
+		a := cfg.snapshot().Adaptive
+		interval := time.Duration(a.IntervalSeconds) * time.Second
+		if !a.Enabled {
+			if enabled {
+				resourceManagerSingleton.clearLimits()
+				log.Info("adaptive concurrency disabled, back to the configured thread limits")
+				enabled = false
+			}
+			time.Sleep(time.Second * 5)
+			continue
+		}
+		if !enabled {
+			log.Infof("adaptive concurrency enabled, tuning every %v", interval)
+			enabled = true
+			// what was measured before adaptive was disabled says nothing now
+			ac.ALock.Lock()
+			ac.Stats = make(map[string]*adaptiveStat)
+			ac.States = make(map[string]*aimdState)
+			ac.ALock.Unlock()
+		}
+		time.Sleep(interval)
+		if stop {
+			return
+		}
+		ac.tune(a, interval)
+		schedulerSingleton.notify()
+	}
+}
+
+func (ac *AdaptiveController) String() string {
+	ac.ALock.Lock()
+	defer ac.ALock.Unlock()
+	if len(ac.States) == 0 {
+		return ""
+	}
+	keys := make([]string, 0, len(ac.States))
+	for k := range ac.States {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var b strings.Builder
+	b.WriteString("adaptive threads:\n")
+	for _, k := range keys {
+		st := ac.States[k]
+		fmt.Fprintf(&b, "  %s: %d [%d,%d], %.1f MB/s, chunk latency %v", k, st.Limit, st.Min, st.Max, st.MBPS, st.Latency)
+		if !st.lastChange.IsZero() {
+			fmt.Fprintf(&b, ", changed %v ago", time.Now().Sub(st.lastChange).Truncate(time.Second))
+		}
+		b.WriteString("\n")
+	}
+	return b.String()
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func newTestAdaptive() *AdaptiveController {
+	return &AdaptiveController{
+		Stats:  make(map[string]*adaptiveStat),
+		States: make(map[string]*aimdState),
+		ALock:  new(sync.Mutex),
+	}
+}
+
+func TestAdaptiveRecord(t *testing.T) {
+	ac := newTestAdaptive()
+	slot := &Slot{SrcIp: testSrcIp, SrcPath: "/src1", DstIp: testDstIp, DstPath: "/dst1"}
+	// a half MiB chunk in 50ms and a full one in 100ms both take 100ms per MiB
+	ac.record(slot, 512<<10, 50*time.Millisecond)
+	ac.record(slot, 1<<20, 100*time.Millisecond)
+	ac.record(slot, 0, time.Second)
+	ac.record(nil, 1<<20, time.Second)
+	if len(ac.Stats) != 4 {
+		t.Fatalf("recorded %d keys, want the 2 hosts and 2 paths", len(ac.Stats))
+	}
+	for key, st := range ac.Stats {
+		if st.Bytes != 1536<<10 || st.Chunks != 2 || st.Latency/time.Duration(st.Chunks) != 100*time.Millisecond {
+			t.Fatalf("%s: %+v", key, *st)
+		}
+	}
+}
+
+func TestAdaptiveTune(t *testing.T) {
+	key := pathKey(SideDst, testDstIp, "/dst1")
+	a := Adaptive{Enabled: true, IntervalSeconds: 1, TargetLatencyMs: 1000, PathMinThreads: 1, HostMinThreads: 1}
+	mib := func(n int64, latency time.Duration) *adaptiveStat {
+		return &adaptiveStat{Bytes: n << 20, Chunks: n, Latency: time.Duration(n) * latency}
+	}
+	cases := []struct {
+		name  string
+		cur   int64 // tuned limit before the step, the configured one is 4
+		inUse int64
+		stat  *adaptiveStat
+		prev  *aimdState
+		want  int64
+	}{
+		{"idle keeps the limit", 2, 0, nil, nil, 2},
+		{"not saturated keeps the limit", 2, 1, mib(10, 100*time.Millisecond), nil, 2},
+		{"congestion halves", 4, 4, mib(10, 2*time.Second), nil, 2},
+		{"congestion stops at min", 1, 1, mib(10, 2*time.Second), nil, 1},
+		{"saturated adds one", 2, 2, mib(10, 100*time.Millisecond), nil, 3},
+		{"saturated stops at max", 4, 4, mib(10, 100*time.Millisecond), nil, 4},
+		{"the added thread brought throughput", 3, 3, mib(20, 100*time.Millisecond), &aimdState{Increased: true, MBPS: 10}, 4},
+		{"the added thread brought nothing", 3, 3, mib(10, 100*time.Millisecond), &aimdState{Increased: true, MBPS: 10}, 2},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			setupResources(t, 4, 4, 4, 4)
+			resourceManagerSingleton.Limits[key] = c.cur
+			resourceManagerSingleton.Paths[key] = c.inUse
+			ac := newTestAdaptive()
+			if c.stat != nil {
+				ac.Stats[key] = c.stat
+			}
+			if c.prev != nil {
+				ac.States[key] = c.prev
+			}
+			ac.tune(a, time.Second)
+			if got := resourceManagerSingleton.Limits[key]; got != c.want {
+				t.Fatalf("limit %d, want %d", got, c.want)
+			}
+			st := ac.States[key]
+			if st.Limit != c.want || st.Increased != (c.want > c.cur) || st.Min != 1 || st.Max != 4 {
+				t.Fatalf("state %+v", *st)
+			}
+			if len(ac.Stats) != 0 {
+				t.Fatalf("stats of the step left: %d", len(ac.Stats))
+			}
+		})
+	}
+}
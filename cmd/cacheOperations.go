@@ -9,15 +9,12 @@ package main
 import (
 	"errors"
 	"fmt"
-	"github.com/filecoin-project/go-state-types/big"
 	"move_sectors/move_common"
 	"move_sectors/mv_utils"
 	"os"
 	"path"
 	"path/filepath"
-	"sort"
 	"strings"
-	"syscall"
 	"time"
 )
 
@@ -31,6 +28,10 @@ type CacheTask struct {
 	TotalSize     int64
 	Status        string
 	SealProofType string
+	SrcMtime      int64
+	Priority      int
+	SrcCheck      string
+	DstCheck      string
 }
 
 var _ Operation = &CacheTask{}
@@ -39,8 +40,12 @@ func newCacheTask(singleCacheSrcDir, sId, oriSrc, srcIP string) (*CacheTask, err
 	var task = new(CacheTask)
 	// cal total cache size
 	var totalSize int64
+	var srcMtime int64
 	_ = filepath.Walk(singleCacheSrcDir, func(path string, info os.FileInfo, err error) error {
 		totalSize += info.Size()
+		if info.ModTime().Unix() > srcMtime {
+			srcMtime = info.ModTime().Unix()
+		}
 		return nil
 	})
 
@@ -60,6 +65,7 @@ func newCacheTask(singleCacheSrcDir, sId, oriSrc, srcIP string) (*CacheTask, err
 	task.CacheSrcDir = singleCacheSrcDir
 	task.TotalSize = totalSize
 	task.Status = StatusOnWaiting
+	task.SrcMtime = srcMtime
 	return task, nil
 }
 
@@ -67,17 +73,17 @@ func (t *CacheTask) canDo() bool {
 	srcComputersMapSingleton.CLock.Lock()
 	defer srcComputersMapSingleton.CLock.Unlock()
 	srcComputer := srcComputersMapSingleton.CMap[t.SrcIp]
-	var pathCurrentThread int64
-	var pathLimitThread int64
+	if srcComputer.Draining {
+		return false
+	}
 	for _, loc := range srcComputer.Paths {
-		if t.OriSrc == loc.Location {
-			pathCurrentThread = loc.CurrentThreads
-			pathLimitThread = loc.SinglePathThreadLimit
+		if t.OriSrc == strings.TrimRight(loc.Location, "/") {
+			if loc.Draining {
+				return false
+			}
+			return resourceManagerSingleton.hasFree(SideSrc, srcComputer, loc)
 		}
 	}
-	if srcComputer.CurrentThreads < srcComputer.LimitThread && pathCurrentThread < pathLimitThread {
-		return true
-	}
 	return false
 }
 
@@ -86,39 +92,11 @@ func (t *CacheTask) getBestDst() (string, string, error) {
 
 	dir, s, err := t.tryToFindGroupDir()
 	if err != nil {
-		if err.Error() == move_common.FondGroupButTooMuchThread {
-			return "", "", err
-		}
-
-		dstC, err := getOneFreeDstComputer()
-		if err != nil {
+		if e := err.Error(); e == move_common.FondGroupButTooMuchThread || e == move_common.GroupDirFull {
 			return "", "", err
 		}
-
-		log.Debugf("sorting dst paths")
-		paths := dstC.Paths
-		sort.Slice(paths, func(i, j int) bool {
-			var statI = new(syscall.Statfs_t)
-			_ = syscall.Statfs(paths[i].Location, statI)
-			var statJ = new(syscall.Statfs_t)
-			_ = syscall.Statfs(paths[j].Location, statJ)
-
-			iw := big.NewInt(int64(statI.Bavail*uint64(statI.Bsize)) / (paths[i].CurrentThreads + 1))
-			jw := big.NewInt(int64(statJ.Bavail*uint64(statJ.Bsize)) / (paths[j].CurrentThreads + 1))
-
-			return iw.GreaterThanEqual(jw)
-		})
-		log.Debugf("selecting dst paths for %s", t.SectorID)
-		for _, p := range paths {
-			var stat = new(syscall.Statfs_t)
-			_ = syscall.Statfs(p.Location, stat)
-			if stat.Bavail*uint64(stat.Bsize) > uint64(t.TotalSize) && p.CurrentThreads < p.SinglePathThreadLimit {
-				return p.Location, dstC.Ip, nil
-			}
-		}
-		return "", "", errors.New(move_common.NoDstSuitableForNow)
+		return getBestDstByPolicy(t.getSectorID(), t.TotalSize)
 	}
-	log.Debugf("found group path for %s cache", t.SectorID)
 	return dir, s, nil
 }
 
@@ -129,18 +107,26 @@ func (t *CacheTask) fullInfo(dstOri, dstIp string) {
 	t.DstIp = dstIp
 }
 
-func (t *CacheTask) startCopy(cfg *Config, dstPath string) {
+func (t *CacheTask) startCopy(cfg *Config, run *CopyRun) {
 	log.Infof("start to copying %v", *t)
 	// copying cache
-	err := copyDir(t.CacheSrcDir, t.CacheDstDir, cfg)
-	freeThreads(dstPath, t.DstIp, t.SrcIp, t.OriSrc)
+	err := copyDir(t.CacheSrcDir, t.CacheDstDir, cfg, run)
+	if err == nil {
+		// a corrupt cache copied faithfully is still a faulted sector
+		err = t.validateCacheDir(t.CacheDstDir)
+		t.setCheckResult(&t.DstCheck, err)
+	}
+	resourceManagerSingleton.release(run.slot)
 	if err != nil {
-		if err.Error() == move_common.StoppedBySyscall {
+		run.fail(err)
+		if err.Error() == move_common.StoppedBySyscall || err.Error() == move_common.CancelledByControl {
 			log.Warn(err)
 		} else {
 			log.Error(err)
 		}
-		os.RemoveAll(t.CacheDstDir)
+		if !run.keepPartial() {
+			os.RemoveAll(t.CacheDstDir)
+		}
 		if os.Getenv("SKIP_FAILED") == "1" {
 			t.setStatus(StatusDone)
 		} else {
@@ -155,6 +141,10 @@ func (t *CacheTask) startCopy(cfg *Config, dstPath string) {
 func (t *CacheTask) tryToFindGroupDir() (string, string, error) {
 	dstComputersMapSingleton.CLock.Lock()
 	defer dstComputersMapSingleton.CLock.Unlock()
+	// the persistent placement map goes first, it also knows parts still copying
+	if dir, ip, found, err := findAssignedDir(t.getSectorID(), t.getFileType(), t.TotalSize); found {
+		return dir, ip, err
+	}
 	log.Debugf("finding group dst, %s", t.SectorID)
 	// search sealed at first
 	for _, cmp := range dstComputersMapSingleton.CMap {
@@ -162,11 +152,9 @@ func (t *CacheTask) tryToFindGroupDir() (string, string, error) {
 			dstSealed := strings.TrimRight(p.Location, "/") + "/sealed/" + t.getSectorID()
 			_, err := os.Stat(dstSealed)
 			if err == nil {
-				if cmp.CurrentThreads < cmp.LimitThread && p.CurrentThreads < p.SinglePathThreadLimit {
+				if resourceManagerSingleton.hasFree(SideDst, cmp, p) {
 
-					var stat = new(syscall.Statfs_t)
-					_ = syscall.Statfs(p.Location, stat)
-					if stat.Bavail*uint64(stat.Bsize) <= uint64(t.TotalSize) {
+					if !capacityAllows(cmp, p, t.getSectorID(), t.TotalSize) {
 						log.Debugf("%v fond same group dir on %s, but disk has not enough space, will chose new dst", *t, p.Location)
 						return "", "", errors.New(move_common.NotEnoughSpace)
 					}
@@ -185,11 +173,9 @@ func (t *CacheTask) tryToFindGroupDir() (string, string, error) {
 			dstUnSealed := strings.TrimRight(p.Location, "/") + "/unsealed/" + t.getSectorID()
 			_, err := os.Stat(dstUnSealed)
 			if err == nil {
-				if cmp.CurrentThreads < cmp.LimitThread && p.CurrentThreads < p.SinglePathThreadLimit {
+				if resourceManagerSingleton.hasFree(SideDst, cmp, p) {
 
-					var stat = new(syscall.Statfs_t)
-					_ = syscall.Statfs(p.Location, stat)
-					if stat.Bavail*uint64(stat.Bsize) <= uint64(t.TotalSize) {
+					if !capacityAllows(cmp, p, t.getSectorID(), t.TotalSize) {
 						log.Debugf("%v fond same group dir on %s, but disk has not enough space, will chose new dst", *t, p.Location)
 						return "", "", errors.New(move_common.NotEnoughSpace)
 					}
@@ -258,44 +244,71 @@ func (t *CacheTask) checkSourceSize() ([]string, error) {
 			}
 		}
 	}
+	err = t.validateCacheDir(t.CacheSrcDir)
+	t.setCheckResult(&t.SrcCheck, err)
+	if err != nil {
+		return paths, err
+	}
 	return paths, nil
 }
 
+// validateCacheDir decodes p_aux and t_aux and checks every tree-r-last file of dir
+func (t *CacheTask) validateCacheDir(dir string) error {
+	srcPaths, err := t.makeSrcPathSliceForCache()
+	if err != nil {
+		return err
+	}
+	pAux, err := mv_utils.DecodePAux(path.Join(dir, "p_aux"))
+	if err != nil {
+		return err
+	}
+	if _, err = mv_utils.DecodeTAux(path.Join(dir, "t_aux")); err != nil {
+		return err
+	}
+	for _, p := range srcPaths {
+		if !strings.Contains(p, "tree-r") {
+			continue
+		}
+		treeRPath := path.Join(dir, path.Base(p))
+		size, err := getStandSize(t.SealProofType, treeRPath)
+		if err != nil {
+			return err
+		}
+		if err = mv_utils.CheckTreeRLast(treeRPath, size); err != nil {
+			return err
+		}
+	}
+
+	// the dst must carry exactly the commitments of the src
+	if dir != t.CacheSrcDir {
+		srcPAux, err := mv_utils.DecodePAux(path.Join(t.CacheSrcDir, "p_aux"))
+		if err != nil {
+			return err
+		}
+		if *srcPAux != *pAux {
+			return fmt.Errorf("p_aux of %s differs from source %s", dir, t.CacheSrcDir)
+		}
+	}
+	return nil
+}
+
+func (t *CacheTask) setCheckResult(field *string, err error) {
+	taskListSingleton.TLock.Lock()
+	defer taskListSingleton.TLock.Unlock()
+	if err != nil {
+		*field = err.Error()
+	} else {
+		*field = "ok"
+	}
+}
+
 func (t *CacheTask) checkIsExistedInDst(srcPaths []string, cfg *Config) bool {
-	dstComputersMapSingleton.CLock.Lock()
-	defer dstComputersMapSingleton.CLock.Unlock()
 	sinceTime := time.Now()
-	for _, v := range dstComputersMapSingleton.CMap {
-		for _, p := range v.Paths {
-			tag := 1
-			for _, singleCachePath := range srcPaths {
-				dst := strings.Replace(singleCachePath, t.OriSrc, p.Location, 1)
-				statSrc, _ := os.Stat(singleCachePath)
-				statDst, err := os.Stat(dst)
-				// if existed,check hash
-				if err == nil {
-					if statDst.Size() == statSrc.Size() {
-						srcHash, _ := recordCalLogIfNeed(mv_utils.CalFileHash, singleCachePath, statSrc.Size(), cfg.Chunks)
-						dstHash, _ := recordCalLogIfNeed(mv_utils.CalFileHash, dst, statDst.Size(), cfg.Chunks)
-						if srcHash == dstHash && srcHash != "" && dstHash != "" {
-							tag = 1
-						} else {
-							tag = 0
-						}
-					} else {
-						tag = 0
-					}
-				} else {
-					tag = 0
-				}
-			}
-			if tag == 1 {
-				log.Debugf("src cache file: %v already existed in dst %s,cacheTask done,check cost %v",
-					*t, p.Location, time.Now().Sub(sinceTime))
-				log.Debugf("task %v is existed in dst", *t)
-				return true
-			}
-		}
+	if loc, ok := isExistedInDst(t.OriSrc, srcPaths, cfg); ok {
+		log.Debugf("src cache file: %v already existed in dst %s,cacheTask done,check cost %v",
+			*t, loc, time.Now().Sub(sinceTime))
+		log.Debugf("task %v is existed in dst", *t)
+		return true
 	}
 	return false
 }
@@ -328,3 +341,27 @@ func (t *CacheTask) getSrcPath() string {
 	defer taskListSingleton.TLock.Unlock()
 	return t.OriSrc
 }
+
+func (t *CacheTask) getTotalSize() int64 {
+	return t.TotalSize
+}
+
+func (t *CacheTask) getSrcMtime() int64 {
+	return t.SrcMtime
+}
+
+func (t *CacheTask) getPriority() int {
+	taskListSingleton.TLock.Lock()
+	defer taskListSingleton.TLock.Unlock()
+	return t.Priority
+}
+
+func (t *CacheTask) setPriority(p int) {
+	taskListSingleton.TLock.Lock()
+	defer taskListSingleton.TLock.Unlock()
+	t.Priority = p
+}
+
+func (t *CacheTask) getFileType() move_common.FileType {
+	return move_common.Cache
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+)
+
+// CapacityPolicy limits how much of a dst path this tool may use, a
+// policy set on a computer applies to every path of it without its own one
+type CapacityPolicy struct {
+	MinFreeBytes   int64   // free space to keep on the path
+	MinFreePercent float64 // free space to keep in percent of the path size
+	MaxBytes       int64   // bytes this tool may write to the path
+	MaxSectors     int     // sectors this tool may write to the path
+}
+
+// CapacityUsage counts what copies of this tool wrote on each dst path, the
+// ones finished by earlier runs are seeded from the history at start
+type CapacityUsage struct {
+	Bytes   map[string]int64
+	Sectors map[string]map[string]struct{}
+	ULock   *sync.Mutex
+}
+
+var capacityUsageSingleton = CapacityUsage{
+	Bytes:   make(map[string]int64),
+	Sectors: make(map[string]map[string]struct{}),
+	ULock:   new(sync.Mutex),
+}
+
+func (cp CapacityPolicy) check() error {
+	if cp.MinFreeBytes < 0 || cp.MaxBytes < 0 || cp.MaxSectors < 0 {
+		return fmt.Errorf("capacity policy values should not be negative")
+	}
+	if cp.MinFreePercent < 0 || cp.MinFreePercent >= 100 {
+		return fmt.Errorf("minfreepercent should be in [0,100), got %v", cp.MinFreePercent)
+	}
+	return nil
+}
+
+// effectiveCapacityPolicy takes every unset value of the path from its computer
+func effectiveCapacityPolicy(cmp Computer, p Path) CapacityPolicy {
+	cp := p.CapacityPolicy
+	if cp.MinFreeBytes == 0 {
+		cp.MinFreeBytes = cmp.MinFreeBytes
+	}
+	if cp.MinFreePercent == 0 {
+		cp.MinFreePercent = cmp.MinFreePercent
+	}
+	if cp.MaxBytes == 0 {
+		cp.MaxBytes = cmp.MaxBytes
+	}
+	if cp.MaxSectors == 0 {
+		cp.MaxSectors = cmp.MaxSectors
+	}
+	return cp
+}
+
+// minFree is the free space to keep on a path of total bytes
+func (cp CapacityPolicy) minFree(total uint64) uint64 {
+	minFree := uint64(cp.MinFreeBytes)
+	if byPercent := uint64(float64(total) * cp.MinFreePercent / 100); byPercent > minFree {
+		minFree = byPercent
+	}
+	return minFree
+}
+
+func (u *CapacityUsage) add(run *CopyRun) {
+	u.ULock.Lock()
+	defer u.ULock.Unlock()
+	key := dstPathKey(run.DstIp, run.DstPath)
+	u.Bytes[key] += run.Size
+	if _, ok := u.Sectors[key]; !ok {
+		u.Sectors[key] = make(map[string]struct{})
+	}
+	u.Sectors[key][run.SectorID] = struct{}{}
+}
+
+// seed counts the sectors the history shows copied to a dst path of cfg by
+// earlier runs and still there, so MaxBytes and MaxSectors hold across runs.
+// Paths counted already are kept, so a reload seeds only the paths it added
+func (u *CapacityUsage) seed(cfg *Config) error {
+	records, err := historySingleton.records(HistoryFilter{Status: StatusDone})
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	bytes := make(map[string]int64)
+	sectors := make(map[string]map[string]struct{})
+	for _, rec := range lastDone(records) {
+		location := dstLocationOf(cfg, rec.DstIp, rec.DstPath)
+		if location == "" {
+			continue
+		}
+		if _, err := os.Stat(rec.DstPath); err != nil {
+			continue
+		}
+		key := dstPathKey(rec.DstIp, location)
+		bytes[key] += rec.Bytes
+		if _, ok := sectors[key]; !ok {
+			sectors[key] = make(map[string]struct{})
+		}
+		sectors[key][rec.SectorID] = struct{}{}
+	}
+	u.ULock.Lock()
+	defer u.ULock.Unlock()
+	for key := range bytes {
+		if _, ok := u.Bytes[key]; ok {
+			continue
+		}
+		u.Bytes[key], u.Sectors[key] = bytes[key], sectors[key]
+		log.Infof("dst %s: %d sectors %.1f GiB copied by earlier runs, counted for maxbytes and maxsectors", key, len(sectors[key]), gib(uint64(bytes[key])))
+	}
+	return nil
+}
+
+// dstLocationOf returns the dst path of cfg the file is under, "" if none
+func dstLocationOf(cfg *Config, ip, file string) string {
+	found := ""
+	for _, cmp := range cfg.DstComputers {
+		if cmp.Ip != ip {
+			continue
+		}
+		for _, p := range cmp.Paths {
+			location := strings.TrimRight(p.Location, "/")
+			if strings.HasPrefix(file, location+"/") && len(location) > len(found) {
+				found = location
+			}
+		}
+	}
+	return found
+}
+
+// copied returns the bytes of finished copies on the path
+func (u *CapacityUsage) copied(ip, location string) int64 {
+	u.ULock.Lock()
+	defer u.ULock.Unlock()
+	return u.Bytes[dstPathKey(ip, location)]
+}
+
+// used returns bytes and sectors of finished and in-flight copies on the path
+func (u *CapacityUsage) used(ip, location string) (int64, map[string]struct{}) {
+	key := dstPathKey(ip, location)
+	bytes, inFlight := reservationLedgerSingleton.inFlight(ip, location)
+	u.ULock.Lock()
+	defer u.ULock.Unlock()
+	bytes += u.Bytes[key]
+	for id := range u.Sectors[key] {
+		inFlight[id] = struct{}{}
+	}
+	return bytes, inFlight
+}
+
+// capacityAllows reports whether size bytes of sectorID may be written to the path now
+func capacityAllows(cmp Computer, p Path, sectorID string, size int64) bool {
+	if cmp.Draining || p.Draining {
+		return false
+	}
+	if !sectorStoreSingleton.allows(cmp.Ip, p.Location, size) {
+		return false
+	}
+	avail, total := getDiskSpace(p.Location)
+	reserved := reservationLedgerSingleton.reserved(cmp.Ip, p.Location)
+	if avail <= reserved || avail-reserved <= uint64(size) {
+		return false
+	}
+	avail -= reserved
+
+	cp := effectiveCapacityPolicy(cmp, p)
+	minFree := cp.minFree(total)
+	if avail-uint64(size) < minFree {
+		log.Debugf("dst %s %s would keep less than %d bytes free", cmp.Ip, p.Location, minFree)
+		return false
+	}
+
+	if cp.MaxBytes == 0 && cp.MaxSectors == 0 {
+		return true
+	}
+	usedBytes, sectors := capacityUsageSingleton.used(cmp.Ip, p.Location)
+	if cp.MaxBytes > 0 && usedBytes+size > cp.MaxBytes {
+		log.Debugf("dst %s %s reached max bytes %d", cmp.Ip, p.Location, cp.MaxBytes)
+		return false
+	}
+	if _, ok := sectors[sectorID]; cp.MaxSectors > 0 && !ok && len(sectors) >= cp.MaxSectors {
+		log.Debugf("dst %s %s reached max sectors %d", cmp.Ip, p.Location, cp.MaxSectors)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestEffectiveCapacityPolicy(t *testing.T) {
+	cmp := Computer{CapacityPolicy: CapacityPolicy{MinFreeBytes: 10, MinFreePercent: 5, MaxBytes: 100, MaxSectors: 3}}
+	cases := []struct {
+		name string
+		path CapacityPolicy
+		want CapacityPolicy
+	}{
+		{"path without policy takes the computer's", CapacityPolicy{}, cmp.CapacityPolicy},
+		{"path values win", CapacityPolicy{MinFreeBytes: 20, MaxSectors: 1}, CapacityPolicy{MinFreeBytes: 20, MinFreePercent: 5, MaxBytes: 100, MaxSectors: 1}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got := effectiveCapacityPolicy(cmp, Path{CapacityPolicy: c.path})
+			if got != c.want {
+				t.Fatalf("got %+v, want %+v", got, c.want)
+			}
+		})
+	}
+
+	if got := (CapacityPolicy{MinFreeBytes: 10, MinFreePercent: 5}).minFree(1000); got != 50 {
+		t.Errorf("minFree takes the larger of bytes and percent, got %d", got)
+	}
+	if err := (CapacityPolicy{MinFreePercent: 100}).check(); err == nil {
+		t.Errorf("minfreepercent 100 must be refused")
+	}
+}
+
+// resetCapacity empties the usage and reservations capacityAllows reads
+func resetCapacity(t *testing.T) {
+	t.Helper()
+	capacityUsageSingleton.Bytes = make(map[string]int64)
+	capacityUsageSingleton.Sectors = make(map[string]map[string]struct{})
+	reservationLedgerSingleton.Paths = make(map[string]map[*CopyRun]struct{})
+	sectorStoreSingleton.Paths = make(map[string]*PathStore)
+}
+
+func TestCapacityAllows(t *testing.T) {
+	const ip = "10.0.0.1"
+	location := t.TempDir()
+	avail, _ := getDiskSpace(location)
+	if avail < 1<<20 {
+		t.Skip("not enough free space in the temp dir")
+	}
+	half := int64(avail / 2)
+	usedBy := func(bytes int64, sectors ...string) func() {
+		return func() {
+			capacityUsageSingleton.add(&CopyRun{SectorID: sectors[0], DstIp: ip, DstPath: location, Size: bytes})
+			for _, id := range sectors[1:] {
+				capacityUsageSingleton.add(&CopyRun{SectorID: id, DstIp: ip, DstPath: location})
+			}
+		}
+	}
+	cases := []struct {
+		name     string
+		cmp      Computer
+		path     Path
+		sectorID string
+		size     int64
+		before   func()
+		want     bool
+	}{
+		{"fits", Computer{}, Path{}, "s-t01000-1", 1 << 20, nil, true},
+		{"draining computer", Computer{Draining: true}, Path{}, "s-t01000-1", 1 << 20, nil, false},
+		{"draining path", Computer{}, Path{Draining: true}, "s-t01000-1", 1 << 20, nil, false},
+		{"larger than free space", Computer{}, Path{}, "s-t01000-1", int64(avail), nil, false},
+		{"in-flight copies reserve the space", Computer{}, Path{}, "s-t01000-1", half, func() {
+			reservationLedgerSingleton.reserve(&CopyRun{SectorID: "s-t01000-2", DstIp: ip, DstPath: location, Size: half + 1<<20})
+		}, false},
+		{"min free bytes of the computer", Computer{CapacityPolicy: CapacityPolicy{MinFreeBytes: half + 1<<20}}, Path{}, "s-t01000-1", half, nil, false},
+		{"min free bytes of the path", Computer{}, Path{CapacityPolicy: CapacityPolicy{MinFreeBytes: half}}, "s-t01000-1", 1 << 20, nil, true},
+		{"max bytes reached", Computer{}, Path{CapacityPolicy: CapacityPolicy{MaxBytes: 2 << 20}}, "s-t01000-1", 1 << 20, usedBy(1<<20+1, "s-t01000-2"), false},
+		{"max bytes not reached", Computer{}, Path{CapacityPolicy: CapacityPolicy{MaxBytes: 2 << 20}}, "s-t01000-1", 1 << 20, usedBy(1<<20, "s-t01000-2"), true},
+		{"max sectors reached", Computer{}, Path{CapacityPolicy: CapacityPolicy{MaxSectors: 2}}, "s-t01000-1", 1 << 20, usedBy(0, "s-t01000-2", "s-t01000-3"), false},
+		// other kinds of a sector on the path already do not count again
+		{"max sectors counts a sector once", Computer{}, Path{CapacityPolicy: CapacityPolicy{MaxSectors: 2}}, "s-t01000-1", 1 << 20, usedBy(0, "s-t01000-1", "s-t01000-3"), true},
+		{"in-flight sectors count", Computer{}, Path{CapacityPolicy: CapacityPolicy{MaxSectors: 1}}, "s-t01000-1", 1 << 20, func() {
+			reservationLedgerSingleton.reserve(&CopyRun{SectorID: "s-t01000-2", DstIp: ip, DstPath: location, Size: 1 << 20})
+		}, false},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			resetCapacity(t)
+			defer resetCapacity(t)
+			if c.before != nil {
+				c.before()
+			}
+			c.cmp.Ip = ip
+			c.path.Location = location
+			if got := capacityAllows(c.cmp, c.path, c.sectorID, c.size); got != c.want {
+				t.Fatalf("capacityAllows %v, want %v", got, c.want)
+			}
+		})
+	}
+}
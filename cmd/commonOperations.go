@@ -21,6 +21,7 @@ import (
 	"path/filepath"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -28,6 +29,9 @@ const (
 	StatusOnWaiting = "StatusOnWaiting"
 	StatusOnWorking = "StatusOnWorking"
 	StatusDone      = "StatusDone"
+	StatusFailed    = "StatusFailed"
+	StatusCancelled = "StatusCancelled"
+	StatusSkipped   = "StatusSkipped"
 	ProofType32G    = "32G"
 	ProofType64G    = "64G"
 	TreeRFormat     = "sc-02-data-tree-r-last-%d.dat"
@@ -62,9 +66,14 @@ type Operation interface {
 	getInfo() interface{}
 	getSrcIp() string
 	getSrcPath() string
+	getTotalSize() int64
+	getFileType() move_common.FileType
+	getSrcMtime() int64
+	getPriority() int
+	setPriority(p int)
 	canDo() bool
 	getBestDst() (string, string, error)
-	startCopy(cfg *Config, dstPath string)
+	startCopy(cfg *Config, run *CopyRun)
 	getStatus() string
 	setStatus(st string)
 	fullInfo(dstOri, dstIp string)
@@ -73,42 +82,38 @@ type Operation interface {
 	tryToFindGroupDir() (string, string, error)
 }
 
-func getOneFreeDstComputer() (*Computer, error) {
-	dstComputersMapSingleton.CLock.Lock()
-	defer dstComputersMapSingleton.CLock.Unlock()
-	for _, cmp := range dstComputersMapSingleton.CMap {
-		if cmp.CurrentThreads < cmp.LimitThread {
-			return &cmp, nil
-		}
-	}
-	return nil, errors.New(move_common.NoDstSuitableForNow)
-}
-
-func copyDir(srcDir, dst string, cfg *Config) error {
+func copyDir(srcDir, dst string, cfg *Config, run *CopyRun) error {
+	chunks := cfg.snapshot().Chunks
 	if err := mv_utils.MakeDirIfNotExists(dst); err != nil {
 		return err
 	}
 	err := filepath.Walk(srcDir, func(path string, info os.FileInfo, err error) error {
-		if stop {
-			return errors.New(move_common.StoppedBySyscall)
+		if err := run.err(); err != nil {
+			return err
 		}
 		if info == nil || err != nil {
 			return err
 		}
 		if path != srcDir {
-			err = copying(path, dst+"/"+info.Name(), 0, cfg.Chunks)
+			err = copying(path, dst+"/"+info.Name(), 0, chunks, run)
 		}
 		return err
 	})
 	return err
 }
 
-func copying(src, dst string, singleThreadMBPS int, chunks int64) (err error) {
+func copying(src, dst string, singleThreadMBPS int, chunks int64, run *CopyRun) (err error) {
 
 	if src != dst {
+		// a file of a cache dir the interrupted copy finished already
+		if done := resumeOffset(src, dst, run); done > 0 && done == fileSize(src) {
+			log.Infof("%s was copied by the interrupted copy, keep it", dst)
+			run.resumed(done)
+			return nil
+		}
 		//fix path with QINIU
 		middlePath := dst + ".tmp"
-		if err = cp(src, middlePath, singleThreadMBPS, chunks); err != nil {
+		if err = cp(src, middlePath, singleThreadMBPS, chunks, run); err != nil {
 			return err
 		}
 
@@ -120,9 +125,52 @@ func copying(src, dst string, singleThreadMBPS int, chunks int64) (err error) {
 	return nil
 }
 
-func cp(src, dst string, singleThreadMBPS int, chunks int64) (err error) {
-	const BufferSize = 1 * 1024 * 1024
-	buf := make([]byte, BufferSize)
+const copyBufferSize = 1 * 1024 * 1024
+
+// resumeOffset returns how many bytes of dst an interrupted copy of src left
+// can be kept: the whole buffers the exist check finds the same as src, or all
+// of dst if it has the size of src. 0 if run does not resume or nothing fits
+func resumeOffset(src, dst string, run *CopyRun) int64 {
+	if run == nil || run.resume == nil {
+		return 0
+	}
+	info, err := os.Stat(dst)
+	if err != nil {
+		return 0
+	}
+	size := fileSize(src)
+	offset := info.Size()
+	if offset > size {
+		return 0
+	}
+	if offset < size {
+		offset -= offset % copyBufferSize
+	}
+	if offset == 0 {
+		return 0
+	}
+	same, err := mv_utils.SamePrefix(src, dst, offset, *run.resume, existCheckBudget)
+	if err != nil {
+		log.Warnf("check %s left by the interrupted copy failed, copy it from the start: %v", dst, err)
+		return 0
+	}
+	if !same {
+		log.Warnf("%s left by the interrupted copy differs from %s, copy it from the start", dst, src)
+		return 0
+	}
+	return offset
+}
+
+func fileSize(file string) int64 {
+	info, err := os.Stat(file)
+	if err != nil {
+		return -1
+	}
+	return info.Size()
+}
+
+func cp(src, dst string, singleThreadMBPS int, chunks int64, run *CopyRun) (err error) {
+	buf := make([]byte, copyBufferSize)
 
 	sourceFileStat, err := os.Stat(src)
 	if err != nil {
@@ -148,7 +196,8 @@ func cp(src, dst string, singleThreadMBPS int, chunks int64) (err error) {
 	if err != nil {
 		return err
 	}
-	destination, err := os.Create(dst)
+	offset := resumeOffset(src, dst, run)
+	destination, err := os.OpenFile(dst, os.O_RDWR|os.O_CREATE, 0666)
 	if err != nil {
 		return err
 	}
@@ -158,13 +207,28 @@ func cp(src, dst string, singleThreadMBPS int, chunks int64) (err error) {
 			err = err2
 		}
 	}()
+	if err = destination.Truncate(offset); err != nil {
+		return err
+	}
+	if offset > 0 {
+		if _, err = source.Seek(offset, io.SeekStart); err != nil {
+			return err
+		}
+		if _, err = destination.Seek(offset, io.SeekStart); err != nil {
+			return err
+		}
+		log.Infof("resume %s from %d of %d bytes the interrupted copy wrote", dst, offset, sourceFileStat.Size())
+		run.resumed(offset)
+	}
 
 	for {
-		if stop {
-			return errors.New(move_common.StoppedBySyscall)
+		if err := run.err(); err != nil {
+			return err
 		}
 
+		readStart := time.Now()
 		n, err := source.Read(buf)
+		readCost := time.Now().Sub(readStart)
 		if err != nil && err != io.EOF {
 			return err
 		}
@@ -172,15 +236,20 @@ func cp(src, dst string, singleThreadMBPS int, chunks int64) (err error) {
 			break
 		}
 
-		// 限速
+		// 限速，时间窗口切换时正在拷贝的文件也随之变速
 		if singleThreadMBPS != 0 {
+			if mbps := scheduleSingleton.singleThreadMBPS(); mbps > 0 {
+				singleThreadMBPS = mbps
+			}
 			sleepTime := 1000000 / int64(singleThreadMBPS)
 			time.Sleep(time.Microsecond * time.Duration(sleepTime))
 		}
 
+		writeStart := time.Now()
 		if _, err := destination.Write(buf[:n]); err != nil {
 			return err
 		}
+		run.addWritten(n, readCost+time.Now().Sub(writeStart))
 	}
 	return
 }
@@ -212,7 +281,7 @@ func getStandSize(proofType, path string) (int64, error) {
 		treeRSize = 9586976
 		pAuxSize = 64
 	default:
-		return 0, errors.New(fmt.Sprintf("this kind of SealProofType: %d should never existed", proofType))
+		return 0, errors.New(fmt.Sprintf("this kind of SealProofType: %s should never existed", proofType))
 	}
 
 	if strings.Contains(path, "unsealed") || strings.Contains(path, "sealed") {
@@ -239,93 +308,71 @@ func compareSize(path string, base int64, delta int) error {
 	return nil
 }
 
-func recordCalLogIfNeed(calFunc func(string, int64, int64) (string, error), filePath string, size int64, chunks int64) (string, error) {
+func recordCalLogIfNeed(filePath string, size int64, cfg *Config) (string, error) {
+	hashThreads <- struct{}{}
+	defer func() {
+		<-hashThreads
+	}()
+	opt := cfg.ExistCheck.hashOption()
+	if hashCacheSingleton != nil {
+		if s, ok := hashCacheSingleton.Get(filePath, opt.Key()); ok {
+			log.Debugf("cal %s calHash hit cache, result: %s", filePath, s)
+			return s, nil
+		}
+	}
 	since := time.Now()
-	s, err := calFunc(filePath, size, chunks)
+	s, err := mv_utils.CalFileHashWithOption(filePath, size, opt, existCheckBudget)
 	log.Debugf("cal %s calHash cost %v, result: %s", filePath, time.Now().Sub(since), s)
+	if err == nil && hashCacheSingleton != nil {
+		if err := hashCacheSingleton.Put(filePath, opt.Key(), s); err != nil {
+			log.Warnf("save hash of %s into cache failed: %v", filePath, err)
+		}
+	}
 	return s, err
 }
 
-func occupyThreads(dstPath, dstIp, srcIp, srcPath string) {
-	srcComputersMapSingleton.CLock.Lock()
-	dstComputersMapSingleton.CLock.Lock()
-	// srcComputer && srcPath
-	srcComputer := srcComputersMapSingleton.CMap[srcIp]
-	log.Debugf("occupySrcComputer:before %d,ip %s", srcComputer.CurrentThreads, srcIp)
-	srcComputer.CurrentThreads++
-	// srcPath
-	for idx, loc := range srcComputer.Paths {
-		if srcPath == loc.Location {
-			loc.CurrentThreads++
-			srcComputer.Paths[idx] = loc
+// isExistedInDst returns the dst location which already holds every file in srcPaths
+func isExistedInDst(oriSrc string, srcPaths []string, cfg *Config) (string, bool) {
+	relPaths := make([]string, len(srcPaths))
+	sizes := make([]int64, len(srcPaths))
+	for i, src := range srcPaths {
+		statSrc, err := os.Stat(src)
+		if err != nil {
+			return "", false
 		}
+		relPaths[i] = strings.TrimPrefix(strings.TrimPrefix(src, oriSrc), "/")
+		sizes[i] = statSrc.Size()
 	}
-	srcComputersMapSingleton.CMap[srcIp] = srcComputer
-	log.Debugf("occupySrcComputer:after %d,ip %s", srcComputersMapSingleton.CMap[srcIp].CurrentThreads, srcIp)
-
-	// dstComputer
-	dstComputer := dstComputersMapSingleton.CMap[dstIp]
-	log.Debugf("occupyDstComputer:before %d,ip %s", dstComputer.CurrentThreads, dstIp)
-	dstComputer.CurrentThreads++
-	dstComputersMapSingleton.CMap[dstIp] = dstComputer
-	log.Debugf("occupyDstComputer:after %d,ip %s", dstComputersMapSingleton.CMap[dstIp].CurrentThreads, dstIp)
-
-	// dstPath
-	for idx, p := range dstComputer.Paths {
-		if p.Location == dstPath {
-			log.Debugf("occupyDstPathThread:before %d,ip %s,path %s", p.CurrentThreads, dstIp, p.Location)
-			p.CurrentThreads++
-			dstComputer.Paths[idx] = p
-			dstComputersMapSingleton.CMap[dstIp] = dstComputer
-			log.Debugf("occupyDstPathThread:after %d,ip %s,path %s", p.CurrentThreads, dstIp, p.Location)
+	// sizes are compared through the index, only matched locations are hashed
+	for _, loc := range dstIndexSingleton.candidates(relPaths, sizes) {
+		if cfg.ExistCheck.Mode == mv_utils.CheckModeSize || isSameFilesInDst(oriSrc, loc, srcPaths, sizes, cfg) {
+			return loc, true
 		}
 	}
-
-	srcComputersMapSingleton.CLock.Unlock()
-	dstComputersMapSingleton.CLock.Unlock()
+	return "", false
 }
 
-func freeThreads(dstPath, dstIp, srcIp, srcPath string) {
-	srcComputersMapSingleton.CLock.Lock()
-	dstComputersMapSingleton.CLock.Lock()
-	//srcComputer
-	srcComputer := srcComputersMapSingleton.CMap[srcIp]
-	log.Debugf("releaseSrcComputer:before %d,ip %s", srcComputer.CurrentThreads, srcIp)
-	if srcComputer.CurrentThreads < 0 {
-		log.Errorf("wrong thread num,required num is bigger than 0,but %d", srcComputer.CurrentThreads)
-	}
-	srcComputer.CurrentThreads--
-	// srcPath
-	for idx, loc := range srcComputer.Paths {
-		if srcPath == loc.Location {
-			loc.CurrentThreads--
-			srcComputer.Paths[idx] = loc
-		}
-	}
-	srcComputersMapSingleton.CMap[srcIp] = srcComputer
-	log.Debugf("releaseSrcComputer:after %d,ip %s", srcComputersMapSingleton.CMap[srcIp].CurrentThreads, srcIp)
-
-	//dstComputer
-	dstComputer := dstComputersMapSingleton.CMap[dstIp]
-	log.Debugf("releaseDstComputer:before %d,ip %s", dstComputer.CurrentThreads, dstIp)
-	if dstComputer.CurrentThreads < 0 {
-		log.Errorf("wrong thread num,required num is bigger than 0,but %d", dstComputer.CurrentThreads)
-	}
-	dstComputer.CurrentThreads--
-	dstComputersMapSingleton.CMap[dstIp] = dstComputer
-	log.Debugf("releaseDstComputer:after %d,ip %s",
-		dstComputersMapSingleton.CMap[dstIp].CurrentThreads, dstIp)
-
-	// dstPath
-	for idx, p := range dstComputer.Paths {
-		if p.Location == dstPath {
-			log.Debugf("releaseDstPathThread:before %d,ip %s,path %s", p.CurrentThreads, dstIp, p.Location)
-			p.CurrentThreads--
-			dstComputer.Paths[idx] = p
-			dstComputersMapSingleton.CMap[dstIp] = dstComputer
-			log.Debugf("releaseDstPathThread:after %d,ip %s,path %s", p.CurrentThreads, dstIp, p.Location)
-		}
+func isSameFilesInDst(oriSrc, dstLocation string, srcPaths []string, sizes []int64, cfg *Config) bool {
+	var same int32 = 1
+	wg := sync.WaitGroup{}
+	for i := range srcPaths {
+		idx := i
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			idleIOIfNeed(cfg)
+			srcHash, err := recordCalLogIfNeed(srcPaths[idx], sizes[idx], cfg)
+			if err != nil {
+				atomic.StoreInt32(&same, 0)
+				return
+			}
+			dst := strings.Replace(srcPaths[idx], oriSrc, dstLocation, 1)
+			dstHash, err := recordCalLogIfNeed(dst, sizes[idx], cfg)
+			if err != nil || srcHash != dstHash || srcHash == "" {
+				atomic.StoreInt32(&same, 0)
+			}
+		}()
 	}
-	srcComputersMapSingleton.CLock.Unlock()
-	dstComputersMapSingleton.CLock.Unlock()
+	wg.Wait()
+	return atomic.LoadInt32(&same) == 1
 }
@@ -12,13 +12,45 @@ import (
 	"gopkg.in/yaml.v2"
 	"io/ioutil"
 	"move_sectors/mv_utils"
+	"path/filepath"
+	"runtime"
+	"sync"
 )
 
+// configLock guards the fields of the running config a reload replaces and
+// placementPolicySingleton, goroutines read them through snapshot
+var configLock = new(sync.RWMutex)
+
 type Config struct {
 	SrcComputers     []Computer
 	DstComputers     []Computer
 	SingleThreadMBPS int
 	Chunks           int64
+	ExistCheck       ExistCheck
+	HashCacheFile    string // default to mv_sectors_hash.db next to the config file
+	DisableHashCache bool
+	PlacementPolicy  string   // most-free, fill-first, round-robin, weighted or least-loaded
+	PriorityRules    []string // oldest-mtime, lowest-sector, fullest-source, applied in order
+	PlacementMapFile string   // default to mv_sectors_placement.db next to the config file
+	MaxRetries       int      // failed copies of a task before it is marked failed, 0 means retry forever
+	Adaptive         Adaptive
+	LoadGuard        LoadGuard
+	Schedule         []TimeWindow // rate and concurrency limits of time windows, the first matching applies
+	ThroughputFile   string       // default to mv_sectors_throughput.json next to the config file
+	JournalDir       string       // journals of jobs, default to mv_sectors_jobs next to the config file
+	HistoryFile      string       // how every task ended, default to mv_sectors_history.db next to the config file
+
+	filePath string
+}
+
+// ExistCheck describes how to decide a file is already present in dst
+type ExistCheck struct {
+	Mode         string // size, sample or full
+	BlockSize    int64  // bytes per sampled block
+	Blocks       int64  // sampled blocks per file, default to Chunks
+	Algorithm    string // crc32, md5, sha1 or sha256
+	Parallel     int    // files hashed at the same time
+	IOBudgetMBPS int    // MB/s all hashing may read, 0 means no limit
 }
 
 type Computer struct {
@@ -26,13 +58,30 @@ type Computer struct {
 	Paths          []Path
 	BandWidth      int
 	LimitThread    int
-	CurrentThreads int
+	Draining       bool `yaml:"-"` // removed from the config by a reload
+	Weight         int  // fair share weight of a src computer, default to 1
+	CapacityPolicy `yaml:",inline"`
 }
 
 type Path struct {
 	Location              string
 	SinglePathThreadLimit int64
-	CurrentThreads        int64
+	Draining              bool `yaml:"-"` // removed from the config by a reload
+	Weight                int  // fair share weight on src, weighted placement policy on dst, default to 1
+	CapacityPolicy        `yaml:",inline"`
+}
+
+// snapshot copies the config, a reload replaces slices instead of changing them
+func (c *Config) snapshot() Config {
+	configLock.RLock()
+	defer configLock.RUnlock()
+	return *c
+}
+
+func currentPlacementPolicy() PlacementPolicy {
+	configLock.RLock()
+	defer configLock.RUnlock()
+	return placementPolicySingleton
 }
 
 func getConfig(cctx *cli.Context) (*Config, error) {
@@ -41,6 +90,11 @@ func getConfig(cctx *cli.Context) (*Config, error) {
 	if err != nil {
 		return nil, err
 	}
+	return loadConfig(configFilePath)
+}
+
+// loadConfig reads and checks the config file, used at start and on reload
+func loadConfig(configFilePath string) (*Config, error) {
 	config, err := LoadConfigFromFile(configFilePath)
 	if err != nil {
 		return nil, err
@@ -48,6 +102,32 @@ func getConfig(cctx *cli.Context) (*Config, error) {
 	if qualifiedConfig, err := isQualifiedConfig(config); !qualifiedConfig {
 		return nil, fmt.Errorf("config file: %v error:%v", configFilePath, err)
 	}
+	config.filePath = configFilePath
+	if config.HashCacheFile == "" {
+		config.HashCacheFile = filepath.Join(filepath.Dir(configFilePath), "mv_sectors_hash.db")
+	} else if config.HashCacheFile, err = mv_utils.GetAbsPath(config.HashCacheFile); err != nil {
+		return nil, err
+	}
+	if config.PlacementMapFile == "" {
+		config.PlacementMapFile = filepath.Join(filepath.Dir(configFilePath), "mv_sectors_placement.db")
+	} else if config.PlacementMapFile, err = mv_utils.GetAbsPath(config.PlacementMapFile); err != nil {
+		return nil, err
+	}
+	if config.ThroughputFile == "" {
+		config.ThroughputFile = filepath.Join(filepath.Dir(configFilePath), "mv_sectors_throughput.json")
+	} else if config.ThroughputFile, err = mv_utils.GetAbsPath(config.ThroughputFile); err != nil {
+		return nil, err
+	}
+	if config.JournalDir == "" {
+		config.JournalDir = filepath.Join(filepath.Dir(configFilePath), "mv_sectors_jobs")
+	} else if config.JournalDir, err = mv_utils.GetAbsPath(config.JournalDir); err != nil {
+		return nil, err
+	}
+	if config.HistoryFile == "" {
+		config.HistoryFile = filepath.Join(filepath.Dir(configFilePath), "mv_sectors_history.db")
+	} else if config.HistoryFile, err = mv_utils.GetAbsPath(config.HistoryFile); err != nil {
+		return nil, err
+	}
 	return config, nil
 }
 
@@ -79,5 +159,61 @@ func isQualifiedConfig(cfg *Config) (bool, error) {
 		log.Errorf("lowest chunks required 3 but %d, chunks is force set to 3", cfg.Chunks)
 		cfg.Chunks = 3
 	}
+	if err := checkExistCheckConfig(&cfg.ExistCheck, cfg.Chunks); err != nil {
+		return false, err
+	}
+	if err := checkPriorityRules(cfg.PriorityRules); err != nil {
+		return false, err
+	}
+	if cfg.MaxRetries < 0 {
+		return false, fmt.Errorf("maxretries should not be negative")
+	}
+	if err := checkAdaptiveConfig(&cfg.Adaptive); err != nil {
+		return false, err
+	}
+	if err := checkLoadGuardConfig(&cfg.LoadGuard); err != nil {
+		return false, err
+	}
+	if err := checkSchedule(cfg.Schedule); err != nil {
+		return false, err
+	}
 	return true, nil
 }
+
+func checkExistCheckConfig(ec *ExistCheck, chunks int64) error {
+	if ec.Mode == "" {
+		ec.Mode = mv_utils.CheckModeSample
+	}
+	if ec.BlockSize <= 0 {
+		ec.BlockSize = mv_utils.DefaultBlockSize
+	}
+	if ec.Blocks <= 0 {
+		ec.Blocks = chunks
+	}
+	if ec.Algorithm == "" {
+		ec.Algorithm = mv_utils.HashCrc32
+	}
+	if ec.Parallel <= 0 {
+		ec.Parallel = runtime.NumCPU()
+	}
+	switch ec.Mode {
+	case mv_utils.CheckModeSize, mv_utils.CheckModeSample, mv_utils.CheckModeFull:
+	default:
+		return fmt.Errorf("unknown existcheck mode %s,options: size,sample,full", ec.Mode)
+	}
+	switch ec.Algorithm {
+	case mv_utils.HashCrc32, mv_utils.HashMd5, mv_utils.HashSha1, mv_utils.HashSha256:
+	default:
+		return fmt.Errorf("unknown existcheck algorithm %s,options: crc32,md5,sha1,sha256", ec.Algorithm)
+	}
+	return nil
+}
+
+func (ec *ExistCheck) hashOption() mv_utils.HashOption {
+	return mv_utils.HashOption{
+		Mode:      ec.Mode,
+		BlockSize: ec.BlockSize,
+		Blocks:    ec.Blocks,
+		Algorithm: ec.Algorithm,
+	}
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/urfave/cli/v2"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	CtrlHold         = "hold"
+	CtrlResume       = "resume"
+	CtrlStopGraceful = "stop-graceful"
+	CtrlStopNow      = "stop-now"
+	CtrlStatus       = "status"
+	CtrlTaskCancel   = "task-cancel"
+	CtrlTaskRetry    = "task-retry"
+	CtrlTaskSkip     = "task-skip"
+	CtrlTaskPin      = "task-pin"
+	CtrlTaskPriority = "task-priority"
+	CtrlJob          = "job"
+)
+
+// ControlRequest is one command sent to the running process over the control socket
+type ControlRequest struct {
+	Cmd  string
+	Args map[string]string
+}
+
+type ControlResponse struct {
+	Ok  bool
+	Msg string
+}
+
+type controlHandler func(req *ControlRequest) (string, error)
+
+var controlHandlers = map[string]controlHandler{
+	CtrlHold: func(req *ControlRequest) (string, error) {
+		schedulerSingleton.setHeld(true)
+		return fmt.Sprintf("held, %d running copies will finish", schedulerSingleton.runningNum()), nil
+	},
+	CtrlResume: func(req *ControlRequest) (string, error) {
+		schedulerSingleton.setHeld(false)
+		return "resumed", nil
+	},
+	CtrlStopGraceful: func(req *ControlRequest) (string, error) {
+		schedulerSingleton.stopGracefully()
+		return fmt.Sprintf("stopping after %d running copies finish", schedulerSingleton.runningNum()), nil
+	},
+	CtrlStopNow: func(req *ControlRequest) (string, error) {
+		stopNow()
+		return "stopping now, running copies are cancelled", nil
+	},
+	CtrlStatus: func(req *ControlRequest) (string, error) {
+		s := &schedulerSingleton
+		s.SLock.Lock()
+		head := fmt.Sprintf("waiting tasks: %d, held: %v, stopping: %v\n", len(s.Ready), s.Held, s.Stopping)
+		s.SLock.Unlock()
+		return head + journalSingleton.String() + resourceManagerSingleton.snapshot().String() + scheduleSingleton.String() + adaptiveSingleton.String() + loadGuardSingleton.String(), nil
+	},
+	CtrlTaskCancel:   cancelTask,
+	CtrlTaskRetry:    retryTask,
+	CtrlTaskSkip:     skipTask,
+	CtrlTaskPin:      pinTask,
+	CtrlTaskPriority: prioritizeTask,
+	CtrlJob:          jobSummary,
+}
+
+// startControlServer listens on the control socket, the caller holds the
+// job lock so a socket file left there is stale
+func startControlServer(sockPath string) (net.Listener, error) {
+	_ = os.Remove(sockPath)
+	l, err := net.Listen("unix", sockPath)
+	if err != nil {
+		return nil, fmt.Errorf("listen control socket %s: %w", sockPath, err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go serveControlConn(conn)
+		}
+	}()
+	log.Infof("control socket listening on %s", sockPath)
+	return l, nil
+}
+
+func serveControlConn(conn net.Conn) {
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(time.Minute))
+	var req ControlRequest
+	var resp ControlResponse
+	if err := json.NewDecoder(conn).Decode(&req); err != nil {
+		resp.Msg = err.Error()
+	} else if handler, ok := controlHandlers[req.Cmd]; !ok {
+		resp.Msg = fmt.Sprintf("unknown control command %s", req.Cmd)
+	} else if msg, err := handler(&req); err != nil {
+		resp.Msg = err.Error()
+	} else {
+		resp.Ok = true
+		resp.Msg = msg
+		if req.Cmd != CtrlStatus {
+			log.Infof("control command %s %v done: %s", req.Cmd, req.Args, msg)
+		}
+	}
+	_ = json.NewEncoder(conn).Encode(&resp)
+}
+
+// sendControl sends one request to the running process and returns its answer
+func sendControl(sockPath string, req *ControlRequest) (string, error) {
+	conn, err := net.DialTimeout("unix", sockPath, 5*time.Second)
+	if err != nil {
+		return "", fmt.Errorf("can not connect to the running process, is it running? %w", err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(time.Minute))
+	if err = json.NewEncoder(conn).Encode(req); err != nil {
+		return "", err
+	}
+	var resp ControlResponse
+	if err = json.NewDecoder(conn).Decode(&resp); err != nil {
+		return "", err
+	}
+	if !resp.Ok {
+		return "", errors.New(resp.Msg)
+	}
+	return resp.Msg, nil
+}
+
+// controlAction sends cmd with the flags named in args as its arguments
+func controlAction(cmd string, args ...string) cli.ActionFunc {
+	return func(cctx *cli.Context) error {
+		req := &ControlRequest{Cmd: cmd, Args: make(map[string]string)}
+		for _, name := range args {
+			req.Args[name] = cctx.String(name)
+		}
+		sock, err := jobSocket(cctx)
+		if err != nil {
+			return err
+		}
+		msg, err := sendControl(sock, req)
+		if err != nil {
+			return err
+		}
+		fmt.Println(strings.TrimRight(msg, "\n"))
+		return nil
+	}
+}
+
+var HoldCmd = &cli.Command{
+	Name:   "hold",
+	Usage:  "finish running copies and start no new ones",
+	Flags:  []cli.Flag{jobFlag},
+	Action: controlAction(CtrlHold),
+}
+
+var ResumeCmd = &cli.Command{
+	Name:   "resume",
+	Usage:  "start new copies again after hold",
+	Flags:  []cli.Flag{jobFlag},
+	Action: controlAction(CtrlResume),
+}
+
+var StatusCmd = &cli.Command{
+	Name:   "status",
+	Usage:  "show the threads in use and the running copies",
+	Flags:  []cli.Flag{jobFlag},
+	Action: controlAction(CtrlStatus),
+}
+
+var StopCmd = &cli.Command{
+	Name:  "stop",
+	Usage: "stop the running process",
+	Flags: []cli.Flag{
+		jobFlag,
+		&cli.BoolFlag{
+			Name:  "graceful",
+			Usage: "finish running copies, then exit",
+		},
+		&cli.BoolFlag{
+			Name:  "now",
+			Usage: "cancel running copies and exit",
+		},
+	},
+	Action: func(cctx *cli.Context) error {
+		if cctx.Bool("graceful") == cctx.Bool("now") {
+			return errors.New("you must tell how to stop,options: --graceful,--now")
+		}
+		if cctx.Bool("graceful") {
+			return controlAction(CtrlStopGraceful)(cctx)
+		}
+		return controlAction(CtrlStopNow)(cctx)
+	},
+}
+
+var taskFlags = []cli.Flag{
+	jobFlag,
+	&cli.StringFlag{
+		Name:     "sector",
+		Usage:    "sector id of the task, like s-t01000-1",
+		Required: true,
+	},
+	&cli.StringFlag{
+		Name:  "kind",
+		Usage: "file kind of the task: Sealed, UnSealed or Cache, could be omitted if the sector has only one",
+	},
+}
+
+var TaskCmd = &cli.Command{
+	Name:  "task",
+	Usage: "control one task of the running process",
+	Subcommands: []*cli.Command{
+		{
+			Name:   "cancel",
+			Usage:  "cancel the task and remove what it copied",
+			Flags:  taskFlags,
+			Action: controlAction(CtrlTaskCancel, "sector", "kind"),
+		},
+		{
+			Name:   "retry",
+			Usage:  "copy the task again, a running copy restarts from scratch",
+			Flags:  taskFlags,
+			Action: controlAction(CtrlTaskRetry, "sector", "kind"),
+		},
+		{
+			Name:   "skip",
+			Usage:  "mark the task skipped, a running copy is cancelled",
+			Flags:  taskFlags,
+			Action: controlAction(CtrlTaskSkip, "sector", "kind"),
+		},
+		{
+			Name:  "pin",
+			Usage: "copy the task to the given dst path only",
+			Flags: append([]cli.Flag{
+				&cli.StringFlag{
+					Name:     "dst-ip",
+					Usage:    "ip of the dst computer",
+					Required: true,
+				},
+				&cli.StringFlag{
+					Name:     "dst-path",
+					Usage:    "location of the dst path",
+					Required: true,
+				},
+			}, taskFlags...),
+			Action: controlAction(CtrlTaskPin, "sector", "kind", "dst-ip", "dst-path"),
+		},
+		{
+			Name:  "priority",
+			Usage: "set the priority of the task, higher goes first",
+			Flags: append([]cli.Flag{
+				&cli.StringFlag{
+					Name:     "priority",
+					Usage:    "the new priority",
+					Required: true,
+				},
+			}, taskFlags...),
+			Action: controlAction(CtrlTaskPriority, "sector", "kind", "priority"),
+		},
+	},
+}
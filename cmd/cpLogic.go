@@ -16,166 +16,239 @@ import (
 	"os"
 	"path/filepath"
 	"runtime"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 )
 
 func initializeComputerMapSingleton(cfg *Config) error {
+	srcMap, err := makeComputersMap(cfg.SrcComputers, cfg.SingleThreadMBPS, false)
+	if err != nil {
+		return err
+	}
+	dstMap, err := makeComputersMap(cfg.DstComputers, cfg.SingleThreadMBPS, true)
+	if err != nil {
+		return err
+	}
 	for _, v := range cfg.SrcComputers {
-		if v.Ip == "" || v.BandWidth == 0 || len(v.Paths) == 0 {
-			return errors.New("invalid computer ip, BandWidth or paths; please check the config")
-		}
-		if _, ok := srcComputersMapSingleton.CMap[v.Ip]; !ok {
-			v.LimitThread = calThreadLimit(v.BandWidth, cfg.SingleThreadMBPS)
-			srcComputersMapSingleton.CMap[v.Ip] = v
-			checkDoubled := make(map[string]struct{})
-			for _, path := range v.Paths {
-				if path.SinglePathThreadLimit <= 0 {
-					return errors.New("invalid single path thread limit")
-				}
-				if _, ok = checkDoubled[path.Location]; ok {
-					return fmt.Errorf("doubled path:%s in same ip:%s", path.Location, v.Ip)
-				}
-				checkDoubled[path.Location] = struct{}{}
-			}
-		} else {
-			return errors.New("double computer ip,please check the config")
+		fairShareSingleton.setWeights(v)
+	}
+	for _, v := range cfg.DstComputers {
+		for _, path := range v.Paths {
+			dstOrderSingleton[dstPathKey(v.Ip, path.Location)] = len(dstOrderSingleton)
 		}
 	}
+	srcComputersMapSingleton.CMap = srcMap
+	dstComputersMapSingleton.CMap = dstMap
+	sectorStoreSingleton.load(cfg)
+	scheduleSingleton.apply(cfg)
+	return nil
+}
 
-	for _, v := range cfg.DstComputers {
+// makeComputersMap checks the computers of the config and computes their thread limits
+func makeComputersMap(computers []Computer, singleThreadMBPS int, isDst bool) (map[string]Computer, error) {
+	cMap := make(map[string]Computer)
+	for _, v := range computers {
 		if v.Ip == "" || v.BandWidth == 0 || len(v.Paths) == 0 {
-			return errors.New("invalid computer ip, BandWidth or paths; please check the config")
+			return nil, errors.New("invalid computer ip, BandWidth or paths; please check the config")
 		}
-		if _, ok := dstComputersMapSingleton.CMap[v.Ip]; !ok {
-			v.LimitThread = calThreadLimit(v.BandWidth, cfg.SingleThreadMBPS)
-			dstComputersMapSingleton.CMap[v.Ip] = v
+		if isDst {
+			if err := v.CapacityPolicy.check(); err != nil {
+				return nil, fmt.Errorf("dst computer %s: %v", v.Ip, err)
+			}
+		}
+		if _, ok := cMap[v.Ip]; !ok {
+			v.LimitThread = calThreadLimit(v.BandWidth, singleThreadMBPS)
+			cMap[v.Ip] = v
 			checkDoubled := make(map[string]struct{})
 			for _, path := range v.Paths {
 				if path.SinglePathThreadLimit <= 0 {
-					return errors.New("invalid single path thread limit")
+					return nil, errors.New("invalid single path thread limit")
 				}
 				if _, ok = checkDoubled[path.Location]; ok {
-					return fmt.Errorf("doubled path:%s in same ip:%s", path.Location, v.Ip)
+					return nil, fmt.Errorf("doubled path:%s in same ip:%s", path.Location, v.Ip)
 				}
 				checkDoubled[path.Location] = struct{}{}
+				if isDst {
+					if err := path.CapacityPolicy.check(); err != nil {
+						return nil, fmt.Errorf("dst path %s: %v", path.Location, err)
+					}
+				}
 			}
 		} else {
-			return errors.New("double computer ip,please check the config")
+			return nil, errors.New("double computer ip,please check the config")
 		}
 	}
-
-	return nil
+	return cMap, nil
 }
 
 func initOps() ([]Operation, error) {
-	var ops = make([]Operation, 0)
+	var (
+		ops      = make([]Operation, 0)
+		opsLock  sync.Mutex
+		wg       sync.WaitGroup
+		firstErr error
+	)
+	since := time.Now()
+	srcComputersMapSingleton.CLock.Lock()
 	for _, srcComputer := range srcComputersMapSingleton.CMap {
 		for _, src := range srcComputer.Paths {
-			if stop {
-				return nil, errors.New("stopped by signal")
-			}
-			switch fileType {
-			case move_common.Cache:
-				cacheSrcDir := strings.TrimRight(src.Location, "/") + "/cache"
-				err := filepath.Walk(cacheSrcDir, func(path string, info os.FileInfo, err error) error {
-					if stop {
-						return errors.New(move_common.StoppedBySyscall)
-					}
-					if info == nil || err != nil {
-						return err
-					}
-					if info.Mode().IsDir() && path != cacheSrcDir {
-						// get initialized cacheTask
-						singleCacheSrcDir := cacheSrcDir + "/" + info.Name()
-						cacheTask, err := newCacheTask(singleCacheSrcDir, info.Name(), src.Location, srcComputer.Ip)
-						if err != nil {
-							return err
-						}
-						// do not cp file which isn't 32G or 64G,or which size error
-						if cacheTask == nil {
-							return nil
-						}
-
-						ops = append(ops, cacheTask)
-					}
-					return err
-				})
+			srcIp, srcPath := srcComputer.Ip, src
+			// every source path is walked by its own goroutine
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				pathOps, err := scanSrcPath(srcIp, srcPath)
+				opsLock.Lock()
+				defer opsLock.Unlock()
 				if err != nil {
-					return nil, err
-				}
-			case move_common.Sealed:
-				sealedSrcDir := strings.TrimRight(src.Location, "/") + "/sealed"
-				err := filepath.Walk(sealedSrcDir, func(path string, info os.FileInfo, err error) error {
-					if stop {
-						return errors.New(move_common.StoppedBySyscall)
-					}
-					if info == nil || err != nil {
-						return err
-					}
-					if !info.Mode().IsRegular() {
-						return nil
-					}
-					sealedTask, err := newSealedTask(path, info.Name(), src.Location, srcComputer.Ip)
-					if err != nil {
-						return err
-					}
-					// do not cp file which isn't 32G or 64G,or which size error
-					if sealedTask == nil {
-						return nil
+					if firstErr == nil {
+						firstErr = err
 					}
-					ops = append(ops, sealedTask)
+					return
+				}
+				ops = append(ops, pathOps...)
+			}()
+		}
+	}
+	srcComputersMapSingleton.CLock.Unlock()
+	wg.Wait()
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	log.Infof("scanned %d %s files from source, cost %v", len(ops), fileTypesString(fileTypes), time.Now().Sub(since))
+	return ops, nil
+}
 
-					return err
-				})
+// scanSrcPath makes the tasks of every kind of this run found on a src path
+func scanSrcPath(srcIp string, src Path) ([]Operation, error) {
+	var ops = make([]Operation, 0)
+	for _, ft := range fileTypes {
+		kindOps, err := scanSrcPathOfKind(srcIp, src, ft)
+		if err != nil {
+			return nil, err
+		}
+		ops = append(ops, kindOps...)
+	}
+	return ops, nil
+}
+
+func scanSrcPathOfKind(srcIp string, src Path, ft move_common.FileType) ([]Operation, error) {
+	var ops = make([]Operation, 0)
+	if stop {
+		return nil, errors.New("stopped by signal")
+	}
+	switch ft {
+	case move_common.Cache:
+		cacheSrcDir := strings.TrimRight(src.Location, "/") + "/cache"
+		err := filepath.Walk(cacheSrcDir, func(path string, info os.FileInfo, err error) error {
+			if stop {
+				return errors.New(move_common.StoppedBySyscall)
+			}
+			if info == nil || err != nil {
+				return err
+			}
+			if info.Mode().IsDir() && path != cacheSrcDir {
+				// get initialized cacheTask
+				singleCacheSrcDir := cacheSrcDir + "/" + info.Name()
+				cacheTask, err := newCacheTask(singleCacheSrcDir, info.Name(), src.Location, srcIp)
 				if err != nil {
-					return nil, err
+					return err
+				}
+				// do not cp file which isn't 32G or 64G,or which size error
+				if cacheTask == nil {
+					return nil
 				}
-			case move_common.UnSealed:
-				unsealedSrcDir := strings.TrimRight(src.Location, "/") + "/unsealed"
-				err := filepath.Walk(unsealedSrcDir, func(path string, info os.FileInfo, err error) error {
-					if stop {
-						return errors.New(move_common.StoppedBySyscall)
-					}
-					if info == nil || err != nil {
-						return err
-					}
-					if !info.Mode().IsRegular() {
-						return nil
-					}
-					unsealedTask, err := newUnSealedTask(path, src.Location, srcComputer.Ip, info.Name())
-					if err != nil {
-						return err
-					}
 
-					// do not cp file which isn't 32G or 64G,or which size error
-					if unsealedTask == nil {
-						return nil
-					}
+				ops = append(ops, cacheTask)
+			}
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+	case move_common.Sealed:
+		sealedSrcDir := strings.TrimRight(src.Location, "/") + "/sealed"
+		err := filepath.Walk(sealedSrcDir, func(path string, info os.FileInfo, err error) error {
+			if stop {
+				return errors.New(move_common.StoppedBySyscall)
+			}
+			if info == nil || err != nil {
+				return err
+			}
+			if !info.Mode().IsRegular() {
+				return nil
+			}
+			sealedTask, err := newSealedTask(path, info.Name(), src.Location, srcIp)
+			if err != nil {
+				return err
+			}
+			// do not cp file which isn't 32G or 64G,or which size error
+			if sealedTask == nil {
+				return nil
+			}
+			ops = append(ops, sealedTask)
 
-					ops = append(ops, unsealedTask)
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+	case move_common.UnSealed:
+		unsealedSrcDir := strings.TrimRight(src.Location, "/") + "/unsealed"
+		err := filepath.Walk(unsealedSrcDir, func(path string, info os.FileInfo, err error) error {
+			if stop {
+				return errors.New(move_common.StoppedBySyscall)
+			}
+			if info == nil || err != nil {
+				return err
+			}
+			if !info.Mode().IsRegular() {
+				return nil
+			}
+			unsealedTask, err := newUnSealedTask(path, src.Location, srcIp, info.Name())
+			if err != nil {
+				return err
+			}
 
-					return err
-				})
-				if err != nil {
-					return nil, err
-				}
+			// do not cp file which isn't 32G or 64G,or which size error
+			if unsealedTask == nil {
+				return nil
 			}
+
+			ops = append(ops, unsealedTask)
+
+			return err
+		})
+		if err != nil {
+			return nil, err
 		}
 	}
-	return ops, nil
 
+	return ops, nil
 }
 
-func checkSourceSizeAndIsExistedInDst(ops []Operation, cfg *Config) error {
+// checkSourceSizeAndIsExistedInDst adds the ops to copy into the task list and returns them
+func checkSourceSizeAndIsExistedInDst(ops []Operation, cfg *Config) ([]Operation, error) {
 	var threadChan = make(chan struct{}, runtime.NumCPU())
+	var (
+		errLock  sync.Mutex
+		firstErr error
+		accepted = make([]Operation, 0)
+	)
 	wg := sync.WaitGroup{}
 	if lenOps := len(ops); lenOps > 0 {
 		lenSpecifiedMap := len(specifiedSectorsMap)
 		for _, v := range ops {
 			if stop {
-				return nil
+				return accepted, nil
+			}
+			errLock.Lock()
+			failed := firstErr != nil
+			errLock.Unlock()
+			if failed {
+				break
 			}
 			op := v
 			// if manually specify sectors to copy,just check and copy specified sectors
@@ -184,15 +257,6 @@ func checkSourceSizeAndIsExistedInDst(ops []Operation, cfg *Config) error {
 					continue
 				}
 			}
-			// checkSourceSize
-			srcPaths, err := op.checkSourceSize()
-			if err != nil {
-				if skipSourceError {
-					continue
-				} else {
-					return err
-				}
-			}
 
 			select {
 			case threadChan <- struct{}{}:
@@ -202,14 +266,33 @@ func checkSourceSizeAndIsExistedInDst(ops []Operation, cfg *Config) error {
 						<-threadChan
 						wg.Done()
 					}()
+					// checkSourceSize
+					srcPaths, err := op.checkSourceSize()
+					if err != nil {
+						if skipSourceError {
+							log.Warn(err)
+						} else {
+							errLock.Lock()
+							if firstErr == nil {
+								firstErr = err
+							}
+							errLock.Unlock()
+						}
+						return
+					}
+
 					// check is already existed in dst
 					if op.checkIsExistedInDst(srcPaths, cfg) {
+						journalSingleton.existing(op, srcPaths, cfg)
+						historySingleton.existing(op, srcPaths)
 						return
 					}
+					journalSingleton.discovered(op)
 
 					// add op
 					taskListSingleton.TLock.Lock()
 					taskListSingleton.Ops = append(taskListSingleton.Ops, op)
+					accepted = append(accepted, op)
 					taskListSingleton.TLock.Unlock()
 				}()
 			}
@@ -219,7 +302,7 @@ func checkSourceSizeAndIsExistedInDst(ops []Operation, cfg *Config) error {
 	// wait all thread done
 	wg.Wait()
 	close(threadChan)
-	return nil
+	return accepted, firstErr
 }
 
 // init task list
@@ -232,8 +315,23 @@ func initializeTaskList(cfg *Config) error {
 		return err
 	}
 
+	// a resumed job skips what it verified and keeps what was cancelled
+	ops, kept, err := journalSingleton.reconcile(ops)
+	if err != nil {
+		return err
+	}
+	taskListSingleton.TLock.Lock()
+	taskListSingleton.Ops = append(taskListSingleton.Ops, kept...)
+	taskListSingleton.TLock.Unlock()
+
+	// index files already on dst paths
+	err = buildDstIndex()
+	if err != nil {
+		return err
+	}
+
 	// check source size && IsExistedInDst
-	err = checkSourceSizeAndIsExistedInDst(ops, cfg)
+	_, err = checkSourceSizeAndIsExistedInDst(ops, cfg)
 	if err != nil {
 		return err
 	}
@@ -241,116 +339,58 @@ func initializeTaskList(cfg *Config) error {
 	return nil
 }
 
-func startWork(cfg *Config) {
+func startWork(cfg *Config) error {
 	// init task list
 	err := initializeTaskList(cfg)
 	if err != nil {
-		log.Error(err)
-		return
+		return err
 	}
-	since := time.Now()
-	//lenSpecifiedMap := len(specifiedSectorsMap)
-	for {
-		NotDoneNum := 0
-		for _, v := range taskListSingleton.Ops {
-			t := v
-			if stop {
-				log.Warn(move_common.StoppedBySyscall)
-				waitingForAllTaskStop()
-				return
-			}
+	taskListSingleton.TLock.Lock()
+	ops := taskListSingleton.Ops
+	taskListSingleton.TLock.Unlock()
+	sectorPrioritiesSingleton.applyPriorities(ops)
+	schedulerSingleton.push(ops...)
+	schedulerSingleton.run(cfg)
+	return nil
+}
 
-			switch t.getStatus() {
-			case StatusOnWaiting:
-				NotDoneNum++
-				if t.canDo() {
-					// get one best dst
-					dst, dstIp, err := t.getBestDst()
-					if err != nil {
-						if err.Error() == move_common.FondGroupButTooMuchThread {
-							continue
-						} else if err.Error() == move_common.NoDstSuitableForNow {
-							log.Debug(err.Error())
-						} else {
-							log.Warn(err)
-						}
-						continue
-					}
-					t.fullInfo(dst, dstIp)
-					srcIp := t.getSrcIp()
-					srcPath := t.getSrcPath()
-					occupyThreads(dst, dstIp, srcIp, srcPath)
-					t.setStatus(StatusOnWorking)
-					go t.startCopy(cfg, dst)
-				}
-			case StatusOnWorking:
-				NotDoneNum++
-			case StatusDone:
-			}
-		}
-		if NotDoneNum == 0 {
-			break
+func printDetail() {
+	if os.Getenv("SHOW_DETAIL") != "1" {
+		return
+	}
+	snap := resourceManagerSingleton.snapshot()
+	fmt.Print(snap)
+	for _, h := range snap.Hosts {
+		if h.Side != SideDst || h.InUse != 0 {
+			continue
 		}
-		if os.Getenv("SHOW_DETAIL") == "1" {
-			if time.Now().Sub(since) > time.Minute*5 {
-				since = time.Now()
-				fmt.Println("src computer thread info:")
-				for ip, v := range srcComputersMapSingleton.CMap {
-					fmt.Printf("%s: current thread:%d; limit thread:%d \n", ip, v.CurrentThreads, v.LimitThread)
-				}
-
-				fmt.Println("dst computer thread info:")
-				for ip, v := range dstComputersMapSingleton.CMap {
-					fmt.Printf("%s: current thread:%d; limit thread:%d \n", ip, v.CurrentThreads, v.LimitThread)
-					for _, p := range v.Paths {
-						fmt.Printf("path: %s,current thread:%d; limit thread:%d \n", p.Location, p.CurrentThreads, p.SinglePathThreadLimit)
+		// an idle dst host, show what is still waiting for it
+		for _, ov := range taskListSingleton.Ops {
+			info := ov.getInfo()
+			if ov.getStatus() != StatusDone {
+				switch task := info.(type) {
+				case SealedTask:
+					if task.DstIp == h.Ip {
+						fmt.Println(task)
 					}
-					if ip != "" && v.CurrentThreads == 0 {
-						for _, ov := range taskListSingleton.Ops {
-							info := ov.getInfo()
-							if ov.getStatus() != StatusDone {
-								switch fileType {
-								case move_common.Sealed:
-									task := info.(SealedTask)
-									if task.DstIp == v.Ip {
-										fmt.Println(task)
-									}
-								case move_common.Cache:
-									task := info.(CacheTask)
-									if task.DstIp == v.Ip {
-										fmt.Println(task)
-									}
-								case move_common.UnSealed:
-									task := info.(UnSealedTask)
-									if task.DstIp == v.Ip {
-										fmt.Println(task)
-									}
-								}
-							}
-
-						}
+				case CacheTask:
+					if task.DstIp == h.Ip {
+						fmt.Println(task)
+					}
+				case UnSealedTask:
+					if task.DstIp == h.Ip {
+						fmt.Println(task)
 					}
 				}
 			}
 		}
-		if fileType != move_common.Cache {
-			time.Sleep(time.Second * 10)
-		} else {
-			time.Sleep(time.Second * 2)
-		}
 	}
-	log.Infof("all task done for %s file", fileType)
 }
 
 func waitingForAllTaskStop() {
 	log.Info("waiting all tasks stop to exit process")
 	for {
-		num := 0
-		for _, t := range taskListSingleton.Ops {
-			if t.getStatus() == StatusOnWorking {
-				num++
-			}
-		}
+		num := schedulerSingleton.runningNum()
 		if num == 0 {
 			log.Info("all tasks stopped")
 			break
@@ -365,10 +405,29 @@ func makeSpecifiedSectorsMap(path string) error {
 	if err != nil {
 		return err
 	}
-	f, err := os.Open(absPath)
+	sectors, priorities, err := readSectorListFile(absPath, true)
 	if err != nil {
 		return err
 	}
+	specifiedSectorsMap = sectors
+	info, err := os.Stat(absPath)
+	if err != nil {
+		return err
+	}
+	sectorPrioritiesSingleton.File = absPath
+	sectorPrioritiesSingleton.Priorities = priorities
+	sectorPrioritiesSingleton.mtime = info.ModTime()
+	return nil
+}
+
+// readSectorListFile reads lines of "sectorID [priority]"
+func readSectorListFile(absPath string, checkDoubled bool) (map[string]struct{}, map[string]int, error) {
+	sectors := make(map[string]struct{})
+	priorities := make(map[string]int)
+	f, err := os.Open(absPath)
+	if err != nil {
+		return nil, nil, err
+	}
 	defer f.Close()
 	reader := bufio.NewReader(f)
 	for {
@@ -377,13 +436,24 @@ func makeSpecifiedSectorsMap(path string) error {
 			if err == io.EOF {
 				break
 			} else {
-				return err
+				return nil, nil, err
 			}
 		}
-		if _, ok := specifiedSectorsMap[string(s)]; ok {
-			return fmt.Errorf("doubled sectorID in sectors list file %s", absPath)
+		fields := strings.Fields(string(s))
+		if len(fields) == 0 {
+			continue
+		}
+		if _, ok := sectors[fields[0]]; ok && checkDoubled {
+			return nil, nil, fmt.Errorf("doubled sectorID in sectors list file %s", absPath)
+		}
+		sectors[fields[0]] = struct{}{}
+		if len(fields) > 1 {
+			priority, err := strconv.Atoi(fields[1])
+			if err != nil {
+				return nil, nil, fmt.Errorf("wrong priority of %s in sectors list file %s: %v", fields[0], absPath, err)
+			}
+			priorities[fields[0]] = priority
 		}
-		specifiedSectorsMap[string(s)] = struct{}{}
 	}
-	return nil
+	return sectors, priorities, nil
 }
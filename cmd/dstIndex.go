@@ -0,0 +1,137 @@
+package main
+
+import (
+	"errors"
+	"move_sectors/move_common"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DstIndex holds the sizes of every sector file found on dst paths, built
+// with one walk per dst path so existence checks need neither stat nor lock
+type DstIndex struct {
+	// relative path like sealed/s-t0xxx-1 -> dst location -> size
+	Files map[string]map[string]int64
+	lock  *sync.Mutex
+}
+
+var dstIndexSingleton = DstIndex{
+	Files: make(map[string]map[string]int64),
+	lock:  new(sync.Mutex),
+}
+
+func subDirOfFileType(ft move_common.FileType) string {
+	switch ft {
+	case move_common.Sealed:
+		return "sealed"
+	case move_common.UnSealed:
+		return "unsealed"
+	default:
+		return "cache"
+	}
+}
+
+func (idx *DstIndex) add(rel, location string, size int64) {
+	idx.lock.Lock()
+	defer idx.lock.Unlock()
+	if _, ok := idx.Files[rel]; !ok {
+		idx.Files[rel] = make(map[string]int64)
+	}
+	idx.Files[rel][location] = size
+}
+
+// candidates returns dst locations holding all relPaths with the given sizes
+func (idx *DstIndex) candidates(relPaths []string, sizes []int64) []string {
+	idx.lock.Lock()
+	defer idx.lock.Unlock()
+	res := make([]string, 0)
+	if len(relPaths) == 0 {
+		return res
+	}
+	for loc, size := range idx.Files[relPaths[0]] {
+		if size != sizes[0] {
+			continue
+		}
+		all := true
+		for i := 1; i < len(relPaths); i++ {
+			if s, ok := idx.Files[relPaths[i]][loc]; !ok || s != sizes[i] {
+				all = false
+				break
+			}
+		}
+		if all {
+			res = append(res, loc)
+		}
+	}
+	return res
+}
+
+func buildDstIndex() error {
+	since := time.Now()
+	locations := make([]string, 0)
+	dstComputersMapSingleton.CLock.Lock()
+	for _, cmp := range dstComputersMapSingleton.CMap {
+		for _, p := range cmp.Paths {
+			locations = append(locations, p.Location)
+		}
+	}
+	dstComputersMapSingleton.CLock.Unlock()
+
+	var (
+		wg       sync.WaitGroup
+		errLock  sync.Mutex
+		firstErr error
+	)
+	for _, l := range locations {
+		loc := strings.TrimRight(l, "/")
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := indexDstPath(loc); err != nil {
+				errLock.Lock()
+				if firstErr == nil {
+					firstErr = err
+				}
+				errLock.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if firstErr != nil {
+		return firstErr
+	}
+	log.Infof("dst index built, %d files on %d paths, cost %v", len(dstIndexSingleton.Files), len(locations), time.Now().Sub(since))
+	return nil
+}
+
+// indexDstPath indexes the sub dirs of every kind of this run on a dst path
+func indexDstPath(loc string) error {
+	for _, ft := range fileTypes {
+		if err := indexDstDir(loc, loc+"/"+subDirOfFileType(ft)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func indexDstDir(loc, root string) error {
+	if _, err := os.Stat(root); os.IsNotExist(err) {
+		return nil
+	}
+	return filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if stop {
+			return errors.New(move_common.StoppedBySyscall)
+		}
+		if info == nil || err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() || strings.HasSuffix(path, ".tmp") {
+			return nil
+		}
+		dstIndexSingleton.add(strings.TrimPrefix(path, loc+"/"), loc, info.Size())
+		return nil
+	})
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"strings"
+	"sync"
+)
+
+// FairShare shares the dst threads between source computers and source paths:
+// among tasks of the same priority, the source which was served the fewest
+// bytes per weight goes first, so no sealing box waits for the others to drain
+type FairShare struct {
+	HostWeight map[string]int
+	PathWeight map[string]int
+	HostServed map[string]int64
+	PathServed map[string]int64
+	FLock      *sync.Mutex
+}
+
+var fairShareSingleton = FairShare{
+	HostWeight: make(map[string]int),
+	PathWeight: make(map[string]int),
+	HostServed: make(map[string]int64),
+	PathServed: make(map[string]int64),
+	FLock:      new(sync.Mutex),
+}
+
+func srcPathKey(ip, location string) string {
+	return ip + ":" + strings.TrimRight(location, "/")
+}
+
+func (fs *FairShare) setWeights(cmp Computer) {
+	fs.FLock.Lock()
+	defer fs.FLock.Unlock()
+	fs.HostWeight[cmp.Ip] = cmp.Weight
+	for _, p := range cmp.Paths {
+		fs.PathWeight[srcPathKey(cmp.Ip, p.Location)] = p.Weight
+	}
+}
+
+func weightOrOne(w int) float64 {
+	if w <= 0 {
+		return 1
+	}
+	return float64(w)
+}
+
+// served records size bytes started from the source path
+func (fs *FairShare) served(ip, location string, size int64) {
+	fs.FLock.Lock()
+	defer fs.FLock.Unlock()
+	fs.HostServed[ip] += size
+	fs.PathServed[srcPathKey(ip, location)] += size
+}
+
+// virtualTime returns the normalized service of the source host and path
+func (fs *FairShare) virtualTime(ip, location string) (float64, float64) {
+	fs.FLock.Lock()
+	defer fs.FLock.Unlock()
+	key := srcPathKey(ip, location)
+	return float64(fs.HostServed[ip]) / weightOrOne(fs.HostWeight[ip]),
+		float64(fs.PathServed[key]) / weightOrOne(fs.PathWeight[key])
+}
+
+// srcQueue is the ready tasks of one source path, in priority order
+type srcQueue struct {
+	ip       string
+	location string
+	ops      []Operation
+	blocked  bool
+}
+
+// groupBySource splits sorted ops by source path keeping their order
+func groupBySource(ops []Operation) []*srcQueue {
+	queues := make([]*srcQueue, 0)
+	index := make(map[string]*srcQueue)
+	for _, op := range ops {
+		key := srcPathKey(op.getSrcIp(), op.getSrcPath())
+		q, ok := index[key]
+		if !ok {
+			q = &srcQueue{ip: op.getSrcIp(), location: op.getSrcPath()}
+			index[key] = q
+			queues = append(queues, q)
+		}
+		q.ops = append(q.ops, op)
+	}
+	return queues
+}
+
+// nextQueue picks the source whose head task should start next: highest
+// priority first, then the host and the path with the lowest virtual time
+func (fs *FairShare) nextQueue(queues []*srcQueue) *srcQueue {
+	var best *srcQueue
+	var bestHost, bestPath float64
+	for _, q := range queues {
+		if q.blocked || len(q.ops) == 0 {
+			continue
+		}
+		host, path := fs.virtualTime(q.ip, q.location)
+		if best == nil {
+			best, bestHost, bestPath = q, host, path
+			continue
+		}
+		pq, pb := q.ops[0].getPriority(), best.ops[0].getPriority()
+		if pq > pb || (pq == pb && (host < bestHost || (host == bestHost && path < bestPath))) {
+			best, bestHost, bestPath = q, host, path
+		}
+	}
+	return best
+}
@@ -0,0 +1,566 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/urfave/cli/v2"
+	"move_sectors/move_common"
+	"move_sectors/mv_utils"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	ModelConfigured = "configured"
+	ModelMeasured   = "measured"
+)
+
+// simDisk is a virtual filesystem, dst paths on one device share it
+type simDisk struct {
+	avail uint64
+	total uint64
+}
+
+type simHost struct {
+	side      string
+	ip        string
+	bandwidth int
+	limit     int64 // of the window in force
+	maxLimit  int64
+	threads   int64
+	peak      int64
+}
+
+type simPath struct {
+	side    string
+	ip      string
+	key     string
+	host    *simHost
+	base    int64 // singlepaththreadlimit of the config
+	limit   int64 // of the window in force
+	threads int64
+
+	// dst paths only
+	location   string
+	disk       *simDisk
+	policy     CapacityPolicy
+	weight     int
+	order      int
+	bytes      int64
+	canStore   bool  // by sectorstore.json
+	maxStorage int64 // by sectorstore.json, 0 means no limit
+	stored     int64 // on disk at load and not counted in copied, for MaxStorage
+	sectors    map[string]struct{}
+	copied     int64               // bytes of the copies capacity usage counted before
+	copiedIDs  map[string]struct{} // and their sectors
+	running    int
+	full       bool
+	fullAt     time.Duration
+}
+
+type simCopy struct {
+	op       Operation
+	src      *simPath
+	dst      *simPath
+	remain   float64 // MB
+	measured float64 // MB/s, 0 if the paths have no measure or by the configured model
+}
+
+// DstFill is what a forecast puts on a dst path
+type DstFill struct {
+	Ip      string
+	Path    string
+	Sectors int
+	Bytes   int64
+	Left    uint64 // free bytes at the end
+	Full    bool
+	FullAt  time.Duration // since the start, when no more task fits
+}
+
+// HostPeak is the most threads a forecast runs on a host at once
+type HostPeak struct {
+	Side  string
+	Ip    string
+	Peak  int64
+	Limit int64
+}
+
+// Forecast is the result of simulating the scheduler over the task list
+type Forecast struct {
+	Model     string
+	Tasks     int
+	Estimated int // copies of the measured model without a measure, at the configured speed
+	ETA       time.Duration
+	Hosts     []HostPeak
+	Dsts      []DstFill
+	Blocked   []PlanEntry
+}
+
+// simulator runs the scheduler on virtual disks and threads, every copy
+// goes at the speed of one thread; the time windows of the schedule change
+// the limits and speed as the simulated time passes them
+type simulator struct {
+	cfg      *Config
+	model    string
+	policy   PlacementPolicy
+	hosts    map[string]*simHost
+	paths    map[string]*simPath
+	dsts     []*simPath
+	groups   map[string]*simPath // sector -> dst path of its first part
+	start    time.Time
+	now      time.Duration
+	limits   WindowLimits
+	changeAt time.Duration // when the limits change next, -1 if never
+	minSize  int64
+	result   *Forecast
+}
+
+func newSimulator(cfg *Config, model string) (*simulator, error) {
+	policy, err := newPlacementPolicy(cfg.PlacementPolicy)
+	if err != nil {
+		return nil, err
+	}
+	sim := &simulator{
+		cfg:    cfg,
+		model:  model,
+		policy: policy,
+		hosts:  make(map[string]*simHost),
+		paths:  make(map[string]*simPath),
+		groups: make(map[string]*simPath),
+		start:  time.Now(),
+		result: &Forecast{Model: model, Blocked: make([]PlanEntry, 0)},
+	}
+	disks := make(map[string]*simDisk)
+	for _, side := range []string{SideSrc, SideDst} {
+		cm := &srcComputersMapSingleton
+		if side == SideDst {
+			cm = &dstComputersMapSingleton
+		}
+		cm.CLock.Lock()
+		for _, cmp := range cm.CMap {
+			if cmp.Draining {
+				continue
+			}
+			host := &simHost{side: side, ip: cmp.Ip, bandwidth: cmp.BandWidth}
+			sim.hosts[hostKey(side, cmp.Ip)] = host
+			for _, p := range cmp.Paths {
+				if p.Draining {
+					continue
+				}
+				sp := &simPath{side: side, ip: cmp.Ip, key: pathKey(side, cmp.Ip, p.Location), host: host, base: configuredPathLimit(cfg, side, cmp.Ip, p)}
+				sim.paths[sp.key] = sp
+				if side == SideSrc {
+					continue
+				}
+				sp.location = strings.TrimRight(p.Location, "/")
+				sp.policy = effectiveCapacityPolicy(cmp, p)
+				sp.weight = pathWeight(cmp.Ip, p)
+				sp.canStore, sp.maxStorage, sp.stored = sectorStoreSingleton.limits(cmp.Ip, p.Location)
+				sp.order = dstOrderSingleton[dstPathKey(cmp.Ip, p.Location)]
+				sp.sectors = make(map[string]struct{})
+				sp.copied, sp.copiedIDs = capacityUsageSingleton.used(cmp.Ip, p.Location)
+				dev, ok := mv_utils.DevOfPath(p.Location)
+				if !ok {
+					dev = sp.key
+				}
+				if sp.disk, ok = disks[dev]; !ok {
+					avail, total := getDiskSpace(p.Location)
+					sp.disk = &simDisk{avail: avail, total: total}
+					disks[dev] = sp.disk
+				}
+				sim.dsts = append(sim.dsts, sp)
+			}
+		}
+		cm.CLock.Unlock()
+	}
+	sort.Slice(sim.dsts, func(i, j int) bool {
+		return sim.dsts[i].order < sim.dsts[j].order
+	})
+	return sim, nil
+}
+
+// fits reports whether size bytes of sectorID may go to the dst path, like capacityAllows
+func (p *simPath) fits(sectorID string, size int64) bool {
+	if !p.canStore || p.maxStorage > 0 && p.stored+p.copied+p.bytes+size > p.maxStorage {
+		return false
+	}
+	if p.disk.avail <= uint64(size) || p.disk.avail-uint64(size) < p.policy.minFree(p.disk.total) {
+		return false
+	}
+	if p.policy.MaxBytes > 0 && p.copied+p.bytes+size > p.policy.MaxBytes {
+		return false
+	}
+	_, planned := p.sectors[sectorID]
+	_, copied := p.copiedIDs[sectorID]
+	if p.policy.MaxSectors > 0 && !planned && !copied && len(p.sectors)+len(p.copiedIDs) >= p.policy.MaxSectors {
+		return false
+	}
+	return true
+}
+
+func (p *simPath) hasFreeThread() bool {
+	return p.threads < p.limit && p.host.threads < p.host.limit
+}
+
+func (p *simPath) take(n int64) {
+	p.threads += n
+	p.host.threads += n
+	if p.host.threads > p.host.peak {
+		p.host.peak = p.host.threads
+	}
+}
+
+// configuredPathLimit is the singlepaththreadlimit cfg sets on the path,
+// before any window caps it
+func configuredPathLimit(cfg *Config, side, ip string, p Path) int64 {
+	computers := cfg.SrcComputers
+	if side == SideDst {
+		computers = cfg.DstComputers
+	}
+	for _, c := range computers {
+		if c.Ip != ip {
+			continue
+		}
+		if cp, ok := findPath(c, p.Location); ok {
+			return cp.SinglePathThreadLimit
+		}
+	}
+	return p.SinglePathThreadLimit
+}
+
+// applyWindow sets the limits of the window in force at the simulated time
+// like Schedule.apply, and finds when they change next
+func (sim *simulator) applyWindow() {
+	if sim.changeAt != 0 && (sim.changeAt < 0 || sim.now < sim.changeAt) {
+		return
+	}
+	at := sim.start.Add(sim.now)
+	sim.limits = limitsAt(sim.cfg, at)
+	sim.changeAt = -1
+	if next, ok := nextLimitsChange(sim.cfg, at); ok {
+		sim.changeAt = next.Sub(sim.start)
+	}
+	l := sim.limits
+	for _, h := range sim.hosts {
+		h.limit = int64(calThreadLimit(h.bandwidth*l.BandWidthPercent/100, l.SingleThreadMBPS))
+		if h.limit < 1 {
+			h.limit = 1
+		}
+		if h.limit > h.maxLimit {
+			h.maxLimit = h.limit
+		}
+	}
+	for _, p := range sim.paths {
+		p.limit = p.base
+		if l.MaxPathThreads > 0 && p.limit > l.MaxPathThreads {
+			p.limit = l.MaxPathThreads
+		}
+	}
+}
+
+// measuredRate is the MB/s finished copies had from src to dst, 0 if not
+// measured or by the configured model
+func (sim *simulator) measuredRate(src, dst *simPath) float64 {
+	if sim.model != ModelMeasured {
+		return 0
+	}
+	rate, known := 0.0, false
+	for _, key := range []string{src.key, dst.key} {
+		if mbps, ok := throughputSingleton.mbps(key); ok && (!known || mbps < rate) {
+			rate, known = mbps, true
+		}
+	}
+	if !known {
+		sim.result.Estimated++
+	}
+	return rate
+}
+
+// rate is the MB/s of the copy now, never faster than one thread of the
+// window in force may go
+func (sim *simulator) rate(c *simCopy) float64 {
+	configured := float64(sim.limits.SingleThreadMBPS)
+	if c.measured > 0 && c.measured < configured {
+		return c.measured
+	}
+	return configured
+}
+
+// chooseDst returns the dst path of op, nil if it has to wait for threads;
+// blocked is true when no dst path will ever have room for it
+func (sim *simulator) chooseDst(op Operation) (dst *simPath, blocked bool) {
+	id, size := op.getSectorID(), op.getTotalSize()
+	// other parts of the sector and the placement map go first, like tryToFindGroupDir
+	group, ok := sim.groups[id]
+	if !ok {
+		if entry, found := placementMapSingleton.lookup(id); found {
+			group, ok = sim.paths[pathKey(SideDst, entry.DstIp, entry.DstPath)]
+		}
+	}
+	if ok && group.fits(id, size) {
+		if group.hasFreeThread() {
+			return group, false
+		}
+		return nil, false
+	}
+	candidates := make([]DstCandidate, 0)
+	byKey := make(map[string]*simPath)
+	roomy := false
+	for _, p := range sim.dsts {
+		if !p.fits(id, size) {
+			continue
+		}
+		roomy = true
+		if !p.hasFreeThread() {
+			continue
+		}
+		candidates = append(candidates, DstCandidate{
+			Ip:          p.ip,
+			Location:    p.location,
+			Avail:       p.disk.avail,
+			PathThreads: p.threads,
+			HostThreads: int(p.host.threads),
+			HostLimit:   int(p.host.limit),
+			Weight:      p.weight,
+			Order:       p.order,
+		})
+		byKey[dstPathKey(p.ip, p.location)] = p
+	}
+	if !roomy {
+		return nil, true
+	}
+	if len(candidates) == 0 {
+		return nil, false
+	}
+	c := sim.policy.choose(candidates)
+	return byKey[dstPathKey(c.Ip, c.Location)], false
+}
+
+// markFull records the dst paths no task of the run fits anymore
+func (sim *simulator) markFull() {
+	for _, p := range sim.dsts {
+		if !p.full && p.running == 0 && !p.fits("", sim.minSize) {
+			p.full, p.fullAt = true, sim.now
+		}
+	}
+}
+
+func (sim *simulator) run(ops []Operation) *Forecast {
+	sim.result.Tasks = len(ops)
+	for _, op := range ops {
+		if sim.minSize == 0 || op.getTotalSize() < sim.minSize {
+			sim.minSize = op.getTotalSize()
+		}
+	}
+	sim.applyWindow()
+	sim.markFull()
+	waiting := ops
+	running := make([]*simCopy, 0)
+	idleSince := time.Duration(-1) // since when windows with no new tasks held every task
+	for len(waiting) > 0 || len(running) > 0 {
+		sim.applyWindow()
+		remain := make([]Operation, 0, len(waiting))
+		sealedWaiting := waitingSealedSectors(waiting)
+		progress := false
+		for _, op := range waiting {
+			if sim.limits.NoNewTasks {
+				remain = append(remain, op)
+				continue
+			}
+			src, ok := sim.paths[pathKey(SideSrc, op.getSrcIp(), op.getSrcPath())]
+			if !ok {
+				sim.block(op, "src path is not configured")
+				progress = true
+				continue
+			}
+			if _, ok := sealedWaiting[op.getSectorID()]; ok && op.getFileType() == move_common.Cache {
+				remain = append(remain, op)
+				continue
+			}
+			if !src.hasFreeThread() {
+				remain = append(remain, op)
+				continue
+			}
+			dst, blocked := sim.chooseDst(op)
+			if blocked {
+				sim.block(op, "no dst path has enough space")
+				progress = true
+				continue
+			}
+			if dst == nil {
+				remain = append(remain, op)
+				continue
+			}
+			size := op.getTotalSize()
+			src.take(1)
+			dst.take(1)
+			dst.disk.avail -= uint64(size)
+			dst.bytes += size
+			dst.sectors[op.getSectorID()] = struct{}{}
+			dst.running++
+			progress = true
+			if _, ok := sim.groups[op.getSectorID()]; !ok {
+				sim.groups[op.getSectorID()] = dst
+			}
+			if op.getFileType() == move_common.Sealed {
+				delete(sealedWaiting, op.getSectorID())
+			}
+			running = append(running, &simCopy{op: op, src: src, dst: dst,
+				remain: float64(size) / float64(1<<20), measured: sim.measuredRate(src, dst)})
+		}
+		waiting = remain
+		if len(running) == 0 {
+			// a cache may wait for its sealed file blocked in this pass
+			if progress && len(waiting) > 0 {
+				continue
+			}
+			// a window with no new tasks ends some time
+			if idleSince < 0 {
+				idleSince = sim.now
+			}
+			if sim.limits.NoNewTasks && sim.changeAt > 0 && sim.now-idleSince < time.Hour*24*7 {
+				sim.now = sim.changeAt
+				continue
+			}
+			reason := "no thread could ever run it"
+			if sim.limits.NoNewTasks {
+				reason = "the schedule never allows new tasks"
+			}
+			for _, op := range waiting {
+				sim.block(op, reason)
+			}
+			break
+		}
+
+		idleSince = -1
+		// move on to the next finished copy, or to the next window if sooner
+		step := -1.0
+		for _, c := range running {
+			if s := c.remain / sim.rate(c); step < 0 || s < step {
+				step = s
+			}
+		}
+		elapsed := time.Duration(step * float64(time.Second))
+		if sim.changeAt > 0 && sim.now+elapsed > sim.changeAt {
+			elapsed = sim.changeAt - sim.now
+			step = elapsed.Seconds()
+		}
+		sim.now += elapsed
+		left := running[:0]
+		for _, c := range running {
+			c.remain -= step * sim.rate(c)
+			if c.remain > 1e-6 {
+				left = append(left, c)
+				continue
+			}
+			c.src.take(-1)
+			c.dst.take(-1)
+			c.dst.running--
+		}
+		running = left
+		sim.markFull()
+	}
+	sim.result.ETA = sim.now
+	for _, h := range sim.hosts {
+		sim.result.Hosts = append(sim.result.Hosts, HostPeak{Side: h.side, Ip: h.ip, Peak: h.peak, Limit: h.maxLimit})
+	}
+	sort.Slice(sim.result.Hosts, func(i, j int) bool {
+		a, b := sim.result.Hosts[i], sim.result.Hosts[j]
+		return a.Side > b.Side || (a.Side == b.Side && a.Ip < b.Ip)
+	})
+	for _, p := range sim.dsts {
+		sim.result.Dsts = append(sim.result.Dsts, DstFill{
+			Ip:      p.ip,
+			Path:    p.location,
+			Sectors: len(p.sectors),
+			Bytes:   p.bytes,
+			Left:    p.disk.avail,
+			Full:    p.full,
+			FullAt:  p.fullAt,
+		})
+	}
+	return sim.result
+}
+
+func (sim *simulator) block(op Operation, reason string) {
+	entry := planEntryOf(op)
+	entry.Reason = reason
+	sim.result.Blocked = append(sim.result.Blocked, entry)
+}
+
+// forecast simulates copying every task of the task list with the current config
+func forecast(cfg *Config, model string) (*Forecast, error) {
+	taskListSingleton.TLock.Lock()
+	ops := append([]Operation{}, taskListSingleton.Ops...)
+	taskListSingleton.TLock.Unlock()
+	sectorPrioritiesSingleton.applyPriorities(ops)
+	sortByPriority(ops, cfg.PriorityRules)
+	sim, err := newSimulator(cfg, model)
+	if err != nil {
+		return nil, err
+	}
+	return sim.run(ops), nil
+}
+
+func (f *Forecast) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "forecast of %d %s tasks with the %s bandwidth model", f.Tasks, fileTypesString(fileTypes), f.Model)
+	if f.Estimated > 0 {
+		fmt.Fprintf(&b, ", %d copies without a measure at singlethreadmbps", f.Estimated)
+	}
+	fmt.Fprintf(&b, "\nETA %v, done about %s if started now\n", f.ETA.Truncate(time.Second),
+		time.Now().Add(f.ETA).Format("2006-01-02 15:04"))
+	for _, h := range f.Hosts {
+		fmt.Fprintf(&b, "%s computer %s: peak threads %d/%d\n", h.Side, h.Ip, h.Peak, h.Limit)
+	}
+	for _, d := range f.Dsts {
+		fmt.Fprintf(&b, "dst %s %s: %d sectors %.1f GiB, %.1f GiB left", d.Ip, d.Path, d.Sectors, gib(uint64(d.Bytes)), gib(d.Left))
+		if d.Full {
+			fmt.Fprintf(&b, ", full after %v", d.FullAt.Truncate(time.Second))
+		}
+		b.WriteString("\n")
+	}
+	for _, e := range f.Blocked {
+		fmt.Fprintf(&b, "blocked %s %s of %s %s: %s\n", e.SectorID, e.Kind, e.SrcIp, e.SrcPath, e.Reason)
+	}
+	return b.String()
+}
+
+var ForecastCmd = &cli.Command{
+	Name:  "forecast",
+	Usage: "simulate copying the tasks with the current config, print the ETA, peak threads and when the dst paths fill",
+	Flags: append(append([]cli.Flag{}, runFlags...),
+		&cli.StringFlag{
+			Name:  "model",
+			Usage: "speed of one thread, configured: singlethreadmbps, measured: the speed finished copies had on the paths",
+			Value: ModelConfigured,
+		},
+	),
+	Action: func(cctx *cli.Context) error {
+		model := cctx.String("model")
+		if model != ModelConfigured && model != ModelMeasured {
+			return fmt.Errorf("unknown model %s,options: %s,%s", model, ModelConfigured, ModelMeasured)
+		}
+		if err := setFileTypes(cctx); err != nil {
+			return err
+		}
+		config, closeRun, err := prepareRun(cctx)
+		if err != nil {
+			return err
+		}
+		defer closeRun()
+		if model == ModelMeasured && len(throughputSingleton.Paths) == 0 {
+			return errors.New("no copy measured yet in " + config.ThroughputFile + ", use the configured model")
+		}
+		if err := initializeTaskList(config); err != nil {
+			return err
+		}
+		f, err := forecast(config, model)
+		if err != nil {
+			return err
+		}
+		fmt.Print(f)
+		return nil
+	},
+}
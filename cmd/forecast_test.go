@@ -0,0 +1,178 @@
+package main
+
+import (
+	"move_sectors/move_common"
+	"testing"
+	"time"
+)
+
+const testGiB = int64(1 << 30)
+
+type simDst struct {
+	location string
+	disk     string // dst paths of one disk share its space
+	limit    int64
+	policy   CapacityPolicy
+}
+
+// newTestSimulator simulates one src path and the dst paths on virtual
+// disks of avail bytes each, no real disk is looked at
+func newTestSimulator(t *testing.T, cfg *Config, srcLimit int64, dsts []simDst, avail map[string]uint64) *simulator {
+	t.Helper()
+	if err := checkSchedule(cfg.Schedule); err != nil {
+		t.Fatal(err)
+	}
+	sim := &simulator{
+		cfg:    cfg,
+		model:  ModelConfigured,
+		policy: &fillFirstPolicy{},
+		hosts:  make(map[string]*simHost),
+		paths:  make(map[string]*simPath),
+		groups: make(map[string]*simPath),
+		start:  at(time.Monday, "12:00"),
+		result: &Forecast{Model: ModelConfigured, Blocked: make([]PlanEntry, 0)},
+	}
+	srcHost := &simHost{side: SideSrc, ip: testSrcIp, bandwidth: 1000}
+	dstHost := &simHost{side: SideDst, ip: testDstIp, bandwidth: 1000}
+	sim.hosts[hostKey(SideSrc, testSrcIp)] = srcHost
+	sim.hosts[hostKey(SideDst, testDstIp)] = dstHost
+	src := &simPath{side: SideSrc, ip: testSrcIp, key: pathKey(SideSrc, testSrcIp, "/src1"), host: srcHost, base: srcLimit}
+	sim.paths[src.key] = src
+	disks := make(map[string]*simDisk)
+	for i, d := range dsts {
+		disk, ok := disks[d.disk]
+		if !ok {
+			disk = &simDisk{avail: avail[d.disk], total: 10 * uint64(testGiB)}
+			disks[d.disk] = disk
+		}
+		p := &simPath{side: SideDst, ip: testDstIp, key: pathKey(SideDst, testDstIp, d.location), host: dstHost, base: d.limit,
+			location: d.location, disk: disk, policy: d.policy, weight: 1, order: i, canStore: true,
+			sectors: make(map[string]struct{}), copiedIDs: make(map[string]struct{})}
+		sim.paths[p.key] = p
+		sim.dsts = append(sim.dsts, p)
+	}
+	return sim
+}
+
+func waitingSealed(id string, size int64) Operation {
+	op := sealedOp(id, "/src1", size, 1000)
+	op.Status = StatusOnWaiting
+	return op
+}
+
+func waitingCache(id string, size int64) Operation {
+	return &CacheTask{SectorID: SectorID{ID: id}, SrcIp: testSrcIp, OriSrc: "/src1", TotalSize: size, Status: StatusOnWaiting}
+}
+
+func TestForecastSimulation(t *testing.T) {
+	oneDst := []simDst{{"/dst1", "sda", 4, CapacityPolicy{}}}
+	twoDsts := []simDst{{"/dst1", "sda", 4, CapacityPolicy{}}, {"/dst2", "sdb", 4, CapacityPolicy{}}}
+	// 1 GiB at 100 MB/s takes 10.24s
+	copyTime := 10240 * time.Millisecond
+	cases := []struct {
+		name     string
+		windows  []TimeWindow
+		srcLimit int64
+		dsts     []simDst
+		avail    map[string]uint64
+		ops      []Operation
+		eta      time.Duration
+		peak     int64 // dst host threads
+		blocked  []string
+		fills    map[string]int // dst path -> sectors
+		full     []string
+	}{
+		{"one thread copies one by one", nil, 1, oneDst, map[string]uint64{"sda": 9 * uint64(testGiB)},
+			[]Operation{waitingSealed("s-t01000-1", testGiB), waitingSealed("s-t01000-2", testGiB)},
+			2 * copyTime, 1, nil, map[string]int{"/dst1": 2}, nil},
+		{"threads copy at once", nil, 2, oneDst, map[string]uint64{"sda": 9 * uint64(testGiB)},
+			[]Operation{waitingSealed("s-t01000-1", testGiB), waitingSealed("s-t01000-2", testGiB)},
+			copyTime, 2, nil, map[string]int{"/dst1": 2}, nil},
+		{"disk full blocks the rest", nil, 2, oneDst, map[string]uint64{"sda": uint64(testGiB * 3 / 2)},
+			[]Operation{waitingSealed("s-t01000-1", testGiB), waitingSealed("s-t01000-2", testGiB)},
+			copyTime, 1, []string{"s-t01000-2"}, map[string]int{"/dst1": 1}, []string{"/dst1"}},
+		{"paths of one disk share its space", nil, 2,
+			[]simDst{{"/dst1", "sda", 4, CapacityPolicy{}}, {"/dst2", "sda", 4, CapacityPolicy{}}}, map[string]uint64{"sda": uint64(testGiB * 3 / 2)},
+			[]Operation{waitingSealed("s-t01000-1", testGiB), waitingSealed("s-t01000-2", testGiB)},
+			copyTime, 1, []string{"s-t01000-2"}, map[string]int{"/dst1": 1}, []string{"/dst1", "/dst2"}},
+		{"the next path takes what does not fit", nil, 2,
+			[]simDst{{"/dst1", "sda", 4, CapacityPolicy{MaxSectors: 1}}, {"/dst2", "sdb", 4, CapacityPolicy{}}}, map[string]uint64{"sda": 9 * uint64(testGiB), "sdb": 9 * uint64(testGiB)},
+			[]Operation{waitingSealed("s-t01000-1", testGiB), waitingSealed("s-t01000-2", testGiB)},
+			copyTime, 2, nil, map[string]int{"/dst1": 1, "/dst2": 1}, []string{"/dst1"}},
+		// the cache starts once its sealed file started
+		{"cache follows its sealed file", nil, 2, twoDsts, map[string]uint64{"sda": uint64(testGiB * 3 / 2), "sdb": 9 * uint64(testGiB)},
+			[]Operation{waitingSealed("s-t01000-1", testGiB), waitingCache("s-t01000-1", testGiB/4)},
+			copyTime, 2, nil, map[string]int{"/dst1": 1, "/dst2": 0}, []string{"/dst1"}},
+		{"no new tasks until the window ends", []TimeWindow{{Start: "11:00", End: "13:00", NoNewTasks: true}}, 1, oneDst, map[string]uint64{"sda": 9 * uint64(testGiB)},
+			[]Operation{waitingSealed("s-t01000-1", testGiB)},
+			time.Hour + copyTime, 1, nil, map[string]int{"/dst1": 1}, nil},
+		{"a slower window slows the copy down", []TimeWindow{{Start: "12:00", End: "13:00", SingleThreadMBPS: 50}}, 1, oneDst, map[string]uint64{"sda": 9 * uint64(testGiB)},
+			[]Operation{waitingSealed("s-t01000-1", testGiB)},
+			2 * copyTime, 1, nil, map[string]int{"/dst1": 1}, nil},
+		{"the schedule never allows new tasks", []TimeWindow{{Start: "00:00", End: "00:00", NoNewTasks: true}}, 1, oneDst, map[string]uint64{"sda": 9 * uint64(testGiB)},
+			[]Operation{waitingSealed("s-t01000-1", testGiB)},
+			0, 0, []string{"s-t01000-1"}, map[string]int{"/dst1": 0}, nil},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			cfg := &Config{SingleThreadMBPS: 100, Schedule: c.windows}
+			f := newTestSimulator(t, cfg, c.srcLimit, c.dsts, c.avail).run(c.ops)
+			if diff := f.ETA - c.eta; diff < -time.Millisecond || diff > time.Millisecond {
+				t.Fatalf("ETA %v, want %v", f.ETA, c.eta)
+			}
+			for _, h := range f.Hosts {
+				if h.Side == SideDst && h.Peak != c.peak {
+					t.Fatalf("dst peak threads %d, want %d", h.Peak, c.peak)
+				}
+			}
+			if len(f.Blocked) != len(c.blocked) {
+				t.Fatalf("blocked %+v, want %v", f.Blocked, c.blocked)
+			}
+			for i, e := range f.Blocked {
+				if e.SectorID != c.blocked[i] || e.Reason == "" {
+					t.Fatalf("blocked %+v, want %v", f.Blocked, c.blocked)
+				}
+			}
+			full := make([]string, 0)
+			for _, d := range f.Dsts {
+				if d.Sectors != c.fills[d.Path] {
+					t.Fatalf("dst %s got %d sectors, want %d", d.Path, d.Sectors, c.fills[d.Path])
+				}
+				if d.Full {
+					full = append(full, d.Path)
+				}
+			}
+			if len(full) != len(c.full) {
+				t.Fatalf("full dst paths %v, want %v", full, c.full)
+			}
+			for i := range full {
+				if full[i] != c.full[i] {
+					t.Fatalf("full dst paths %v, want %v", full, c.full)
+				}
+			}
+		})
+	}
+}
+
+func TestForecastFollowsPlacementMap(t *testing.T) {
+	saved := placementMapSingleton
+	defer func() { placementMapSingleton = saved }()
+	placementMapSingleton = *newTestPlacementMap(t)
+	// an earlier run put the unsealed file of the sector on /dst2, fill-first would choose /dst1
+	if err := placementMapSingleton.assign("s-t01000-1", move_common.UnSealed, testDstIp, "/dst2"); err != nil {
+		t.Fatal(err)
+	}
+	dsts := []simDst{{"/dst1", "sda", 4, CapacityPolicy{}}, {"/dst2", "sdb", 4, CapacityPolicy{}}}
+	avail := map[string]uint64{"sda": 9 * uint64(testGiB), "sdb": 9 * uint64(testGiB)}
+	sim := newTestSimulator(t, &Config{SingleThreadMBPS: 100}, 2, dsts, avail)
+	f := sim.run([]Operation{waitingSealed("s-t01000-1", testGiB), waitingCache("s-t01000-1", testGiB/4), waitingSealed("s-t01000-2", testGiB)})
+	want := map[string]int{"/dst1": 1, "/dst2": 1}
+	for _, d := range f.Dsts {
+		if d.Sectors != want[d.Path] {
+			t.Fatalf("dst %s got %d sectors, want %d", d.Path, d.Sectors, want[d.Path])
+		}
+		if d.Path == "/dst2" && d.Bytes != testGiB+testGiB/4 {
+			t.Fatalf("dst2 got %d bytes, want the sealed file and the cache", d.Bytes)
+		}
+	}
+}
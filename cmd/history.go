@@ -0,0 +1,454 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/urfave/cli/v2"
+	bolt "go.etcd.io/bbolt"
+	"io"
+	"move_sectors/move_common"
+	"move_sectors/mv_utils"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+var historyBucket = []byte("history")
+
+// HistoryExisted is the status of a task the exist check found on dst
+// already, nothing was copied for it
+const HistoryExisted = "Existed"
+
+// HistoryRecord is how one copy of a task ended, or a task skipped before it copied
+type HistoryRecord struct {
+	Job      string
+	SectorID string
+	Kind     move_common.FileType
+	Status   string
+	SrcIp    string
+	SrcPath  string // the source file, or dir of cache
+	DstIp    string
+	DstPath  string // the dst file, or dir of cache
+	Bytes    int64
+	Started  int64
+	Finished int64
+	Seconds  float64
+	MBPS     float64
+	Hash     string // sampled hash of the dst file, of p_aux for cache
+	Error    string
+}
+
+// HistoryLog appends the records to a bbolt db, opened per transaction so
+// jobs and the history command share it
+type HistoryLog struct {
+	File  string
+	HLock *sync.Mutex
+}
+
+var historySingleton = HistoryLog{
+	HLock: new(sync.Mutex),
+}
+
+func (h *HistoryLog) open(readOnly bool) (*bolt.DB, error) {
+	return bolt.Open(h.File, 0644, &bolt.Options{Timeout: 10 * time.Second, ReadOnly: readOnly})
+}
+
+func (h *HistoryLog) add(rec HistoryRecord) {
+	if h.File == "" {
+		return
+	}
+	raw, err := json.Marshal(rec)
+	if err != nil {
+		log.Warnf("history of %s %s: %v", rec.SectorID, rec.Kind, err)
+		return
+	}
+	h.HLock.Lock()
+	defer h.HLock.Unlock()
+	db, err := h.open(false)
+	if err != nil {
+		log.Warnf("open history %s failed: %v", h.File, err)
+		return
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(historyBucket)
+		if err != nil {
+			return err
+		}
+		seq, err := b.NextSequence()
+		if err != nil {
+			return err
+		}
+		key := make([]byte, 8)
+		binary.BigEndian.PutUint64(key, seq)
+		return b.Put(key, raw)
+	})
+	if closeErr := db.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		log.Warnf("history of %s %s not saved: %v", rec.SectorID, rec.Kind, err)
+	}
+}
+
+func historyRecordOf(op Operation) HistoryRecord {
+	rec := HistoryRecord{
+		SectorID: op.getSectorID(),
+		Kind:     op.getFileType(),
+		Status:   op.getStatus(),
+		SrcIp:    op.getSrcIp(),
+		Finished: time.Now().Unix(),
+	}
+	if journalSingleton != nil {
+		rec.Job = journalSingleton.Meta.ID
+	}
+	switch task := op.getInfo().(type) {
+	case SealedTask:
+		rec.SrcPath, rec.DstIp, rec.DstPath = task.SealedSrc, task.DstIp, task.SealedDst
+	case UnSealedTask:
+		rec.SrcPath, rec.DstIp, rec.DstPath = task.UnSealedSrc, task.DstIp, task.UnSealedDst
+	case CacheTask:
+		rec.SrcPath, rec.DstIp, rec.DstPath = task.CacheSrcDir, task.DstIp, task.CacheDstDir
+	}
+	return rec
+}
+
+// finished records how the copy run of op ended
+func (h *HistoryLog) finished(op Operation, run *CopyRun, cfg *Config) {
+	if h.File == "" {
+		return
+	}
+	rec := historyRecordOf(op)
+	rec.Bytes = run.Size - run.remain()
+	rec.Error = run.failure
+	if run.slot != nil {
+		rec.Started = run.slot.Acquired.Unix()
+		rec.Seconds = time.Now().Sub(run.slot.Acquired).Seconds()
+		if rec.Seconds > 0 {
+			rec.MBPS = float64(rec.Bytes) / float64(1<<20) / rec.Seconds
+		}
+	}
+	if rec.Status == StatusDone && rec.Error == "" {
+		rec.Hash = historyHash(op, rec.DstPath, cfg)
+	}
+	h.add(rec)
+}
+
+// stopped records a waiting task cancelled or skipped before it was copied
+func (h *HistoryLog) stopped(op Operation) {
+	if h.File == "" {
+		return
+	}
+	rec := historyRecordOf(op)
+	rec.DstIp, rec.DstPath = "", ""
+	h.add(rec)
+}
+
+// existing records a task skipped since it is complete on dst already
+func (h *HistoryLog) existing(op Operation, srcPaths []string) {
+	if h.File == "" {
+		return
+	}
+	rec := historyRecordOf(op)
+	rec.Status = HistoryExisted
+	rec.DstIp, rec.DstPath = "", ""
+	if location, _, _, ok := existingDst(op, srcPaths); ok && location != "" {
+		rec.DstIp = dstIpOf(location)
+		rec.DstPath = location + strings.TrimPrefix(rec.SrcPath, strings.TrimRight(op.getSrcPath(), "/"))
+	}
+	h.add(rec)
+}
+
+// dstIpOf returns the dst computer the path is configured on
+func dstIpOf(location string) string {
+	dstComputersMapSingleton.CLock.Lock()
+	defer dstComputersMapSingleton.CLock.Unlock()
+	for ip, cmp := range dstComputersMapSingleton.CMap {
+		for _, p := range cmp.Paths {
+			if strings.TrimRight(p.Location, "/") == location {
+				return ip
+			}
+		}
+	}
+	return ""
+}
+
+// historyHash samples the dst with the exist check algorithm, cheap even for
+// a sealed file so every copy gets one
+func historyHash(op Operation, dst string, cfg *Config) string {
+	if op.getFileType() == move_common.Cache {
+		dst = path.Join(dst, "p_aux")
+	}
+	info, err := os.Stat(dst)
+	if err != nil {
+		return ""
+	}
+	opt := cfg.ExistCheck.hashOption()
+	opt.Mode = mv_utils.CheckModeSample
+	s, err := mv_utils.CalFileHashWithOption(dst, info.Size(), opt, existCheckBudget)
+	if err != nil {
+		log.Warnf("hash %s for the history failed: %v", dst, err)
+		return ""
+	}
+	return opt.Key() + ":" + s
+}
+
+// HistoryFilter selects records, zero fields match everything
+type HistoryFilter struct {
+	SectorID string
+	Location string // the src or dst path is it or under it
+	Status   string
+	Since    int64
+	Until    int64
+}
+
+func (f HistoryFilter) match(rec HistoryRecord) bool {
+	if f.SectorID != "" && rec.SectorID != f.SectorID {
+		return false
+	}
+	if f.Location != "" && !underPath(rec.SrcPath, f.Location) && !underPath(rec.DstPath, f.Location) {
+		return false
+	}
+	if f.Status != "" && !strings.EqualFold(rec.Status, f.Status) && !strings.EqualFold(rec.Status, "Status"+f.Status) {
+		return false
+	}
+	if f.Since > 0 && rec.Finished < f.Since {
+		return false
+	}
+	if f.Until > 0 && rec.Finished > f.Until {
+		return false
+	}
+	return true
+}
+
+// underPath reports whether file is location or under it, /mnt/disk1 does not take /mnt/disk10
+func underPath(file, location string) bool {
+	location = strings.TrimRight(location, "/")
+	return file == location || strings.HasPrefix(file, location+"/")
+}
+
+// records returns the matched records in the order they were added
+func (h *HistoryLog) records(filter HistoryFilter) ([]HistoryRecord, error) {
+	if _, err := os.Stat(h.File); err != nil {
+		return nil, err
+	}
+	db, err := h.open(true)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	records := make([]HistoryRecord, 0)
+	err = db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(historyBucket)
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			var rec HistoryRecord
+			if err := json.Unmarshal(v, &rec); err != nil {
+				return err
+			}
+			if filter.match(rec) {
+				records = append(records, rec)
+			}
+			return nil
+		})
+	})
+	return records, err
+}
+
+// lastDone keeps the last done record of every sector part, where it was at the end of records
+func lastDone(records []HistoryRecord) []HistoryRecord {
+	index := make(map[string]int)
+	last := make([]HistoryRecord, 0)
+	for _, rec := range records {
+		if rec.Status != StatusDone || rec.Error != "" {
+			continue
+		}
+		key := string(rec.Kind) + "|" + rec.SectorID
+		if i, ok := index[key]; ok {
+			last[i] = rec
+			continue
+		}
+		index[key] = len(last)
+		last = append(last, rec)
+	}
+	return last
+}
+
+// parseHistoryTime takes a date, a date and time, or RFC3339, in local time
+func parseHistoryTime(s string) (int64, error) {
+	for _, layout := range []string{"2006-01-02 15:04:05", "2006-01-02 15:04", "2006-01-02"} {
+		if t, err := time.ParseInLocation(layout, s, time.Local); err == nil {
+			return t.Unix(), nil
+		}
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return 0, fmt.Errorf("can not parse time %s, like 2006-01-02 or 2006-01-02 15:04:05", s)
+	}
+	return t.Unix(), nil
+}
+
+func formatUnix(sec int64) string {
+	if sec == 0 {
+		return ""
+	}
+	return time.Unix(sec, 0).Format("2006-01-02 15:04:05")
+}
+
+var historyHeader = []string{"Finished", "Job", "SectorID", "Kind", "Status", "SrcIp", "SrcPath", "DstIp", "DstPath",
+	"Bytes", "Started", "Seconds", "MBPS", "Hash", "Error"}
+
+func (rec HistoryRecord) fields() []string {
+	return []string{formatUnix(rec.Finished), rec.Job, rec.SectorID, string(rec.Kind), rec.Status, rec.SrcIp, rec.SrcPath,
+		rec.DstIp, rec.DstPath, strconv.FormatInt(rec.Bytes, 10), formatUnix(rec.Started),
+		strconv.FormatFloat(rec.Seconds, 'f', 1, 64), strconv.FormatFloat(rec.MBPS, 'f', 1, 64), rec.Hash, rec.Error}
+}
+
+func writeHistory(w io.Writer, records []HistoryRecord, format string) error {
+	switch format {
+	case "json":
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(records)
+	case "csv":
+		cw := csv.NewWriter(w)
+		if err := cw.Write(historyHeader); err != nil {
+			return err
+		}
+		for _, rec := range records {
+			if err := cw.Write(rec.fields()); err != nil {
+				return err
+			}
+		}
+		cw.Flush()
+		return cw.Error()
+	case "table":
+		tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "FINISHED\tSECTOR\tKIND\tSTATUS\tSRC\tDST\tGIB\tMB/S\tERROR")
+		for _, rec := range records {
+			dst := ""
+			if rec.DstPath != "" {
+				dst = rec.DstIp + ":" + rec.DstPath
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%.1f\t%.1f\t%s\n", formatUnix(rec.Finished), rec.SectorID, rec.Kind,
+				strings.TrimPrefix(rec.Status, "Status"), rec.SrcIp+":"+rec.SrcPath, dst, gib(uint64(rec.Bytes)), rec.MBPS, rec.Error)
+		}
+		return tw.Flush()
+	}
+	return fmt.Errorf("unknown format %s,options: table,csv,json", format)
+}
+
+var HistoryCmd = &cli.Command{
+	Name:  "history",
+	Usage: "show the finished, failed and skipped tasks of all jobs",
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:  "path",
+			Usage: "special the config file paths, its historyfile is read",
+			Value: "~/mv_sectors.yaml",
+		},
+		&cli.StringFlag{
+			Name:  "file",
+			Usage: "the history db, instead of the historyfile of the config",
+		},
+		&cli.StringFlag{
+			Name:  "sector",
+			Usage: "only the tasks of the sector, like s-t01000-1",
+		},
+		&cli.StringFlag{
+			Name:  "location",
+			Usage: "only the tasks whose src or dst is under the path",
+		},
+		&cli.StringFlag{
+			Name:  "status",
+			Usage: "only the tasks ended with the status: Done, Failed, Cancelled, Skipped, Existed (found on dst, not copied) or OnWaiting (will retry)",
+		},
+		&cli.StringFlag{
+			Name:  "since",
+			Usage: "only the tasks finished since, like 2006-01-02 or 2006-01-02 15:04:05",
+		},
+		&cli.StringFlag{
+			Name:  "until",
+			Usage: "only the tasks finished until",
+		},
+		&cli.StringFlag{
+			Name:  "at",
+			Usage: "where every sector part was at the time, its last done copy until then",
+		},
+		&cli.StringFlag{
+			Name:  "format",
+			Usage: "table, csv or json",
+			Value: "table",
+		},
+		&cli.StringFlag{
+			Name:  "out",
+			Usage: "write to the file instead of stdout",
+		},
+	},
+	Action: func(cctx *cli.Context) error {
+		file := cctx.String("file")
+		if file == "" {
+			config, err := getConfig(cctx)
+			if err != nil {
+				return err
+			}
+			file = config.HistoryFile
+		} else if abs, err := mv_utils.GetAbsPath(file); err != nil {
+			return err
+		} else {
+			file = abs
+		}
+		filter := HistoryFilter{
+			SectorID: cctx.String("sector"),
+			Location: strings.TrimRight(cctx.String("location"), "/"),
+			Status:   cctx.String("status"),
+		}
+		var err error
+		if s := cctx.String("since"); s != "" {
+			if filter.Since, err = parseHistoryTime(s); err != nil {
+				return err
+			}
+		}
+		if s := cctx.String("until"); s != "" {
+			if filter.Until, err = parseHistoryTime(s); err != nil {
+				return err
+			}
+		}
+		if s := cctx.String("at"); s != "" {
+			if filter.Status != "" || filter.Until != 0 {
+				return errors.New("--at takes the done copies until the time, it goes without --status and --until")
+			}
+			if filter.Until, err = parseHistoryTime(s); err != nil {
+				return err
+			}
+		}
+		h := HistoryLog{File: file, HLock: new(sync.Mutex)}
+		records, err := h.records(filter)
+		if os.IsNotExist(err) {
+			return fmt.Errorf("no history in %s yet", file)
+		} else if err != nil {
+			return err
+		}
+		if cctx.String("at") != "" {
+			records = lastDone(records)
+		}
+		var w io.Writer = os.Stdout
+		if out := cctx.String("out"); out != "" {
+			f, err := os.Create(out)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			w = f
+		}
+		return writeHistory(w, records, cctx.String("format"))
+	},
+}
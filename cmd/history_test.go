@@ -0,0 +1,63 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestUnderPath(t *testing.T) {
+	cases := []struct {
+		file, location string
+		want           bool
+	}{
+		{"/mnt/disk1", "/mnt/disk1", true},
+		{"/mnt/disk1/sealed/s-t01000-1", "/mnt/disk1", true},
+		{"/mnt/disk1/sealed/s-t01000-1", "/mnt/disk1/", true},
+		{"/mnt/disk10/sealed/s-t01000-1", "/mnt/disk1", false},
+		{"/mnt/disk1", "/mnt/disk1/sealed", false},
+		{"/mnt/disk1-old/cache", "/mnt/disk1", false},
+		{"/mnt/disk1/sealed", "/", true},
+		{"", "/mnt/disk1", false},
+	}
+	for _, c := range cases {
+		if got := underPath(c.file, c.location); got != c.want {
+			t.Errorf("underPath(%q, %q) = %v, want %v", c.file, c.location, got, c.want)
+		}
+	}
+}
+
+func TestHistoryFilterMatch(t *testing.T) {
+	rec := HistoryRecord{
+		SectorID: "s-t01000-1",
+		SrcPath:  "/mnt/src1/sealed/s-t01000-1",
+		DstPath:  "/mnt/disk1/sealed/s-t01000-1",
+		Status:   StatusDone,
+		Finished: 2000,
+	}
+	cases := []struct {
+		name   string
+		filter HistoryFilter
+		want   bool
+	}{
+		{"no filter", HistoryFilter{}, true},
+		{"sector", HistoryFilter{SectorID: "s-t01000-1"}, true},
+		{"other sector", HistoryFilter{SectorID: "s-t01000-10"}, false},
+		{"src path", HistoryFilter{Location: "/mnt/src1"}, true},
+		{"dst path", HistoryFilter{Location: "/mnt/disk1/"}, true},
+		{"path with the same prefix", HistoryFilter{Location: "/mnt/disk"}, false},
+		{"path under another", HistoryFilter{Location: "/mnt/disk10"}, false},
+		{"status", HistoryFilter{Status: StatusDone}, true},
+		{"status without prefix, any case", HistoryFilter{Status: "done"}, true},
+		{"other status", HistoryFilter{Status: "Failed"}, false},
+		{"since", HistoryFilter{Since: 2000}, true},
+		{"finished before since", HistoryFilter{Since: 2001}, false},
+		{"until", HistoryFilter{Until: 2000}, true},
+		{"finished after until", HistoryFilter{Until: 1999}, false},
+		{"all match", HistoryFilter{SectorID: "s-t01000-1", Location: "/mnt/disk1", Status: "done", Since: 1000, Until: 3000}, true},
+		{"one does not match", HistoryFilter{SectorID: "s-t01000-1", Location: "/mnt/disk2", Status: "done", Since: 1000, Until: 3000}, false},
+	}
+	for _, c := range cases {
+		if got := c.filter.match(rec); got != c.want {
+			t.Errorf("%s: match %v, want %v", c.name, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	fslock "github.com/ipfs/go-fs-lock"
+	"github.com/urfave/cli/v2"
+	"io"
+	"io/ioutil"
+	"move_sectors/mv_utils"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// JobInfo is a running job as the jobs command shows it, kept in the
+// registry dir of the host while the job runs
+type JobInfo struct {
+	ID       string
+	Pid      int
+	Started  int64
+	Config   string
+	Kinds    string
+	Journal  string
+	Socket   string
+	SrcPaths []string
+	DstPaths []string
+}
+
+var (
+	jobRegistryDir = filepath.Join(os.TempDir(), "move_sectors_jobs")
+	jobNamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+)
+
+var jobFlag = &cli.StringFlag{
+	Name:  "job",
+	Usage: "the job to control, could be omitted if only one job is running",
+}
+
+func newJobID() string {
+	return "job-" + time.Now().Format("20060102-150405")
+}
+
+// jobIDOf returns the job named by --job or --resume, or a new id
+func jobIDOf(cctx *cli.Context) (string, bool, error) {
+	name, resume := cctx.String("job"), cctx.String("resume")
+	if name != "" && resume != "" {
+		return "", false, errors.New("--job names a new job, --resume an existing one, use only one of them")
+	}
+	if resume != "" {
+		name = resume
+	}
+	if name == "" {
+		return newJobID(), false, nil
+	}
+	if !jobNamePattern.MatchString(name) {
+		return "", false, fmt.Errorf("job name %s should be letters, digits, '.', '_' or '-'", name)
+	}
+	return name, resume != "", nil
+}
+
+func jobLockName(id string) string {
+	return "move_sectors-" + id + ".lock"
+}
+
+// lockJob makes sure only one process runs the job, other jobs run freely
+func lockJob(id string) (io.Closer, error) {
+	lock, err := createFileLock(os.TempDir(), jobLockName(id))
+	if err != nil {
+		return nil, fmt.Errorf("lock job %s: %w", id, err)
+	}
+	return lock, nil
+}
+
+func controlSocketPath(id string) string {
+	return filepath.Join(os.TempDir(), "move_sectors-"+id+".sock")
+}
+
+var jobStarted = time.Now().Unix()
+
+func computerPaths(computers []Computer) []string {
+	paths := make([]string, 0)
+	for _, cmp := range computers {
+		for _, p := range cmp.Paths {
+			paths = append(paths, cmp.Ip+":"+strings.TrimRight(p.Location, "/"))
+		}
+	}
+	return paths
+}
+
+// registerJob adds the job to the registry, the returned func removes it.
+// Reservations, capacity usage and MaxStorage are counted by each job alone,
+// so a job may not use a dst path another running job uses
+func registerJob(config *Config, id string) (func(), error) {
+	file, err := writeJobInfo(config, id)
+	if err != nil {
+		return nil, err
+	}
+	return func() { _ = os.Remove(file) }, nil
+}
+
+// updateJob checks the new config of a reload and rewrites the registry
+// entry of the job, the func registerJob returned still removes it
+func updateJob(config *Config, id string) error {
+	_, err := writeJobInfo(config, id)
+	return err
+}
+
+// writeJobInfo writes the registry entry of the job unless another running
+// job uses one of its dst paths, and returns the entry file
+func writeJobInfo(config *Config, id string) (string, error) {
+	cfg := config.snapshot()
+	info := JobInfo{
+		ID:       id,
+		Pid:      os.Getpid(),
+		Started:  jobStarted,
+		Config:   cfg.filePath,
+		Kinds:    fileTypesString(fileTypes),
+		Socket:   controlSocketPath(id),
+		SrcPaths: computerPaths(cfg.SrcComputers),
+		DstPaths: computerPaths(cfg.DstComputers),
+	}
+	if journalSingleton != nil {
+		info.Journal = journalSingleton.File
+	}
+	if err := os.MkdirAll(jobRegistryDir, 0777); err != nil {
+		return "", err
+	}
+	// no other job registers between the check and the write
+	lock, err := mv_utils.LockFile(filepath.Join(jobRegistryDir, "registry.lock"))
+	if err != nil {
+		return "", err
+	}
+	defer mv_utils.UnlockFile(lock)
+	if err = checkDstPaths(config, id); err != nil {
+		return "", err
+	}
+	raw, err := json.Marshal(info)
+	if err != nil {
+		return "", err
+	}
+	file := filepath.Join(jobRegistryDir, id+".json")
+	if err = ioutil.WriteFile(file, raw, 0644); err != nil {
+		return "", err
+	}
+	return file, nil
+}
+
+// checkDstPaths fails if another running job uses a dst path of cfg
+func checkDstPaths(cfg *Config, id string) error {
+	jobs, err := runningJobs()
+	if err != nil {
+		return err
+	}
+	dstPaths := computerPaths(cfg.snapshot().DstComputers)
+	for _, job := range jobs {
+		if job.ID == id {
+			continue
+		}
+		for _, p := range dstPaths {
+			for _, other := range job.DstPaths {
+				if p == strings.TrimRight(other, "/") {
+					return fmt.Errorf("dst %s is used by the running job %s, jobs may share src paths but not dst paths", p, job.ID)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// runningJobs lists the registered jobs whose process still holds the job
+// lock, entries of crashed jobs are removed
+func runningJobs() ([]JobInfo, error) {
+	files, err := filepath.Glob(filepath.Join(jobRegistryDir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	jobs := make([]JobInfo, 0, len(files))
+	for _, file := range files {
+		raw, err := ioutil.ReadFile(file)
+		if err != nil {
+			continue
+		}
+		var info JobInfo
+		if err = json.Unmarshal(raw, &info); err != nil {
+			log.Warnf("bad job registry %s: %v", file, err)
+			continue
+		}
+		if locked, err := fslock.Locked(os.TempDir(), jobLockName(info.ID)); err != nil || !locked {
+			_ = os.Remove(file)
+			continue
+		}
+		jobs = append(jobs, info)
+	}
+	sort.Slice(jobs, func(i, j int) bool { return jobs[i].Started < jobs[j].Started })
+	return jobs, nil
+}
+
+// jobSocket returns the control socket of --job, or of the only running job
+func jobSocket(cctx *cli.Context) (string, error) {
+	if id := cctx.String("job"); id != "" {
+		return controlSocketPath(id), nil
+	}
+	jobs, err := runningJobs()
+	if err != nil {
+		return "", err
+	}
+	switch len(jobs) {
+	case 0:
+		return "", errors.New("no job is running")
+	case 1:
+		return jobs[0].Socket, nil
+	}
+	ids := make([]string, len(jobs))
+	for i, job := range jobs {
+		ids[i] = job.ID
+	}
+	return "", fmt.Errorf("jobs %s are running, tell which one by --job", strings.Join(ids, ","))
+}
+
+// jobSummary counts the tasks of the running job by status
+func jobSummary(req *ControlRequest) (string, error) {
+	counts := make(map[string]int)
+	taskListSingleton.TLock.Lock()
+	ops := taskListSingleton.Ops
+	taskListSingleton.TLock.Unlock()
+	for _, op := range ops {
+		counts[op.getStatus()]++
+	}
+	msg := fmt.Sprintf("waiting %d, working %d, done %d, failed %d",
+		counts[StatusOnWaiting], counts[StatusOnWorking], counts[StatusDone], counts[StatusFailed])
+	if schedulerSingleton.paused() {
+		msg += ", paused"
+	}
+	return msg, nil
+}
+
+var JobsCmd = &cli.Command{
+	Name:  "jobs",
+	Usage: "list the jobs running on this host",
+	Action: func(cctx *cli.Context) error {
+		jobs, err := runningJobs()
+		if err != nil {
+			return err
+		}
+		if len(jobs) == 0 {
+			fmt.Println("no job is running")
+			return nil
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "JOB\tPID\tSTARTED\tKINDS\tTASKS\tCONFIG")
+		for _, job := range jobs {
+			tasks, err := sendControl(job.Socket, &ControlRequest{Cmd: CtrlJob})
+			if err != nil {
+				tasks = "unknown"
+			}
+			fmt.Fprintf(w, "%s\t%d\t%s\t%s\t%s\t%s\n", job.ID, job.Pid,
+				time.Unix(job.Started, 0).Format("2006-01-02 15:04:05"), job.Kinds, tasks, job.Config)
+		}
+		w.Flush()
+		for _, job := range jobs {
+			fmt.Printf("%s: src %s, dst %s\n", job.ID, strings.Join(job.SrcPaths, " "), strings.Join(job.DstPaths, " "))
+		}
+		return nil
+	},
+}
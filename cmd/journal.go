@@ -0,0 +1,520 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/urfave/cli/v2"
+	bolt "go.etcd.io/bbolt"
+	"move_sectors/move_common"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	jobBucket   = []byte("job")
+	tasksBucket = []byte("tasks")
+	jobMetaKey  = []byte("meta")
+)
+
+const (
+	JobRunning = "running"
+	JobStopped = "stopped"
+	JobDone    = "done"
+	JobFailed  = "failed"
+
+	// journal states of a task besides the task statuses
+	JournalDiscovered = "discovered"
+	JournalPlaced     = "placed"
+)
+
+// JobMeta is what a job was started with, resume takes it again
+type JobMeta struct {
+	ID              string
+	Created         int64
+	Updated         int64
+	Config          string
+	Kinds           []move_common.FileType
+	SectorListFile  string
+	SkipSourceError bool
+	State           string
+	Pid             int
+}
+
+// JournalFile is a file a task wrote on its dst path
+type JournalFile struct {
+	Path string
+	Size int64
+}
+
+// TaskRecord is the journal of one task, written at every step of it
+type TaskRecord struct {
+	SectorID string
+	Kind     move_common.FileType
+	SrcIp    string
+	SrcPath  string
+	Size     int64
+	SrcMtime int64
+	State    string // discovered, placed or a task status
+	DstIp    string
+	DstPath  string
+	Written  int64 // bytes the running or the last copy has on dst
+	Attempts int
+	Verified string // how the dst files were checked, empty if they were not
+	DstFiles []JournalFile
+	Updated  int64
+}
+
+// Journal persists the steps of every task of a job in a bbolt db, so a job
+// stopped or crashed can be resumed without finding and hashing again
+type Journal struct {
+	Meta JobMeta
+	File string
+	db   *bolt.DB
+	// records of the tasks whose interrupted copy left partial files on dst
+	partial map[string]TaskRecord
+	lock    *sync.Mutex
+}
+
+// journalSingleton is nil for commands which do not copy
+var journalSingleton *Journal
+
+func journalKey(op Operation) []byte {
+	return []byte(planEntryOf(op).key())
+}
+
+// openJob starts the new job id, or reopens it to resume and takes the kinds,
+// sector list and source error handling it was started with unless they are
+// given again
+func openJob(cctx *cli.Context, cfg *Config, id string, resume bool) (*Journal, error) {
+	if err := os.MkdirAll(cfg.JournalDir, 0755); err != nil {
+		return nil, err
+	}
+	file := filepath.Join(cfg.JournalDir, id+".db")
+	if _, err := os.Stat(file); resume && os.IsNotExist(err) {
+		return nil, fmt.Errorf("no job %s in %s", id, cfg.JournalDir)
+	} else if !resume && err == nil {
+		return nil, fmt.Errorf("job %s exists already, resume it by run --resume %s", id, id)
+	}
+	db, err := bolt.Open(file, 0644, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("open job journal %s: %w", file, err)
+	}
+	j := &Journal{File: file, db: db, partial: make(map[string]TaskRecord), lock: new(sync.Mutex)}
+	if resume {
+		if err = j.loadMeta(); err != nil {
+			db.Close()
+			return nil, err
+		}
+		if len(fileTypes) == 0 {
+			fileTypes = j.Meta.Kinds
+			log.Infof("will copy %s files of job %s", fileTypesString(fileTypes), id)
+		}
+		if !cctx.IsSet("SkipSourceError") {
+			skipSourceError = j.Meta.SkipSourceError
+		}
+		if cctx.String("SectorListFile") == "" && j.Meta.SectorListFile != "" {
+			if err = makeSpecifiedSectorsMap(j.Meta.SectorListFile); err != nil {
+				db.Close()
+				return nil, err
+			}
+		}
+	} else {
+		j.Meta = JobMeta{
+			ID:              id,
+			Created:         time.Now().Unix(),
+			Config:          cfg.filePath,
+			Kinds:           fileTypes,
+			SectorListFile:  sectorPrioritiesSingleton.File,
+			SkipSourceError: skipSourceError,
+		}
+	}
+	j.Meta.State = JobRunning
+	j.Meta.Pid = os.Getpid()
+	if err = j.saveMeta(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	if resume {
+		log.Infof("job %s resumed, journal %s", id, file)
+	} else {
+		log.Infof("job %s started, journal %s, resume it by run --resume %s", id, file, id)
+	}
+	return j, nil
+}
+
+func (j *Journal) loadMeta() error {
+	return j.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(jobBucket)
+		if b == nil {
+			return fmt.Errorf("journal %s has no job", j.File)
+		}
+		return json.Unmarshal(b.Get(jobMetaKey), &j.Meta)
+	})
+}
+
+func (j *Journal) saveMeta() error {
+	j.Meta.Updated = time.Now().Unix()
+	raw, err := json.Marshal(j.Meta)
+	if err != nil {
+		return err
+	}
+	return j.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(jobBucket)
+		if err != nil {
+			return err
+		}
+		return b.Put(jobMetaKey, raw)
+	})
+}
+
+// jobEndState tells whether the job exits because of err, it was stopped or
+// it finished
+func jobEndState(err error) string {
+	if err != nil {
+		return JobFailed
+	}
+	schedulerSingleton.SLock.Lock()
+	defer schedulerSingleton.SLock.Unlock()
+	if stop || schedulerSingleton.Stopping {
+		return JobStopped
+	}
+	return JobDone
+}
+
+// close records the state the job ended in
+func (j *Journal) close(state string) {
+	if j == nil {
+		return
+	}
+	j.Meta.State = state
+	if err := j.saveMeta(); err != nil {
+		log.Warnf("save job %s failed: %v", j.Meta.ID, err)
+	}
+	j.db.Close()
+}
+
+// update applies fn to the record of op, batched with concurrent updates
+func (j *Journal) update(op Operation, fn func(r *TaskRecord)) {
+	if j == nil {
+		return
+	}
+	err := j.db.Batch(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(tasksBucket)
+		if err != nil {
+			return err
+		}
+		key := journalKey(op)
+		var r TaskRecord
+		if raw := b.Get(key); raw != nil {
+			if err := json.Unmarshal(raw, &r); err != nil {
+				return err
+			}
+		}
+		e := planEntryOf(op)
+		r.SectorID, r.Kind, r.SrcIp, r.SrcPath, r.Size, r.SrcMtime = e.SectorID, e.Kind, e.SrcIp, e.SrcPath, e.Size, e.SrcMtime
+		fn(&r)
+		r.Updated = time.Now().Unix()
+		raw, err := json.Marshal(r)
+		if err != nil {
+			return err
+		}
+		return b.Put(key, raw)
+	})
+	if err != nil {
+		log.Warnf("journal %s of %s failed: %v", op.getSectorID(), op.getFileType(), err)
+	}
+}
+
+func (j *Journal) records() (map[string]TaskRecord, error) {
+	records := make(map[string]TaskRecord)
+	err := j.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(tasksBucket)
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			var r TaskRecord
+			if err := json.Unmarshal(v, &r); err != nil {
+				return err
+			}
+			records[string(k)] = r
+			return nil
+		})
+	})
+	return records, err
+}
+
+func (j *Journal) discovered(op Operation) {
+	j.update(op, func(r *TaskRecord) {
+		r.State = JournalDiscovered
+		r.DstIp, r.DstPath, r.Written, r.Verified, r.DstFiles = "", "", 0, "", nil
+	})
+}
+
+// existingDst returns the first dst path holding all of srcPaths, "" if the
+// dst index knows none, and the paths and sizes of srcPaths relative to the
+// src path of op; false if a src file is gone
+func existingDst(op Operation, srcPaths []string) (string, []string, []int64, bool) {
+	oriSrc := op.getSrcPath()
+	relPaths := make([]string, len(srcPaths))
+	sizes := make([]int64, len(srcPaths))
+	for i, src := range srcPaths {
+		info, err := os.Stat(src)
+		if err != nil {
+			return "", nil, nil, false
+		}
+		relPaths[i] = strings.TrimPrefix(strings.TrimPrefix(src, oriSrc), "/")
+		sizes[i] = info.Size()
+	}
+	if locations := dstIndexSingleton.candidates(relPaths, sizes); len(locations) > 0 {
+		return locations[0], relPaths, sizes, true
+	}
+	return "", relPaths, sizes, true
+}
+
+// existing records a task the exist check found complete on dst, with the
+// files of the first dst path holding all of srcPaths
+func (j *Journal) existing(op Operation, srcPaths []string, cfg *Config) {
+	if j == nil {
+		return
+	}
+	location, relPaths, sizes, ok := existingDst(op, srcPaths)
+	if !ok {
+		return
+	}
+	files := make([]JournalFile, 0, len(srcPaths))
+	if location != "" {
+		for i, rel := range relPaths {
+			files = append(files, JournalFile{Path: location + "/" + rel, Size: sizes[i]})
+		}
+	}
+	j.update(op, func(r *TaskRecord) {
+		r.State = StatusDone
+		r.DstIp, r.DstPath = "", location
+		r.Verified = "exist check " + cfg.ExistCheck.Mode
+		r.DstFiles = files
+	})
+}
+
+// placed records the dst path of op and reports whether the interrupted
+// copy of op left partial files on it to resume from, the partial files it
+// left on another path are removed
+func (j *Journal) placed(op Operation, dstIp, dstPath string) bool {
+	if j == nil {
+		return false
+	}
+	key := string(journalKey(op))
+	j.lock.Lock()
+	partial, ok := j.partial[key]
+	delete(j.partial, key)
+	j.lock.Unlock()
+	resume := ok && dstPathKey(partial.DstIp, partial.DstPath) == dstPathKey(dstIp, dstPath)
+	if ok && !resume {
+		removePartial(op, partial.DstPath)
+	}
+	j.update(op, func(r *TaskRecord) {
+		r.State = JournalPlaced
+		r.DstIp, r.DstPath, r.Written = dstIp, dstPath, 0
+		r.Attempts++
+	})
+	return resume
+}
+
+// progress records the bytes every running copy has on dst
+func (j *Journal) progress() {
+	if j == nil {
+		return
+	}
+	taskControlSingleton.CLock.Lock()
+	runs := make(map[Operation]int64, len(taskControlSingleton.Runs))
+	for op, run := range taskControlSingleton.Runs {
+		runs[op] = run.Size - run.remain()
+	}
+	taskControlSingleton.CLock.Unlock()
+	for op, written := range runs {
+		w := written
+		j.update(op, func(r *TaskRecord) {
+			if r.State == JournalPlaced || r.State == StatusOnWorking {
+				r.Written = w
+			}
+		})
+	}
+}
+
+// runProgress records the progress of running copies until the process exits
+func (j *Journal) runProgress() {
+	if j == nil {
+		return
+	}
+	for !stop {
+		time.Sleep(30 * time.Second)
+		j.progress()
+	}
+}
+
+// finished records how a copy ended, a done copy is verified by the size of its dst files
+func (j *Journal) finished(op Operation, run *CopyRun) {
+	if j == nil {
+		return
+	}
+	status := op.getStatus()
+	var files []JournalFile
+	verified := ""
+	if status == StatusDone {
+		src, dst, err := copyRootsOf(op)
+		var srcSize, dstSize int64
+		if err == nil {
+			if _, srcSize, err = regularFiles(src); err == nil {
+				files, dstSize, err = regularFiles(dst)
+			}
+		}
+		if err != nil {
+			log.Warnf("verify dst of %s %s failed: %v", op.getSectorID(), op.getFileType(), err)
+		} else if srcSize != dstSize {
+			log.Errorf("dst of %s %s has %d bytes, the source %d", op.getSectorID(), op.getFileType(), dstSize, srcSize)
+			files = nil
+		} else {
+			verified = "size"
+			if op.getFileType() == move_common.Cache {
+				verified = "size, cache validated"
+			}
+		}
+	}
+	j.update(op, func(r *TaskRecord) {
+		r.State = status
+		r.Written = run.Size - run.remain()
+		r.Verified, r.DstFiles = verified, files
+	})
+}
+
+func (j *Journal) setStatus(op Operation) {
+	status := op.getStatus()
+	j.update(op, func(r *TaskRecord) { r.State = status })
+}
+
+// copyRootsOf returns the source and dst file or dir of the copy of op
+func copyRootsOf(op Operation) (string, string, error) {
+	switch task := op.getInfo().(type) {
+	case SealedTask:
+		return task.SealedSrc, task.SealedDst, nil
+	case UnSealedTask:
+		return task.UnSealedSrc, task.UnSealedDst, nil
+	case CacheTask:
+		return task.CacheSrcDir, task.CacheDstDir, nil
+	}
+	return "", "", errors.New("unknown task type")
+}
+
+// regularFiles lists the regular files under root and their total size
+func regularFiles(root string) ([]JournalFile, int64, error) {
+	files := make([]JournalFile, 0)
+	var total int64
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() {
+			files = append(files, JournalFile{Path: path, Size: info.Size()})
+			total += info.Size()
+		}
+		return nil
+	})
+	return files, total, err
+}
+
+// reconcile compares the scanned ops with the journal and what is on disk:
+// verified copies still on dst are skipped, cancelled and skipped tasks keep
+// their status, the rest is returned to be checked and copied again. An
+// interrupted copy goes on from its partial files if it is placed on the same
+// dst path again
+func (j *Journal) reconcile(ops []Operation) ([]Operation, []Operation, error) {
+	if j == nil {
+		return ops, nil, nil
+	}
+	records, err := j.records()
+	if err != nil || len(records) == 0 {
+		return ops, nil, err
+	}
+	var verified, interrupted, failed int
+	var partial int64
+	todo := make([]Operation, 0, len(ops))
+	kept := make([]Operation, 0)
+	for _, op := range ops {
+		r, ok := records[string(journalKey(op))]
+		if !ok || r.Size != op.getTotalSize() || r.SrcMtime != op.getSrcMtime() {
+			todo = append(todo, op)
+			continue
+		}
+		switch r.State {
+		case StatusDone:
+			if r.Verified != "" && len(r.DstFiles) > 0 && filesOnDisk(r.DstFiles) {
+				verified++
+				continue
+			}
+		case StatusCancelled, StatusSkipped:
+			op.setStatus(r.State)
+			kept = append(kept, op)
+			continue
+		case JournalPlaced, StatusOnWorking, StatusOnWaiting:
+			if r.Attempts > 0 {
+				interrupted++
+			}
+			if r.DstPath != "" {
+				j.lock.Lock()
+				j.partial[string(journalKey(op))] = r
+				j.lock.Unlock()
+				partial += r.Written
+			}
+		case StatusFailed:
+			failed++
+		}
+		todo = append(todo, op)
+	}
+	log.Infof("job %s: %d tasks verified done, %d interrupted copies with %.1f GiB written and %d failed tasks start again, %d kept cancelled or skipped",
+		j.Meta.ID, verified, interrupted, float64(partial)/(1<<30), failed, len(kept))
+	return todo, kept, nil
+}
+
+// removePartial removes the files an interrupted copy of op left on the dst
+// path, op is copied to another path this time
+func removePartial(op Operation, dstPath string) {
+	src, _, err := copyRootsOf(op)
+	if err != nil {
+		return
+	}
+	dst := strings.Replace(src, strings.TrimRight(op.getSrcPath(), "/"), strings.TrimRight(dstPath, "/"), 1)
+	partial := dst + ".tmp"
+	if op.getFileType() == move_common.Cache {
+		partial = dst
+	}
+	if _, err := os.Stat(partial); err != nil {
+		return
+	}
+	if err := os.RemoveAll(partial); err != nil {
+		log.Warnf("remove %s: %v", partial, err)
+		return
+	}
+	log.Infof("removed %s left by the interrupted copy", partial)
+}
+
+// filesOnDisk reports whether every file is still there with its size
+func filesOnDisk(files []JournalFile) bool {
+	for _, f := range files {
+		info, err := os.Stat(f.Path)
+		if err != nil || info.Size() != f.Size {
+			return false
+		}
+	}
+	return true
+}
+
+func (j *Journal) String() string {
+	if j == nil {
+		return ""
+	}
+	return fmt.Sprintf("job %s, journal %s\n", j.Meta.ID, j.File)
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"errors"
+	bolt "go.etcd.io/bbolt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func openTestJournal(t *testing.T) *Journal {
+	t.Helper()
+	file := filepath.Join(t.TempDir(), "job-test.db")
+	db, err := bolt.Open(file, 0644, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return &Journal{Meta: JobMeta{ID: "job-test"}, File: file, db: db, partial: make(map[string]TaskRecord), lock: new(sync.Mutex)}
+}
+
+func TestJournalReconcile(t *testing.T) {
+	dir := t.TempDir()
+	onDisk := filepath.Join(dir, "sealed")
+	if err := ioutil.WriteFile(onDisk, make([]byte, 100), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		name    string
+		record  *TaskRecord // nil if the journal has none of the task
+		size    int64       // of the scanned task, 100 if 0
+		todo    bool
+		kept    string // status the task keeps if not todo
+		partial bool   // resumes from its partial files if placed on the same path
+	}{
+		{"not journaled", nil, 0, true, "", false},
+		{"verified and on disk", &TaskRecord{State: StatusDone, Verified: "size", DstFiles: []JournalFile{{onDisk, 100}}}, 0, false, "", false},
+		{"done but not verified", &TaskRecord{State: StatusDone, DstFiles: []JournalFile{{onDisk, 100}}}, 0, true, "", false},
+		{"verified but gone", &TaskRecord{State: StatusDone, Verified: "size", DstFiles: []JournalFile{{onDisk + ".gone", 100}}}, 0, true, "", false},
+		{"verified but changed on dst", &TaskRecord{State: StatusDone, Verified: "size", DstFiles: []JournalFile{{onDisk, 99}}}, 0, true, "", false},
+		{"source changed", &TaskRecord{State: StatusDone, Verified: "size", DstFiles: []JournalFile{{onDisk, 100}}}, 200, true, "", false},
+		{"cancelled", &TaskRecord{State: StatusCancelled}, 0, false, StatusCancelled, false},
+		{"skipped", &TaskRecord{State: StatusSkipped}, 0, false, StatusSkipped, false},
+		{"interrupted copy", &TaskRecord{State: StatusOnWorking, DstIp: testDstIp, DstPath: "/dst1", Written: 50, Attempts: 1}, 0, true, "", true},
+		{"placed before the crash", &TaskRecord{State: JournalPlaced, DstIp: testDstIp, DstPath: "/dst1", Attempts: 1}, 0, true, "", true},
+		{"discovered", &TaskRecord{State: JournalDiscovered}, 0, true, "", false},
+		{"failed", &TaskRecord{State: StatusFailed, DstIp: testDstIp, DstPath: "/dst1", Attempts: 3}, 0, true, "", false},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			j := openTestJournal(t)
+			journaled := sealedOp("s-t01000-1", "/src1", 100, 1000)
+			if c.record != nil {
+				r := *c.record
+				j.update(journaled, func(rec *TaskRecord) {
+					rec.State, rec.DstIp, rec.DstPath, rec.Written, rec.Attempts = r.State, r.DstIp, r.DstPath, r.Written, r.Attempts
+					rec.Verified, rec.DstFiles = r.Verified, r.DstFiles
+				})
+			}
+			size := c.size
+			if size == 0 {
+				size = 100
+			}
+			op := sealedOp("s-t01000-1", "/src1", size, 1000)
+			todo, kept, err := j.reconcile([]Operation{op})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if (len(todo) == 1) != c.todo {
+				t.Fatalf("todo %d, want todo %v", len(todo), c.todo)
+			}
+			if c.kept != "" && (len(kept) != 1 || op.Status != c.kept) {
+				t.Fatalf("kept %d with status %s, want %s", len(kept), op.Status, c.kept)
+			}
+			if c.kept == "" && len(kept) != 0 {
+				t.Fatalf("kept %d, want none", len(kept))
+			}
+			if len(todo) == 0 {
+				return
+			}
+			// a partial copy resumes on its path only, once
+			if resume := j.placed(op, testDstIp, "/dst1/"); resume != c.partial {
+				t.Fatalf("resume %v, want %v", resume, c.partial)
+			}
+			if j.placed(op, testDstIp, "/dst1") {
+				t.Fatal("resumed twice")
+			}
+			records, err := j.records()
+			if err != nil {
+				t.Fatal(err)
+			}
+			r := records[string(journalKey(op))]
+			if r.State != JournalPlaced || r.Written != 0 || r.DstPath != "/dst1" {
+				t.Fatalf("record after placed %+v", r)
+			}
+		})
+	}
+}
+
+func TestJobEndState(t *testing.T) {
+	savedStop, savedStopping := stop, schedulerSingleton.Stopping
+	defer func() { stop, schedulerSingleton.Stopping = savedStop, savedStopping }()
+	cases := []struct {
+		name     string
+		err      error
+		stop     bool // by a signal or stop --now
+		stopping bool // by stop --graceful
+		want     string
+	}{
+		{"finished", nil, false, false, JobDone},
+		{"stopped now", nil, true, false, JobStopped},
+		{"stopped gracefully", nil, false, true, JobStopped},
+		{"failed", errors.New("boom"), false, false, JobFailed},
+		{"failed while stopping", errors.New("boom"), true, false, JobFailed},
+	}
+	for _, c := range cases {
+		stop, schedulerSingleton.Stopping = c.stop, c.stopping
+		if got := jobEndState(c.err); got != c.want {
+			t.Errorf("%s: state %s, want %s", c.name, got, c.want)
+		}
+	}
+}
+
+func TestJournalPlacedElsewhereRemovesPartial(t *testing.T) {
+	src, dst1, dst2 := t.TempDir(), t.TempDir(), t.TempDir()
+	op := sealedOp("s-t01000-1", src, 100, 1000)
+	op.SealedSrc = filepath.Join(src, "sealed", "s-t01000-1")
+	tmp := filepath.Join(dst1, "sealed", "s-t01000-1.tmp")
+	if err := os.MkdirAll(filepath.Dir(tmp), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(tmp, make([]byte, 50), 0644); err != nil {
+		t.Fatal(err)
+	}
+	j := openTestJournal(t)
+	j.update(op, func(r *TaskRecord) {
+		r.State, r.DstIp, r.DstPath, r.Written, r.Attempts = StatusOnWorking, testDstIp, dst1, 50, 1
+	})
+	if _, _, err := j.reconcile([]Operation{op}); err != nil {
+		t.Fatal(err)
+	}
+	if j.placed(op, testDstIp, dst2) {
+		t.Fatal("resumed on another dst path")
+	}
+	if _, err := os.Stat(tmp); !os.IsNotExist(err) {
+		t.Fatalf("partial file left on the old dst path: %v", err)
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"move_sectors/mv_utils"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// leaseBusyRecheck is how long a path found fully leased by all jobs is taken
+// as full before the lease files are tried again
+const leaseBusyRecheck = 10 * time.Second
+
+// PathLeases caps the threads all jobs of the host run on one path together.
+// A thread holds an flock on one of the slot files 0..limit-1 of its path, so
+// the threads of jobs sharing a path never exceed the largest limit among them,
+// a job with a smaller limit takes fewer of the slots but may find them all
+// held by others; the leases of a crashed job go with its process.
+// The files are only touched to take and give a lease, what this job holds and
+// which paths were full are kept in memory under the resource manager lock
+type PathLeases struct {
+	Dir   string
+	JobID string
+	held  map[string]int64     // ip:location -> leases this job holds
+	busy  map[string]time.Time // ip:location -> when all its leases were found held
+	files map[*os.File]string  // lease -> ip:location
+}
+
+var pathLeasesSingleton = PathLeases{
+	Dir:   filepath.Join(os.TempDir(), "move_sectors_leases"),
+	held:  make(map[string]int64),
+	busy:  make(map[string]time.Time),
+	files: make(map[*os.File]string),
+}
+
+func leaseKey(ip, location string) string {
+	return ip + ":" + strings.TrimRight(location, "/")
+}
+
+// leaseFile is the slot file i of a path, src and dst sides share it since
+// reading and writing the same path are both limited by its disk
+func (pl *PathLeases) leaseFile(ip, location string, i int64) string {
+	sum := sha1.Sum([]byte(leaseKey(ip, location)))
+	return filepath.Join(pl.Dir, fmt.Sprintf("%s.%d", hex.EncodeToString(sum[:8]), i))
+}
+
+// take leases one thread of the path, nil without error means all limit
+// threads are leased by this or other jobs
+func (pl *PathLeases) take(ip, location string, limit int64) (*os.File, error) {
+	if err := os.MkdirAll(pl.Dir, 0777); err != nil {
+		return nil, err
+	}
+	key := leaseKey(ip, location)
+	for i := int64(0); i < limit; i++ {
+		f, ok, err := mv_utils.TryLockFile(pl.leaseFile(ip, location, i))
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			// who holds the lease, for debugging
+			_ = f.Truncate(0)
+			_, _ = f.WriteAt([]byte(fmt.Sprintf("%s %d %s:%s\n", pl.JobID, os.Getpid(), ip, location)), 0)
+			pl.held[key]++
+			pl.files[f] = key
+			delete(pl.busy, key)
+			return f, nil
+		}
+	}
+	pl.busy[key] = time.Now()
+	return nil, nil
+}
+
+// free reports whether one more thread of the path may be leased, without
+// touching the lease files: the threads this job holds must be below limit
+// and the path not found fully leased by all jobs a moment ago
+func (pl *PathLeases) free(ip, location string, limit int64) bool {
+	key := leaseKey(ip, location)
+	if pl.held[key] >= limit {
+		return false
+	}
+	if at, ok := pl.busy[key]; ok && time.Now().Sub(at) < leaseBusyRecheck {
+		return false
+	}
+	return true
+}
+
+func (pl *PathLeases) give(f *os.File) {
+	if f == nil {
+		return
+	}
+	if key, ok := pl.files[f]; ok {
+		delete(pl.files, f)
+		delete(pl.busy, key)
+		if pl.held[key]--; pl.held[key] <= 0 {
+			delete(pl.held, key)
+		}
+	}
+	_ = f.Truncate(0)
+	if err := mv_utils.UnlockFile(f); err != nil {
+		log.Warnf("release lease %s failed: %v", f.Name(), err)
+	}
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"fmt"
+	"move_sectors/mv_utils"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	GuardOk = iota
+	GuardThrottled
+	GuardPaused
+)
+
+var guardLevelNames = []string{"ok", "throttled", "paused"}
+
+// LoadGuard protects sealing and PoSt work on the machines behind the paths:
+// above the throttle thresholds a path takes half of its threads, above the
+// pause thresholds it takes no new task. Zero thresholds are not checked
+type LoadGuard struct {
+	Enabled             bool
+	IntervalSeconds     int     // default 5
+	ThrottleUtilPercent float64 // utilization of the device behind a path
+	PauseUtilPercent    float64
+	ThrottleAwaitMs     float64 // average await of the device behind a path
+	PauseAwaitMs        float64
+	ThrottleIOPressure  float64 // some avg10 of /proc/pressure/io of this host, applies to every path
+	PauseIOPressure     float64
+	IdleIOPriority      bool // copy and hash with the idle io class
+}
+
+func checkLoadGuardConfig(lg *LoadGuard) error {
+	for _, v := range []float64{lg.ThrottleUtilPercent, lg.PauseUtilPercent, lg.ThrottleAwaitMs, lg.PauseAwaitMs,
+		lg.ThrottleIOPressure, lg.PauseIOPressure, float64(lg.IntervalSeconds)} {
+		if v < 0 {
+			return fmt.Errorf("loadguard values should not be negative")
+		}
+	}
+	if lg.IntervalSeconds == 0 {
+		lg.IntervalSeconds = 5
+	}
+	return nil
+}
+
+// level returns the guard level for the given measures
+func (lg LoadGuard) level(util, await, pressure float64) int {
+	over := func(v, threshold float64) bool {
+		return threshold > 0 && v >= threshold
+	}
+	if over(util, lg.PauseUtilPercent) || over(await, lg.PauseAwaitMs) || over(pressure, lg.PauseIOPressure) {
+		return GuardPaused
+	}
+	if over(util, lg.ThrottleUtilPercent) || over(await, lg.ThrottleAwaitMs) || over(pressure, lg.ThrottleIOPressure) {
+		return GuardThrottled
+	}
+	return GuardOk
+}
+
+type guardState struct {
+	Level int
+	Dev   string
+	Util  float64
+	Await float64
+}
+
+type LoadGuardState struct {
+	Paths    map[string]*guardState // path keys of the resource manager
+	Pressure float64
+	prev     map[string]mv_utils.DiskStat
+	noDev    map[string]struct{}
+	GLock    *sync.Mutex
+}
+
+var loadGuardSingleton = LoadGuardState{
+	Paths: make(map[string]*guardState),
+	noDev: make(map[string]struct{}),
+	GLock: new(sync.Mutex),
+}
+
+// adjust applies the guard level of a path key to its thread limit
+func (g *LoadGuardState) adjust(key string, limit int64) int64 {
+	g.GLock.Lock()
+	defer g.GLock.Unlock()
+	st, ok := g.Paths[key]
+	if !ok {
+		return limit
+	}
+	switch st.Level {
+	case GuardPaused:
+		return 0
+	case GuardThrottled:
+		if limit/2 < 1 {
+			return 1
+		}
+		return limit / 2
+	}
+	return limit
+}
+
+type guardedPath struct {
+	key      string
+	location string
+}
+
+func guardedPaths() []guardedPath {
+	paths := make([]guardedPath, 0)
+	for _, side := range []string{SideSrc, SideDst} {
+		cm := &srcComputersMapSingleton
+		if side == SideDst {
+			cm = &dstComputersMapSingleton
+		}
+		cm.CLock.Lock()
+		for ip, cmp := range cm.CMap {
+			for _, p := range cmp.Paths {
+				paths = append(paths, guardedPath{pathKey(side, ip, p.Location), p.Location})
+			}
+		}
+		cm.CLock.Unlock()
+	}
+	return paths
+}
+
+// sample measures every device behind the paths and sets their levels
+func (g *LoadGuardState) sample(lg LoadGuard) {
+	now := time.Now().UnixNano()
+	stats, err := mv_utils.ReadDiskStats(now)
+	if err != nil {
+		log.Warnf("load guard: %v", err)
+	}
+	var pressure float64
+	if lg.ThrottleIOPressure > 0 || lg.PauseIOPressure > 0 {
+		if pressure, err = mv_utils.ReadIOPressure(); err != nil {
+			log.Warnf("load guard: %v", err)
+		}
+	}
+
+	// computers maps are locked before the guard by the resource manager
+	paths := guardedPaths()
+	devs := make([]string, len(paths))
+	for i, p := range paths {
+		devs[i], _ = mv_utils.DevOfPath(p.location)
+	}
+
+	g.GLock.Lock()
+	defer g.GLock.Unlock()
+	released := false
+	for i, p := range paths {
+		dev := devs[i]
+		if dev == "" {
+			if _, logged := g.noDev[p.key]; !logged {
+				log.Warnf("load guard: no local block device behind %s (nfs or another remote fs), the load of its server is not sampled, only the io pressure of this host is checked", p.location)
+				g.noDev[p.key] = struct{}{}
+			}
+		}
+		var util, await float64
+		if cur, ok := stats[dev]; ok {
+			if prev, ok := g.prev[dev]; ok {
+				util, await = mv_utils.UtilAndAwait(prev, cur)
+			}
+		}
+		level := lg.level(util, await, pressure)
+		st, ok := g.Paths[p.key]
+		if !ok {
+			st = &guardState{}
+			g.Paths[p.key] = st
+		}
+		if level != st.Level {
+			msg := fmt.Sprintf("load guard: %s %s -> %s, device %s util %.1f%% await %.1fms io pressure %.2f",
+				p.key, guardLevelNames[st.Level], guardLevelNames[level], dev, util, await, pressure)
+			if level > st.Level {
+				log.Warn(msg)
+			} else {
+				log.Info(msg)
+				released = true
+			}
+		}
+		st.Level, st.Dev, st.Util, st.Await = level, dev, util, await
+	}
+	g.prev = stats
+	g.Pressure = pressure
+	if released {
+		schedulerSingleton.notify()
+	}
+}
+
+// run samples the load until the process exits, the config may be reloaded meanwhile
+func (g *LoadGuardState) run(cfg *Config) {
+	for !stop {
+		lg := cfg.snapshot().LoadGuard
+		if !lg.Enabled {
+			g.GLock.Lock()
+			if len(g.Paths) > 0 {
+				g.Paths = make(map[string]*guardState)
+				g.prev = nil
+				log.Info("load guard disabled")
+				schedulerSingleton.notify()
+			}
+			g.GLock.Unlock()
+			time.Sleep(time.Second * 5)
+			continue
+		}
+		g.sample(lg)
+		time.Sleep(time.Duration(lg.IntervalSeconds) * time.Second)
+	}
+}
+
+func (g *LoadGuardState) String() string {
+	g.GLock.Lock()
+	defer g.GLock.Unlock()
+	if len(g.Paths) == 0 {
+		return ""
+	}
+	keys := make([]string, 0, len(g.Paths))
+	for k := range g.Paths {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var b strings.Builder
+	fmt.Fprintf(&b, "load guard: io pressure %.2f\n", g.Pressure)
+	for _, k := range keys {
+		st := g.Paths[k]
+		fmt.Fprintf(&b, "  %s: %s, device %s util %.1f%% await %.1fms\n", k, guardLevelNames[st.Level], st.Dev, st.Util, st.Await)
+	}
+	return b.String()
+}
+
+// idleIOIfNeed moves the calling goroutine to a thread of its own in the idle
+// io class; the thread ends with the goroutine as it is never unlocked
+func idleIOIfNeed(cfg *Config) {
+	if !cfg.snapshot().LoadGuard.IdleIOPriority {
+		return
+	}
+	runtime.LockOSThread()
+	if err := mv_utils.SetIdleIOPriority(); err != nil {
+		log.Warnf("set idle io priority failed: %v", err)
+	}
+}
@@ -1,19 +1,24 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"github.com/filecoin-project/lotus/lib/lotuslog"
 	fslock "github.com/ipfs/go-fs-lock"
 	logging "github.com/ipfs/go-log"
 	"github.com/urfave/cli/v2"
+	bolt "go.etcd.io/bbolt"
 	"golang.org/x/xerrors"
 	"io"
 	"move_sectors/build"
 	"move_sectors/move_common"
+	"move_sectors/mv_utils"
 	"os"
 	"os/signal"
+	"strings"
 	"sync"
 	"syscall"
+	"time"
 )
 
 var (
@@ -28,12 +33,17 @@ var (
 	}
 	stop              = false
 	skipSourceError   = false
-	fileType          move_common.FileType
+	fileTypes         []move_common.FileType // kinds of file this run moves, sealed first
 	taskListSingleton = TaskList{
 		Ops:   make([]Operation, 0),
 		TLock: new(sync.Mutex),
 	}
 	specifiedSectorsMap map[string]struct{}
+	hashThreads         chan struct{}
+	existCheckBudget    *mv_utils.IOBudget
+	hashCacheSingleton  *mv_utils.HashCache
+	// every copy runs in a child of rootCtx, cancelled when the process stops now
+	rootCtx, cancelAll = context.WithCancel(context.Background())
 )
 
 func main() {
@@ -41,6 +51,17 @@ func main() {
 
 	cmd := []*cli.Command{
 		CpCmd,
+		JobsCmd,
+		HistoryCmd,
+		InitDstCmd,
+		HoldCmd,
+		ResumeCmd,
+		StopCmd,
+		StatusCmd,
+		TaskCmd,
+		PlanCmd,
+		ApplyCmd,
+		ForecastCmd,
 	}
 	app := &cli.App{
 		Name:     "move-sectors",
@@ -52,64 +73,80 @@ func main() {
 	app.Setup()
 	if err := app.Run(os.Args); err != nil {
 		log.Warnf("%+v", err)
-		return
+		os.Exit(1)
 	}
 }
 
+// runFlags choose what to copy, shared by run and plan
+var runFlags = []cli.Flag{
+	&cli.StringFlag{
+		Name:     "path",
+		Usage:    "special the config file paths",
+		Required: false,
+		Hidden:   false,
+		Value:    "~/mv_sectors.yaml",
+	},
+	&cli.BoolFlag{
+		Name:     "UnSealed",
+		Aliases:  []string{"U", "u"},
+		Usage:    "Declare whether to copying unsealed files",
+		Required: false,
+		Hidden:   false,
+		Value:    false,
+	},
+	&cli.BoolFlag{
+		Name:     "Sealed",
+		Aliases:  []string{"S", "s"},
+		Usage:    "Declare whether to copying Sealed files",
+		Required: false,
+		Hidden:   false,
+		Value:    false,
+	},
+	&cli.BoolFlag{
+		Name:     "Cache",
+		Aliases:  []string{"C", "c"},
+		Usage:    "Declare whether to copying cache files",
+		Required: false,
+		Hidden:   false,
+		Value:    false,
+	},
+	&cli.StringFlag{
+		Name:     "SectorListFile",
+		Aliases:  []string{"SF", "sf"},
+		Usage:    "special the file path which contains sectors list you want to copy",
+		Required: false,
+		Hidden:   false,
+	},
+	&cli.BoolFlag{
+		Name:     "SkipSourceError",
+		Usage:    "Declare whether to keep running process and skip files with something wrong",
+		Required: false,
+		Hidden:   false,
+		Value:    false,
+	},
+}
+
 var CpCmd = &cli.Command{
 	Name:  "run",
 	Usage: "startWork to copying files",
-	Flags: []cli.Flag{
+	Flags: append(runFlags,
 		&cli.StringFlag{
-			Name:     "path",
-			Usage:    "special the config file paths",
-			Required: false,
-			Hidden:   false,
-			Value:    "~/mv_sectors.yaml",
-		},
-		&cli.BoolFlag{
-			Name:     "UnSealed",
-			Aliases:  []string{"U", "u"},
-			Usage:    "Declare whether to copying unsealed files",
-			Required: false,
-			Hidden:   false,
-			Value:    false,
-		},
-		&cli.BoolFlag{
-			Name:     "Sealed",
-			Aliases:  []string{"S", "s"},
-			Usage:    "Declare whether to copying Sealed files",
-			Required: false,
-			Hidden:   false,
-			Value:    false,
-		},
-		&cli.BoolFlag{
-			Name:     "Cache",
-			Aliases:  []string{"C", "c"},
-			Usage:    "Declare whether to copying cache files",
-			Required: false,
-			Hidden:   false,
-			Value:    false,
+			Name:  "job",
+			Usage: "name the job, jobs of other names may run at the same time, default to job-<start time>",
 		},
 		&cli.StringFlag{
-			Name:     "SectorListFile",
-			Aliases:  []string{"SF", "sf"},
-			Usage:    "special the file path which contains sectors list you want to copy",
-			Required: false,
-			Hidden:   false,
+			Name:  "resume",
+			Usage: "resume a stopped or crashed job by its id, kinds and sector list default to the job's",
 		},
-		&cli.BoolFlag{
-			Name:     "SkipSourceError",
-			Usage:    "Declare whether to keep running process and skip files with something wrong",
-			Required: false,
-			Hidden:   false,
-			Value:    false,
-		},
-	},
+	),
 
-	Action: func(cctx *cli.Context) error {
+	Action: func(cctx *cli.Context) (err error) {
 		log.Infof("run move_sector process,version:%s", build.GetVersion())
-		lock, err := createFileLock(os.TempDir(), "move_sectors.lock")
+		id, resume, err := jobIDOf(cctx)
+		if err != nil {
+			return err
+		}
+		lock, err := lockJob(id)
 		if err != nil {
 			log.Error(err)
 			return err
@@ -121,69 +158,199 @@ var CpCmd = &cli.Command{
 			return errors.New("create file lock failed")
 		}
 
-		// which kind file will be moved
-		if !cctx.Bool("UnSealed") && !cctx.Bool("Sealed") && !cctx.Bool("Cache") {
-			return errors.New("you must tell which kind of file to move,options: --UnSealed,--Sealed,--Cache")
+		// a resumed job copies the kinds it was started with unless told again
+		if cctx.String("resume") == "" || anyFileTypeSet(cctx) {
+			if err := setFileTypes(cctx); err != nil {
+				return err
+			}
 		}
-		if (cctx.Bool("UnSealed") && cctx.Bool("Sealed")) ||
-			(cctx.Bool("UnSealed") && cctx.Bool("Cache")) ||
-			(cctx.Bool("Sealed") && cctx.Bool("Cache")) {
-			return errors.New("only one kind of file once")
+		config, closeRun, err := prepareRun(cctx)
+		if err != nil {
+			return err
 		}
-		if cctx.Bool("UnSealed") {
-			fileType = move_common.UnSealed
+		defer closeRun()
+		// checked again when the job registers
+		if err = checkDstPaths(config, id); err != nil {
+			return err
 		}
-		if cctx.Bool("Sealed") {
-			fileType = move_common.Sealed
+		journalSingleton, err = openJob(cctx, config, id, resume)
+		if err != nil {
+			return err
 		}
-		if cctx.Bool("Cache") {
-			fileType = move_common.Cache
+		defer func() { journalSingleton.close(jobEndState(err)) }()
+		stopServing, err := serveRun(config, id)
+		if err != nil {
+			return err
 		}
-		log.Infof("will copy %s files", fileType)
-		if cctx.Bool("SkipSourceError") {
-			skipSourceError = true
+		defer stopServing()
+
+		log.Info("startWork to copy")
+		if err = startWork(config); err != nil {
+			return err
 		}
+		log.Info("mv_sectors exited")
+		return nil
+	},
+}
 
-		// if SectorListFile set,read the file and add sectors into a map
-		if slf := cctx.String("SectorListFile"); slf != "" {
-			specifiedSectorsMap = make(map[string]struct{})
-			err := makeSpecifiedSectorsMap(slf)
-			if err != nil {
-				return err
-			}
-			if ls := len(specifiedSectorsMap); ls > 0 {
-				log.Infof("manually specify sectors to copy, nums: %d", ls)
-			}
+func anyFileTypeSet(cctx *cli.Context) bool {
+	return cctx.Bool("UnSealed") || cctx.Bool("Sealed") || cctx.Bool("Cache")
+}
+
+// setFileTypes reads which kinds of file will be moved from the flags
+func setFileTypes(cctx *cli.Context) error {
+	if !anyFileTypeSet(cctx) {
+		return errors.New("you must tell which kind of file to move,options: --UnSealed,--Sealed,--Cache")
+	}
+	fileTypes = make([]move_common.FileType, 0, 3)
+	for _, ft := range move_common.FileTypes {
+		if cctx.Bool(string(ft)) {
+			fileTypes = append(fileTypes, ft)
 		}
+	}
+	log.Infof("will copy %s files", fileTypesString(fileTypes))
+	return nil
+}
 
-		// load config
-		config, err := getConfig(cctx)
+func fileTypesString(fts []move_common.FileType) string {
+	names := make([]string, len(fts))
+	for i, ft := range fts {
+		names[i] = string(ft)
+	}
+	return strings.Join(names, ",")
+}
+
+// prepareRun loads the config and everything tasks are found and placed
+// with, the returned func closes what was opened
+func prepareRun(cctx *cli.Context) (*Config, func(), error) {
+	if cctx.Bool("SkipSourceError") {
+		skipSourceError = true
+	}
+
+	// if SectorListFile set,read the file and add sectors into a map
+	if slf := cctx.String("SectorListFile"); slf != "" {
+		err := makeSpecifiedSectorsMap(slf)
 		if err != nil {
-			log.Error(err)
-			return nil
+			return nil, nil, err
 		}
-		err = initializeComputerMapSingleton(config)
-		if err != nil {
-			log.Error(err)
-			return nil
-		}
-		log.Debugf("srcComputersInfo: %v", srcComputersMapSingleton)
-		log.Debugf("dstComputersInfo: %v", dstComputersMapSingleton)
-		stopSignal := make(chan os.Signal, 2)
-		signal.Notify(stopSignal, syscall.SIGTERM, syscall.SIGINT)
-		go func() {
-			select {
-			case si := <-stopSignal:
-				stop = true
-				log.Warn("stopped by signal %+v", si)
+		if ls := len(specifiedSectorsMap); ls > 0 {
+			log.Infof("manually specify sectors to copy, nums: %d", ls)
+		}
+	}
+
+	// load config
+	config, err := getConfig(cctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	historySingleton.File = config.HistoryFile
+	if err = capacityUsageSingleton.seed(config); err != nil {
+		log.Warnf("capacity usage not seeded from history %s: %v", config.HistoryFile, err)
+	}
+	err = initializeComputerMapSingleton(config)
+	if err != nil {
+		return nil, nil, err
+	}
+	placementPolicySingleton, err = newPlacementPolicy(config.PlacementPolicy)
+	if err != nil {
+		return nil, nil, err
+	}
+	log.Infof("placement policy: %s", placementPolicySingleton.Name())
+	placementMapSingleton.File = config.PlacementMapFile
+	if err = placementMapSingleton.load(); err != nil {
+		return nil, nil, err
+	}
+	log.Infof("placement map %s loaded, %d sectors", config.PlacementMapFile, len(placementMapSingleton.Entries))
+	throughputSingleton.File = config.ThroughputFile
+	if err = throughputSingleton.load(); err != nil {
+		return nil, nil, err
+	}
+	hashThreads = make(chan struct{}, config.ExistCheck.Parallel)
+	existCheckBudget = mv_utils.NewIOBudget(config.ExistCheck.IOBudgetMBPS)
+	log.Infof("exist check mode: %s", config.ExistCheck.Mode)
+	if !config.DisableHashCache && config.ExistCheck.Mode != mv_utils.CheckModeSize {
+		hashCacheSingleton, err = openHashCache(config.HashCacheFile)
+		if errors.Is(err, bolt.ErrTimeout) {
+			// jobs sharing a config dir, one of them hashes without the cache
+			log.Warnf("hash cache %s is used by another job, hash without cache", config.HashCacheFile)
+		} else if err != nil {
+			return nil, nil, err
+		}
+	}
+	log.Debugf("srcComputersInfo: %v", srcComputersMapSingleton)
+	log.Debugf("dstComputersInfo: %v", dstComputersMapSingleton)
+	return config, func() {
+		if hashCacheSingleton != nil {
+			hashCacheSingleton.Close()
+		}
+	}, nil
+}
+
+// serveRun handles signals and control commands of job id and starts the
+// background tuning of a copying process, the returned func stops serving
+func serveRun(config *Config, id string) (func(), error) {
+	stopSignal := make(chan os.Signal, 2)
+	signal.Notify(stopSignal, syscall.SIGTERM, syscall.SIGINT)
+	go func() {
+		select {
+		case si := <-stopSignal:
+			log.Warnf("stopped by signal %+v", si)
+			stopNow()
+		}
+	}()
+	pathLeasesSingleton.JobID = id
+	ctrl, err := startControlServer(controlSocketPath(id))
+	if err != nil {
+		return nil, err
+	}
+	unregister, err := registerJob(config, id)
+	if err != nil {
+		ctrl.Close()
+		return nil, err
+	}
+	reloadSignal := make(chan os.Signal, 1)
+	signal.Notify(reloadSignal, syscall.SIGHUP)
+	go func() {
+		for range reloadSignal {
+			log.Info("reloading config by SIGHUP")
+			if err := reloadConfig(config); err != nil {
+				log.Errorf("reload config failed, keep running with the old one: %v", err)
+				continue
 			}
-		}()
+			schedulerSingleton.notify()
+		}
+	}()
 
-		log.Info("startWork to copy")
-		startWork(config)
-		log.Info("mv_sectors exited")
-		return nil
-	},
+	go adaptiveSingleton.run(config)
+	go loadGuardSingleton.run(config)
+	go scheduleSingleton.run(config)
+	go journalSingleton.runProgress()
+	return func() {
+		unregister()
+		ctrl.Close()
+	}, nil
+}
+
+// stopNow cancels every running copy and makes the process exit
+func stopNow() {
+	stop = true
+	cancelAll()
+	schedulerSingleton.notify()
+}
+
+func openHashCache(dbPath string) (*mv_utils.HashCache, error) {
+	hc, err := mv_utils.OpenHashCache(dbPath)
+	if err != nil {
+		return nil, err
+	}
+	since := time.Now()
+	removed, err := hc.Prune()
+	if err != nil {
+		hc.Close()
+		return nil, err
+	}
+	log.Infof("hash cache %s loaded, removed %d stale entries, cost %v", dbPath, removed, time.Now().Sub(since))
+	return hc, nil
 }
 
 //Check scheduler process if existed
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"move_sectors/move_common"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+const (
+	PolicyMostFree    = "most-free"
+	PolicyFillFirst   = "fill-first"
+	PolicyRoundRobin  = "round-robin"
+	PolicyWeighted    = "weighted"
+	PolicyLeastLoaded = "least-loaded"
+)
+
+// DstCandidate is a dst path which has free threads and enough space for a task
+type DstCandidate struct {
+	Ip          string
+	Location    string
+	Avail       uint64
+	PathThreads int64
+	HostThreads int
+	HostLimit   int
+	Weight      int
+	Order       int // position of the path in the config file
+}
+
+// PlacementPolicy chooses one dst path among the candidates of a task
+type PlacementPolicy interface {
+	Name() string
+	choose(candidates []DstCandidate) DstCandidate
+}
+
+var placementPolicySingleton PlacementPolicy = &mostFreePolicy{}
+
+// dstOrderSingleton records the position of each dst path in the config
+// file, read and written with dstComputersMapSingleton.CLock held
+var dstOrderSingleton = make(map[string]int)
+
+func newPlacementPolicy(name string) (PlacementPolicy, error) {
+	switch name {
+	case "", PolicyMostFree:
+		return &mostFreePolicy{}, nil
+	case PolicyFillFirst:
+		return &fillFirstPolicy{}, nil
+	case PolicyRoundRobin:
+		return &roundRobinPolicy{last: -1, lock: new(sync.Mutex)}, nil
+	case PolicyWeighted:
+		return &weightedPolicy{current: make(map[string]int), lock: new(sync.Mutex)}, nil
+	case PolicyLeastLoaded:
+		return &leastLoadedPolicy{}, nil
+	default:
+		return nil, fmt.Errorf("unknown placement policy %s,options: %s", name,
+			strings.Join([]string{PolicyMostFree, PolicyFillFirst, PolicyRoundRobin, PolicyWeighted, PolicyLeastLoaded}, ","))
+	}
+}
+
+func dstPathKey(ip, location string) string {
+	return ip + ":" + strings.TrimRight(location, "/")
+}
+
+func getDiskAvail(location string) uint64 {
+	avail, _ := getDiskSpace(location)
+	return avail
+}
+
+// getDiskSpace returns the available and the total bytes of the filesystem
+func getDiskSpace(location string) (uint64, uint64) {
+	var stat = new(syscall.Statfs_t)
+	if err := syscall.Statfs(location, stat); err != nil {
+		log.Warnf("statfs %s failed: %v", location, err)
+		return 0, 0
+	}
+	return stat.Bavail * uint64(stat.Bsize), stat.Blocks * uint64(stat.Bsize)
+}
+
+// getDstCandidates lists every dst path able to take size bytes of sectorID now, in config order
+func getDstCandidates(sectorID string, size int64) []DstCandidate {
+	dstComputersMapSingleton.CLock.Lock()
+	defer dstComputersMapSingleton.CLock.Unlock()
+	candidates := make([]DstCandidate, 0)
+	for _, cmp := range dstComputersMapSingleton.CMap {
+		hostThreads := resourceManagerSingleton.hostThreads(SideDst, cmp.Ip)
+		if hostThreads >= int64(cmp.LimitThread) {
+			continue
+		}
+		for _, p := range cmp.Paths {
+			if !resourceManagerSingleton.hasFree(SideDst, cmp, p) {
+				continue
+			}
+			if !capacityAllows(cmp, p, sectorID, size) {
+				continue
+			}
+			avail := getDstAvail(cmp.Ip, p.Location)
+			candidates = append(candidates, DstCandidate{
+				Ip:          cmp.Ip,
+				Location:    p.Location,
+				Avail:       avail,
+				PathThreads: resourceManagerSingleton.pathThreads(SideDst, cmp.Ip, p.Location),
+				HostThreads: int(hostThreads),
+				HostLimit:   cmp.LimitThread,
+				Weight:      pathWeight(cmp.Ip, p),
+				Order:       dstOrderSingleton[dstPathKey(cmp.Ip, p.Location)],
+			})
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].Order < candidates[j].Order
+	})
+	return candidates
+}
+
+// getBestDstByPolicy is used by every kind of task after no group dir was found
+func getBestDstByPolicy(sectorID string, size int64) (string, string, error) {
+	candidates := getDstCandidates(sectorID, size)
+	if len(candidates) == 0 {
+		return "", "", errors.New(move_common.NoDstSuitableForNow)
+	}
+	policy := currentPlacementPolicy()
+	c := policy.choose(candidates)
+	log.Debugf("policy %s selected dst %s %s for %s", policy.Name(), c.Ip, c.Location, sectorID)
+	return c.Location, c.Ip, nil
+}
+
+// mostFreePolicy prefers the path with most free space per running thread
+type mostFreePolicy struct{}
+
+func (p *mostFreePolicy) Name() string { return PolicyMostFree }
+
+func (p *mostFreePolicy) choose(candidates []DstCandidate) DstCandidate {
+	best := candidates[0]
+	for _, c := range candidates[1:] {
+		if c.Avail/uint64(c.PathThreads+1) > best.Avail/uint64(best.PathThreads+1) {
+			best = c
+		}
+	}
+	return best
+}
+
+// fillFirstPolicy packs the paths one by one in config order
+type fillFirstPolicy struct{}
+
+func (p *fillFirstPolicy) Name() string { return PolicyFillFirst }
+
+func (p *fillFirstPolicy) choose(candidates []DstCandidate) DstCandidate {
+	return candidates[0]
+}
+
+// roundRobinPolicy takes the paths in turn
+type roundRobinPolicy struct {
+	last int
+	lock *sync.Mutex
+}
+
+func (p *roundRobinPolicy) Name() string { return PolicyRoundRobin }
+
+func (p *roundRobinPolicy) choose(candidates []DstCandidate) DstCandidate {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	for _, c := range candidates {
+		if c.Order > p.last {
+			p.last = c.Order
+			return c
+		}
+	}
+	p.last = candidates[0].Order
+	return candidates[0]
+}
+
+// weightedPolicy is a smooth weighted round robin over the Weight of the paths
+type weightedPolicy struct {
+	current map[string]int
+	lock    *sync.Mutex
+}
+
+func (p *weightedPolicy) Name() string { return PolicyWeighted }
+
+func (p *weightedPolicy) choose(candidates []DstCandidate) DstCandidate {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	total := 0
+	best := -1
+	for i, c := range candidates {
+		key := dstPathKey(c.Ip, c.Location)
+		p.current[key] += c.Weight
+		total += c.Weight
+		if best < 0 || p.current[key] > p.current[dstPathKey(candidates[best].Ip, candidates[best].Location)] {
+			best = i
+		}
+	}
+	p.current[dstPathKey(candidates[best].Ip, candidates[best].Location)] -= total
+	return candidates[best]
+}
+
+// leastLoadedPolicy prefers the host with the lowest thread usage, then the most free path on it
+type leastLoadedPolicy struct{}
+
+func (p *leastLoadedPolicy) Name() string { return PolicyLeastLoaded }
+
+func (p *leastLoadedPolicy) choose(candidates []DstCandidate) DstCandidate {
+	load := func(c DstCandidate) float64 {
+		return float64(c.HostThreads) / float64(c.HostLimit)
+	}
+	best := candidates[0]
+	for _, c := range candidates[1:] {
+		if load(c) < load(best) || (load(c) == load(best) && c.Avail > best.Avail) {
+			best = c
+		}
+	}
+	return best
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	bolt "go.etcd.io/bbolt"
+	"move_sectors/move_common"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+var placementBucket = []byte("placement")
+
+// PlacementEntry is where the parts of one sector go
+type PlacementEntry struct {
+	DstIp   string
+	DstPath string
+	Kinds   []move_common.FileType
+	Updated int64
+}
+
+// PlacementMap persists the sector -> dst path assignment so every part of a
+// sector follows the first one, across runs and file types. The db is only
+// opened per transaction so separate processes could share it
+type PlacementMap struct {
+	File    string
+	Entries map[string]PlacementEntry
+	mtime   time.Time
+	PLock   *sync.Mutex
+}
+
+var placementMapSingleton = PlacementMap{
+	Entries: make(map[string]PlacementEntry),
+	PLock:   new(sync.Mutex),
+}
+
+func (pm *PlacementMap) open(readOnly bool) (*bolt.DB, error) {
+	return bolt.Open(pm.File, 0644, &bolt.Options{Timeout: 10 * time.Second, ReadOnly: readOnly})
+}
+
+// load reads the whole map when the db file changed since last load
+func (pm *PlacementMap) load() error {
+	if pm.File == "" {
+		return nil
+	}
+	info, err := os.Stat(pm.File)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	pm.PLock.Lock()
+	defer pm.PLock.Unlock()
+	if info.ModTime().Equal(pm.mtime) {
+		return nil
+	}
+	db, err := pm.open(true)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	entries := make(map[string]PlacementEntry)
+	err = db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(placementBucket)
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			var entry PlacementEntry
+			if err := json.Unmarshal(v, &entry); err != nil {
+				return err
+			}
+			entries[string(k)] = entry
+			return nil
+		})
+	})
+	if err != nil {
+		return err
+	}
+	pm.Entries = entries
+	pm.mtime = info.ModTime()
+	return nil
+}
+
+func (pm *PlacementMap) lookup(sectorID string) (PlacementEntry, bool) {
+	if err := pm.load(); err != nil {
+		log.Warnf("load placement map %s failed: %v", pm.File, err)
+	}
+	pm.PLock.Lock()
+	defer pm.PLock.Unlock()
+	entry, ok := pm.Entries[sectorID]
+	return entry, ok
+}
+
+// assign records that a part of kind of sectorID is scheduled to the dst
+// path, it refuses to move a sector whose other parts went to another path
+func (pm *PlacementMap) assign(sectorID string, kind move_common.FileType, dstIp, dstPath string) error {
+	dstPath = strings.TrimRight(dstPath, "/")
+	return pm.update(sectorID, func(entry *PlacementEntry) (bool, error) {
+		if entry.DstIp != dstIp || entry.DstPath != dstPath {
+			if others := entry.otherKinds(kind); len(others) > 0 {
+				return false, fmt.Errorf("%s of sector %s are assigned to %s %s already", fileTypesString(others), sectorID, entry.DstIp, entry.DstPath)
+			}
+			*entry = PlacementEntry{DstIp: dstIp, DstPath: dstPath}
+		}
+		if !entry.has(kind) {
+			entry.Kinds = append(entry.Kinds, kind)
+		}
+		return true, nil
+	})
+}
+
+// unassign drops kind of sectorID from the dst path when its copy did not
+// finish there, the entry goes once no part of the sector is left on the path
+func (pm *PlacementMap) unassign(sectorID string, kind move_common.FileType, dstIp, dstPath string) error {
+	dstPath = strings.TrimRight(dstPath, "/")
+	return pm.update(sectorID, func(entry *PlacementEntry) (bool, error) {
+		if entry.DstIp != dstIp || entry.DstPath != dstPath {
+			// an entry of another path stays, no entry stays none
+			return len(entry.Kinds) > 0, nil
+		}
+		entry.Kinds = entry.otherKinds(kind)
+		return len(entry.Kinds) > 0, nil
+	})
+}
+
+// update rewrites the entry of sectorID by fn in one transaction, the entry
+// is deleted if fn does not keep it
+func (pm *PlacementMap) update(sectorID string, fn func(entry *PlacementEntry) (bool, error)) error {
+	if pm.File == "" {
+		return nil
+	}
+	pm.PLock.Lock()
+	defer pm.PLock.Unlock()
+	db, err := pm.open(false)
+	if err != nil {
+		return err
+	}
+	var entry PlacementEntry
+	keep := false
+	err = db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(placementBucket)
+		if err != nil {
+			return err
+		}
+		raw := b.Get([]byte(sectorID))
+		if raw != nil {
+			if err := json.Unmarshal(raw, &entry); err != nil {
+				return err
+			}
+		}
+		if keep, err = fn(&entry); err != nil {
+			return err
+		}
+		if !keep {
+			if raw == nil {
+				return nil
+			}
+			return b.Delete([]byte(sectorID))
+		}
+		entry.Updated = time.Now().Unix()
+		raw, err = json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(sectorID), raw)
+	})
+	if closeErr := db.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if keep {
+		pm.Entries[sectorID] = entry
+	} else {
+		delete(pm.Entries, sectorID)
+	}
+	// skip reloading what we just wrote
+	if info, err := os.Stat(pm.File); err == nil {
+		pm.mtime = info.ModTime()
+	}
+	return nil
+}
+
+func (e PlacementEntry) has(kind move_common.FileType) bool {
+	for _, k := range e.Kinds {
+		if k == kind {
+			return true
+		}
+	}
+	return false
+}
+
+// otherKinds returns the parts of the entry but kind
+func (e PlacementEntry) otherKinds(kind move_common.FileType) []move_common.FileType {
+	others := make([]move_common.FileType, 0, len(e.Kinds))
+	for _, k := range e.Kinds {
+		if k != kind {
+			others = append(others, k)
+		}
+	}
+	return others
+}
+
+// findAssignedDir returns the dst path assigned to sectorID if it is still
+// configured; the caller must hold dstComputersMapSingleton.CLock. A part of
+// kind may only go elsewhere when no other part of the sector is on the path
+func findAssignedDir(sectorID string, kind move_common.FileType, size int64) (string, string, bool, error) {
+	entry, ok := placementMapSingleton.lookup(sectorID)
+	if !ok {
+		return "", "", false, nil
+	}
+	cmp, ok := dstComputersMapSingleton.CMap[entry.DstIp]
+	if !ok {
+		return "", "", false, nil
+	}
+	for _, p := range cmp.Paths {
+		if strings.TrimRight(p.Location, "/") != entry.DstPath {
+			continue
+		}
+		if !resourceManagerSingleton.hasFree(SideDst, cmp, p) {
+			log.Debugf("%s is assigned to %s, but too much threads for now, will copy later", sectorID, p.Location)
+			return "", "", true, errors.New(move_common.FondGroupButTooMuchThread)
+		}
+		if !capacityAllows(cmp, p, sectorID, size) {
+			if others := entry.otherKinds(kind); len(others) > 0 {
+				log.Debugf("%s is assigned to %s with its %s, but disk has not enough space for now", sectorID, p.Location, fileTypesString(others))
+				return "", "", true, errors.New(move_common.GroupDirFull)
+			}
+			log.Debugf("%s is assigned to %s, but disk has not enough space, will chose new dst", sectorID, p.Location)
+			return "", "", true, errors.New(move_common.NotEnoughSpace)
+		}
+		return p.Location, cmp.Ip, true, nil
+	}
+	return "", "", false, nil
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"move_sectors/move_common"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+func newTestPlacementMap(t *testing.T) *PlacementMap {
+	t.Helper()
+	return &PlacementMap{
+		File:    filepath.Join(t.TempDir(), "placement.db"),
+		Entries: make(map[string]PlacementEntry),
+		PLock:   new(sync.Mutex),
+	}
+}
+
+func TestPlacementMapAssign(t *testing.T) {
+	type step struct {
+		unassign bool
+		kind     move_common.FileType
+		ip, path string
+		err      bool
+	}
+	const sector = "s-t01000-1"
+	cases := []struct {
+		name  string
+		steps []step
+		want  *PlacementEntry // nil if the sector has no entry at the end
+	}{
+		{"parts of a sector gather on one path", []step{
+			{false, move_common.Sealed, "10.0.0.1", "/a/", false},
+			{false, move_common.Cache, "10.0.0.1", "/a", false},
+			{false, move_common.Cache, "10.0.0.1", "/a", false},
+		}, &PlacementEntry{DstIp: "10.0.0.1", DstPath: "/a", Kinds: []move_common.FileType{move_common.Sealed, move_common.Cache}}},
+		{"a part never splits from the others", []step{
+			{false, move_common.Sealed, "10.0.0.1", "/a", false},
+			{false, move_common.Cache, "10.0.0.1", "/b", true},
+			{false, move_common.Cache, "10.0.0.2", "/a", true},
+		}, &PlacementEntry{DstIp: "10.0.0.1", DstPath: "/a", Kinds: []move_common.FileType{move_common.Sealed}}},
+		{"the only part may move", []step{
+			{false, move_common.Sealed, "10.0.0.1", "/a", false},
+			{false, move_common.Sealed, "10.0.0.1", "/b", false},
+		}, &PlacementEntry{DstIp: "10.0.0.1", DstPath: "/b", Kinds: []move_common.FileType{move_common.Sealed}}},
+		{"unassign keeps the other parts", []step{
+			{false, move_common.Sealed, "10.0.0.1", "/a", false},
+			{false, move_common.Cache, "10.0.0.1", "/a", false},
+			{true, move_common.Cache, "10.0.0.1", "/a", false},
+		}, &PlacementEntry{DstIp: "10.0.0.1", DstPath: "/a", Kinds: []move_common.FileType{move_common.Sealed}}},
+		{"unassign of the last part drops the entry", []step{
+			{false, move_common.Sealed, "10.0.0.1", "/a", false},
+			{true, move_common.Sealed, "10.0.0.1", "/a/", false},
+		}, nil},
+		{"unassign of another path is ignored", []step{
+			{false, move_common.Sealed, "10.0.0.1", "/a", false},
+			{true, move_common.Sealed, "10.0.0.1", "/b", false},
+		}, &PlacementEntry{DstIp: "10.0.0.1", DstPath: "/a", Kinds: []move_common.FileType{move_common.Sealed}}},
+		{"unassign without entry", []step{
+			{true, move_common.Sealed, "10.0.0.1", "/a", false},
+		}, nil},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			pm := newTestPlacementMap(t)
+			for i, s := range c.steps {
+				var err error
+				if s.unassign {
+					err = pm.unassign(sector, s.kind, s.ip, s.path)
+				} else {
+					err = pm.assign(sector, s.kind, s.ip, s.path)
+				}
+				if (err != nil) != s.err {
+					t.Fatalf("step %d: error %v, want error %v", i, err, s.err)
+				}
+			}
+			// what a new process loads from the db is what this one keeps
+			loaded := newTestPlacementMap(t)
+			loaded.File = pm.File
+			if err := loaded.load(); err != nil {
+				t.Fatal(err)
+			}
+			for _, m := range []*PlacementMap{pm, loaded} {
+				entry, ok := m.Entries[sector]
+				if c.want == nil {
+					if ok {
+						t.Fatalf("entry %+v left", entry)
+					}
+					continue
+				}
+				entry.Updated = 0
+				if !ok || !reflect.DeepEqual(entry, *c.want) {
+					t.Fatalf("entry %+v, want %+v", entry, *c.want)
+				}
+			}
+		})
+	}
+}
+
+func TestFindAssignedDir(t *testing.T) {
+	location := t.TempDir()
+	const ip = "10.0.0.1"
+	avail, _ := getDiskSpace(location)
+	cmp := Computer{Ip: ip, LimitThread: 2, Paths: []Path{{Location: location + "/", SinglePathThreadLimit: 1}}}
+	savedMap, savedCMap := placementMapSingleton, dstComputersMapSingleton.CMap
+	defer func() {
+		placementMapSingleton, dstComputersMapSingleton.CMap = savedMap, savedCMap
+	}()
+	dstComputersMapSingleton.CMap = map[string]Computer{ip: cmp}
+
+	cases := []struct {
+		name  string
+		entry *PlacementEntry
+		kind  move_common.FileType
+		size  int64
+		busy  bool // the path runs as many threads as it may
+		found bool
+		err   string
+	}{
+		{"no entry", nil, move_common.Sealed, 1, false, false, ""},
+		{"assigned path", &PlacementEntry{DstIp: ip, DstPath: location, Kinds: []move_common.FileType{move_common.Sealed}}, move_common.Cache, 1, false, true, ""},
+		{"path no longer configured", &PlacementEntry{DstIp: ip, DstPath: location + "/gone", Kinds: []move_common.FileType{move_common.Sealed}}, move_common.Cache, 1, false, false, ""},
+		{"computer no longer configured", &PlacementEntry{DstIp: "10.0.0.9", DstPath: location, Kinds: []move_common.FileType{move_common.Sealed}}, move_common.Cache, 1, false, false, ""},
+		{"too much threads", &PlacementEntry{DstIp: ip, DstPath: location, Kinds: []move_common.FileType{move_common.Sealed}}, move_common.Cache, 1, true, true, move_common.FondGroupButTooMuchThread},
+		{"full with other parts waits", &PlacementEntry{DstIp: ip, DstPath: location, Kinds: []move_common.FileType{move_common.Sealed}}, move_common.Cache, int64(avail), false, true, move_common.GroupDirFull},
+		{"full with only this part may move", &PlacementEntry{DstIp: ip, DstPath: location, Kinds: []move_common.FileType{move_common.Cache}}, move_common.Cache, int64(avail), false, true, move_common.NotEnoughSpace},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			resetCapacity(t)
+			placementMapSingleton = *newTestPlacementMap(t)
+			if c.entry != nil {
+				for _, kind := range c.entry.Kinds {
+					if err := placementMapSingleton.assign("s-t01000-1", kind, c.entry.DstIp, c.entry.DstPath); err != nil {
+						t.Fatal(err)
+					}
+				}
+			}
+			key := pathKey(SideDst, ip, location)
+			if c.busy {
+				resourceManagerSingleton.Paths[key] = 1
+				defer delete(resourceManagerSingleton.Paths, key)
+			}
+			dstPath, dstIp, found, err := findAssignedDir("s-t01000-1", c.kind, c.size)
+			if found != c.found {
+				t.Fatalf("found %v, want %v", found, c.found)
+			}
+			if c.err != "" {
+				if err == nil || err.Error() != c.err {
+					t.Fatalf("want error %s, got %v", c.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if found && (dstIp != ip || dstPath != location+"/") {
+				t.Fatalf("found %s %s", dstIp, dstPath)
+			}
+		})
+	}
+}
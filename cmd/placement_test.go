@@ -0,0 +1,92 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestNewPlacementPolicy(t *testing.T) {
+	cases := []struct {
+		name string
+		want string
+		err  bool
+	}{
+		{"", PolicyMostFree, false},
+		{PolicyMostFree, PolicyMostFree, false},
+		{PolicyFillFirst, PolicyFillFirst, false},
+		{PolicyRoundRobin, PolicyRoundRobin, false},
+		{PolicyWeighted, PolicyWeighted, false},
+		{PolicyLeastLoaded, PolicyLeastLoaded, false},
+		{"random", "", true},
+	}
+	for _, c := range cases {
+		policy, err := newPlacementPolicy(c.name)
+		if c.err {
+			if err == nil {
+				t.Errorf("%q: want error", c.name)
+			}
+			continue
+		}
+		if err != nil || policy.Name() != c.want {
+			t.Errorf("%q: got %v %v, want %s", c.name, policy, err, c.want)
+		}
+	}
+}
+
+func TestPlacementPolicyChoose(t *testing.T) {
+	candidates := []DstCandidate{
+		{Ip: "10.0.0.1", Location: "/a", Avail: 100, PathThreads: 0, HostThreads: 1, HostLimit: 4, Weight: 1, Order: 0},
+		{Ip: "10.0.0.1", Location: "/b", Avail: 300, PathThreads: 2, HostThreads: 1, HostLimit: 4, Weight: 2, Order: 1},
+		{Ip: "10.0.0.2", Location: "/c", Avail: 200, PathThreads: 0, HostThreads: 0, HostLimit: 4, Weight: 1, Order: 2},
+	}
+	cases := []struct {
+		policy string
+		// locations chosen by successive calls with the same candidates
+		want []string
+	}{
+		// free space per running thread: /a 100, /b 100, /c 200
+		{PolicyMostFree, []string{"/c", "/c"}},
+		{PolicyFillFirst, []string{"/a", "/a"}},
+		{PolicyRoundRobin, []string{"/a", "/b", "/c", "/a"}},
+		// smooth weighted round robin, /b gets two of every four
+		{PolicyWeighted, []string{"/b", "/a", "/c", "/b"}},
+		// /c is on the idle host
+		{PolicyLeastLoaded, []string{"/c", "/c"}},
+	}
+	for _, c := range cases {
+		t.Run(c.policy, func(t *testing.T) {
+			policy, err := newPlacementPolicy(c.policy)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i, want := range c.want {
+				if got := policy.choose(candidates).Location; got != want {
+					t.Fatalf("call %d chose %s, want %s", i, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestRoundRobinSkipsMissingCandidates(t *testing.T) {
+	policy, _ := newPlacementPolicy(PolicyRoundRobin)
+	all := []DstCandidate{{Location: "/a", Order: 0}, {Location: "/b", Order: 1}, {Location: "/c", Order: 2}}
+	// /b is busy on the second call, the turn goes on to /c
+	calls := [][]DstCandidate{all, {all[0], all[2]}, all}
+	want := []string{"/a", "/c", "/a"}
+	for i, candidates := range calls {
+		if got := policy.choose(candidates).Location; got != want[i] {
+			t.Fatalf("call %d chose %s, want %s", i, got, want[i])
+		}
+	}
+}
+
+func TestLeastLoadedPrefersFreeSpaceOnEqualLoad(t *testing.T) {
+	policy, _ := newPlacementPolicy(PolicyLeastLoaded)
+	candidates := []DstCandidate{
+		{Ip: "10.0.0.1", Location: "/a", Avail: 100, HostThreads: 2, HostLimit: 4},
+		{Ip: "10.0.0.2", Location: "/b", Avail: 300, HostThreads: 1, HostLimit: 2},
+	}
+	if got := policy.choose(candidates).Location; got != "/b" {
+		t.Fatalf("chose %s, want /b", got)
+	}
+}
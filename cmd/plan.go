@@ -0,0 +1,476 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/urfave/cli/v2"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"move_sectors/build"
+	"move_sectors/move_common"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Plan is where every task of a run would go, written by plan and executed by apply
+type Plan struct {
+	Created      string
+	Config       string
+	Kinds        []move_common.FileType
+	Policy       string
+	Entries      []PlanEntry
+	Blocked      []PlanEntry // tasks no dst path has room for
+	Destinations []DstProjection
+}
+
+// PlanEntry is one sector part, its source as it was when planned and its dst
+type PlanEntry struct {
+	SectorID string
+	Kind     move_common.FileType
+	SrcIp    string
+	SrcPath  string
+	SrcMtime int64
+	Size     int64
+	DstIp    string
+	DstPath  string
+	Reason   string
+}
+
+// DstProjection is how full a dst path gets when the plan is done
+type DstProjection struct {
+	Ip             string
+	Path           string
+	Total          uint64
+	Avail          uint64
+	PlannedBytes   int64
+	PlannedSectors int
+	AvailAfter     uint64
+}
+
+func (e PlanEntry) key() string {
+	return strings.Join([]string{string(e.Kind), e.SectorID, e.SrcIp, strings.TrimRight(e.SrcPath, "/")}, "|")
+}
+
+func planEntryOf(op Operation) PlanEntry {
+	return PlanEntry{
+		SectorID: op.getSectorID(),
+		Kind:     op.getFileType(),
+		SrcIp:    op.getSrcIp(),
+		SrcPath:  op.getSrcPath(),
+		SrcMtime: op.getSrcMtime(),
+		Size:     op.getTotalSize(),
+	}
+}
+
+func (p DstProjection) usedPercent(avail uint64) float64 {
+	if p.Total == 0 {
+		return 0
+	}
+	return float64(p.Total-avail) / float64(p.Total) * 100
+}
+
+func gib(b uint64) float64 {
+	return float64(b) / float64(1<<30)
+}
+
+// makePlan places every task of the task list without copying; the planned
+// copies are reserved on their dst paths meanwhile, so every placement sees
+// the space taken by the ones before it
+func makePlan(cfg *Config) *Plan {
+	taskListSingleton.TLock.Lock()
+	ops := append([]Operation{}, taskListSingleton.Ops...)
+	taskListSingleton.TLock.Unlock()
+	sectorPrioritiesSingleton.applyPriorities(ops)
+	sortByPriority(ops, cfg.PriorityRules)
+
+	plan := &Plan{
+		Created: time.Now().Format(time.RFC3339),
+		Config:  cfg.filePath,
+		Kinds:   fileTypes,
+		Policy:  placementPolicySingleton.Name(),
+		Entries: make([]PlanEntry, 0, len(ops)),
+		Blocked: make([]PlanEntry, 0),
+	}
+	plan.Destinations = dstProjections()
+
+	runs := make([]*CopyRun, 0, len(ops))
+	defer func() {
+		for _, run := range runs {
+			reservationLedgerSingleton.release(run)
+		}
+	}()
+	// parts of a sector follow the first one planned, as the placement map does when copying
+	groups := make(map[string]PlanEntry)
+	for _, op := range ops {
+		entry := planEntryOf(op)
+		dir, ip, err := plannedGroupDir(groups, op)
+		if dir == "" {
+			dir, ip, err = op.getBestDst()
+		}
+		if err != nil {
+			entry.Reason = err.Error()
+			switch entry.Reason {
+			case move_common.NoDstSuitableForNow:
+				entry.Reason = "no dst path has enough space"
+			case move_common.GroupDirFull:
+				entry.Reason = "the dst path of the other files of the sector has not enough space"
+			}
+			plan.Blocked = append(plan.Blocked, entry)
+			continue
+		}
+		entry.DstIp, entry.DstPath = ip, strings.TrimRight(dir, "/")
+		if group, ok := groups[entry.SectorID]; ok && group.DstIp == entry.DstIp && group.DstPath == entry.DstPath {
+			entry.Reason = "group, other files of the sector are planned there"
+		} else {
+			entry.Reason = placementReason(op, entry.DstIp, entry.DstPath)
+		}
+		if _, ok := groups[entry.SectorID]; !ok {
+			groups[entry.SectorID] = entry
+		}
+		run := &CopyRun{SectorID: entry.SectorID, DstIp: ip, DstPath: dir, Size: entry.Size}
+		reservationLedgerSingleton.reserve(run)
+		runs = append(runs, run)
+		plan.Entries = append(plan.Entries, entry)
+	}
+
+	for i := range plan.Destinations {
+		d := &plan.Destinations[i]
+		sectors := make(map[string]struct{})
+		for _, e := range plan.Entries {
+			if e.DstIp == d.Ip && e.DstPath == d.Path {
+				d.PlannedBytes += e.Size
+				sectors[e.SectorID] = struct{}{}
+			}
+		}
+		d.PlannedSectors = len(sectors)
+		d.AvailAfter = getDstAvail(d.Ip, d.Path)
+	}
+	return plan
+}
+
+// plannedGroupDir returns the dst path planned for another part of the sector
+// of op if it can take op too, an empty dir if no part was planned
+func plannedGroupDir(groups map[string]PlanEntry, op Operation) (string, string, error) {
+	group, ok := groups[op.getSectorID()]
+	if !ok {
+		return "", "", nil
+	}
+	dstComputersMapSingleton.CLock.Lock()
+	defer dstComputersMapSingleton.CLock.Unlock()
+	cmp, ok := dstComputersMapSingleton.CMap[group.DstIp]
+	p, found := findPath(cmp, group.DstPath)
+	if !ok || !found || !capacityAllows(cmp, p, op.getSectorID(), op.getTotalSize()) {
+		return "", "", nil
+	}
+	return p.Location, cmp.Ip, nil
+}
+
+// dstProjections lists every dst path taking new tasks in config order
+func dstProjections() []DstProjection {
+	dstComputersMapSingleton.CLock.Lock()
+	defer dstComputersMapSingleton.CLock.Unlock()
+	projections := make([]DstProjection, 0)
+	for _, cmp := range dstComputersMapSingleton.CMap {
+		if cmp.Draining {
+			continue
+		}
+		for _, p := range cmp.Paths {
+			if p.Draining {
+				continue
+			}
+			avail, total := getDiskSpace(p.Location)
+			projections = append(projections, DstProjection{
+				Ip:    cmp.Ip,
+				Path:  strings.TrimRight(p.Location, "/"),
+				Total: total,
+				Avail: avail,
+			})
+		}
+	}
+	sort.Slice(projections, func(i, j int) bool {
+		return dstOrderSingleton[dstPathKey(projections[i].Ip, projections[i].Path)] <
+			dstOrderSingleton[dstPathKey(projections[j].Ip, projections[j].Path)]
+	})
+	return projections
+}
+
+// placementReason tells which rule chose the dst path of op
+func placementReason(op Operation, ip, location string) string {
+	if entry, ok := placementMapSingleton.lookup(op.getSectorID()); ok && entry.DstIp == ip && entry.DstPath == location {
+		return "placement map, other files of the sector were placed there"
+	}
+	if dir, groupIp, err := op.tryToFindGroupDir(); err == nil && groupIp == ip && strings.TrimRight(dir, "/") == location {
+		return "group dir, other files of the sector are there"
+	}
+	return "placement policy " + placementPolicySingleton.Name()
+}
+
+func (plan *Plan) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%d %s tasks planned, %d blocked, placement policy %s\n", len(plan.Entries), fileTypesString(plan.Kinds), len(plan.Blocked), plan.Policy)
+	for _, d := range plan.Destinations {
+		fmt.Fprintf(&b, "dst %s %s: %d sectors %.1f GiB planned, free %.1f GiB -> %.1f GiB, used %.1f%% -> %.1f%%\n",
+			d.Ip, d.Path, d.PlannedSectors, gib(uint64(d.PlannedBytes)), gib(d.Avail), gib(d.AvailAfter),
+			d.usedPercent(d.Avail), d.usedPercent(d.AvailAfter))
+	}
+	for _, e := range plan.Blocked {
+		fmt.Fprintf(&b, "blocked %s %s of %s %s: %s\n", e.SectorID, e.Kind, e.SrcIp, e.SrcPath, e.Reason)
+	}
+	return b.String()
+}
+
+func isYamlFile(file string) bool {
+	ext := strings.ToLower(filepath.Ext(file))
+	return ext == ".yaml" || ext == ".yml"
+}
+
+func writePlan(plan *Plan, file string) error {
+	var raw []byte
+	var err error
+	if isYamlFile(file) {
+		raw, err = yaml.Marshal(plan)
+	} else {
+		raw, err = json.MarshalIndent(plan, "", "  ")
+	}
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(file, raw, 0644)
+}
+
+func readPlan(file string) (*Plan, error) {
+	raw, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	plan := new(Plan)
+	if isYamlFile(file) {
+		err = yaml.Unmarshal(raw, plan)
+	} else {
+		err = json.Unmarshal(raw, plan)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read plan %s: %w", file, err)
+	}
+	if len(plan.Kinds) == 0 {
+		return nil, fmt.Errorf("plan %s has no kind of file", file)
+	}
+	for _, kind := range plan.Kinds {
+		switch kind {
+		case move_common.Sealed, move_common.UnSealed, move_common.Cache:
+		default:
+			return nil, fmt.Errorf("plan %s has unknown kind %q", file, kind)
+		}
+	}
+	return plan, nil
+}
+
+// sourceDrift compares the scanned ops with the plan and returns the planned ops
+func sourceDrift(plan *Plan, ops []Operation) ([]Operation, []string) {
+	scanned := make(map[string]Operation, len(ops))
+	for _, op := range ops {
+		scanned[planEntryOf(op).key()] = op
+	}
+	planned := make([]Operation, 0, len(plan.Entries))
+	drift := make([]string, 0)
+	for _, e := range plan.Entries {
+		op, ok := scanned[e.key()]
+		if !ok {
+			drift = append(drift, fmt.Sprintf("source %s %s on %s %s is gone", e.SectorID, e.Kind, e.SrcIp, e.SrcPath))
+			continue
+		}
+		if now := planEntryOf(op); now.Size != e.Size || now.SrcMtime != e.SrcMtime {
+			drift = append(drift, fmt.Sprintf("source %s %s on %s %s changed, size %d -> %d, mtime %d -> %d",
+				e.SectorID, e.Kind, e.SrcIp, e.SrcPath, e.Size, now.Size, e.SrcMtime, now.SrcMtime))
+			continue
+		}
+		planned = append(planned, op)
+	}
+	return planned, drift
+}
+
+// dstDrift checks every dst path can still take what the plan puts on it
+func dstDrift(entries map[Operation]PlanEntry) []string {
+	needs := make(map[pathRef]int64)
+	for _, e := range entries {
+		needs[pathRef{Ip: e.DstIp, Path: Path{Location: e.DstPath}}] += e.Size
+	}
+	dstComputersMapSingleton.CLock.Lock()
+	defer dstComputersMapSingleton.CLock.Unlock()
+	drift := make([]string, 0)
+	for ref, need := range needs {
+		cmp, ok := dstComputersMapSingleton.CMap[ref.Ip]
+		p, found := findPath(cmp, ref.Path.Location)
+		if !ok || !found {
+			drift = append(drift, fmt.Sprintf("dst %s %s is not configured anymore", ref.Ip, ref.Path.Location))
+			continue
+		}
+		if cmp.Draining || p.Draining {
+			drift = append(drift, fmt.Sprintf("dst %s %s is draining", ref.Ip, ref.Path.Location))
+			continue
+		}
+		avail, total := getDiskSpace(p.Location)
+		minFree := effectiveCapacityPolicy(cmp, p).minFree(total)
+		if avail < uint64(need)+minFree {
+			drift = append(drift, fmt.Sprintf("dst %s %s has %.1f GiB free, the plan needs %.1f GiB and keeps %.1f GiB free",
+				ref.Ip, ref.Path.Location, gib(avail), gib(uint64(need)), gib(minFree)))
+		}
+	}
+	sort.Strings(drift)
+	return drift
+}
+
+// startPlannedWork copies exactly the tasks of plan to their planned dst
+// paths, nothing is copied if the sources or the dst paths drifted
+func startPlannedWork(cfg *Config, plan *Plan) error {
+	log.Infof("initializing tasks of the plan created at %s", plan.Created)
+	ops, err := initOps()
+	if err != nil {
+		return err
+	}
+	planned, drift := sourceDrift(plan, ops)
+	if len(drift) == 0 {
+		if err = buildDstIndex(); err != nil {
+			return err
+		}
+		if planned, err = checkSourceSizeAndIsExistedInDst(planned, cfg); err != nil {
+			return err
+		}
+	}
+	entries := make(map[Operation]PlanEntry, len(planned))
+	byKey := make(map[string]PlanEntry, len(plan.Entries))
+	for _, e := range plan.Entries {
+		byKey[e.key()] = e
+	}
+	for _, op := range planned {
+		entries[op] = byKey[planEntryOf(op).key()]
+	}
+	if len(drift) == 0 {
+		drift = dstDrift(entries)
+	}
+	if len(drift) > 0 {
+		for _, d := range drift {
+			log.Error(d)
+		}
+		return fmt.Errorf("%d differences since the plan was made, make a new plan", len(drift))
+	}
+	if done := len(plan.Entries) - len(planned); done > 0 {
+		log.Infof("%d planned tasks are in dst already", done)
+	}
+	if len(plan.Blocked) > 0 {
+		log.Warnf("%d blocked tasks of the plan will not be copied", len(plan.Blocked))
+	}
+
+	taskControlSingleton.CLock.Lock()
+	for op, e := range entries {
+		taskControlSingleton.Pins[op] = pathRef{Ip: e.DstIp, Path: Path{Location: e.DstPath}}
+	}
+	taskControlSingleton.CLock.Unlock()
+	sectorPrioritiesSingleton.applyPriorities(planned)
+	schedulerSingleton.push(planned...)
+	log.Infof("all %d tasks of the plan init done", len(planned))
+	schedulerSingleton.run(cfg)
+	return nil
+}
+
+var PlanCmd = &cli.Command{
+	Name:  "plan",
+	Usage: "find and place the tasks without copying, write the plan to a file",
+	Flags: append(append([]cli.Flag{}, runFlags...),
+		&cli.StringFlag{
+			Name:  "out",
+			Usage: "the plan file, yaml for .yaml or .yml, json otherwise",
+			Value: "mv_sectors_plan.json",
+		},
+	),
+	Action: func(cctx *cli.Context) error {
+		if err := setFileTypes(cctx); err != nil {
+			return err
+		}
+		config, closeRun, err := prepareRun(cctx)
+		if err != nil {
+			return err
+		}
+		defer closeRun()
+		if err := initializeTaskList(config); err != nil {
+			return err
+		}
+		plan := makePlan(config)
+		if err := writePlan(plan, cctx.String("out")); err != nil {
+			return err
+		}
+		fmt.Print(plan)
+		fmt.Printf("plan written to %s, run apply --plan %s to copy\n", cctx.String("out"), cctx.String("out"))
+		return nil
+	},
+}
+
+var ApplyCmd = &cli.Command{
+	Name:  "apply",
+	Usage: "copy the tasks of a plan to their planned dst, refuse if anything drifted",
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:  "path",
+			Usage: "special the config file paths, default to the config the plan was made with",
+			Value: "~/mv_sectors.yaml",
+		},
+		&cli.StringFlag{
+			Name:     "plan",
+			Usage:    "the plan file written by plan",
+			Required: true,
+		},
+		&cli.StringFlag{
+			Name:  "job",
+			Usage: "name the job, default to job-<start time>",
+		},
+	},
+	Action: func(cctx *cli.Context) error {
+		log.Infof("apply move_sector plan,version:%s", build.GetVersion())
+		id, _, err := jobIDOf(cctx)
+		if err != nil {
+			return err
+		}
+		lock, err := lockJob(id)
+		if err != nil {
+			log.Error(err)
+			return err
+		}
+		if lock != nil {
+			defer lock.Close()
+		} else {
+			return errors.New("create file lock failed")
+		}
+
+		plan, err := readPlan(cctx.String("plan"))
+		if err != nil {
+			return err
+		}
+		fileTypes = plan.Kinds
+		log.Infof("will copy %s files of plan %s", fileTypesString(fileTypes), cctx.String("plan"))
+		if !cctx.IsSet("path") && plan.Config != "" {
+			if err := cctx.Set("path", plan.Config); err != nil {
+				return err
+			}
+		}
+		// a refused plan exits non-zero, scripts applying it should notice
+		config, closeRun, err := prepareRun(cctx)
+		if err != nil {
+			return err
+		}
+		defer closeRun()
+		stopServing, err := serveRun(config, id)
+		if err != nil {
+			return err
+		}
+		defer stopServing()
+
+		if err := startPlannedWork(config, plan); err != nil {
+			return err
+		}
+		log.Info("mv_sectors exited")
+		return nil
+	},
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func sealedOp(id, srcPath string, size, mtime int64) *SealedTask {
+	return &SealedTask{SectorID: SectorID{ID: id}, SrcIp: testSrcIp, OriSrc: srcPath, TotalSize: size, SrcMtime: mtime}
+}
+
+func TestSourceDrift(t *testing.T) {
+	planned := planEntryOf(sealedOp("s-t01000-1", "/src1", 100, 1000))
+	cases := []struct {
+		name    string
+		scanned []Operation
+		planned int
+		drift   string
+	}{
+		{"unchanged", []Operation{sealedOp("s-t01000-1", "/src1", 100, 1000)}, 1, ""},
+		{"trailing slash of the path", []Operation{sealedOp("s-t01000-1", "/src1/", 100, 1000)}, 1, ""},
+		{"sectors not planned are not copied", []Operation{sealedOp("s-t01000-1", "/src1", 100, 1000), sealedOp("s-t01000-2", "/src1", 100, 1000)}, 1, ""},
+		{"gone", []Operation{sealedOp("s-t01000-2", "/src1", 100, 1000)}, 0, "is gone"},
+		{"moved to another path", []Operation{sealedOp("s-t01000-1", "/src2", 100, 1000)}, 0, "is gone"},
+		{"size changed", []Operation{sealedOp("s-t01000-1", "/src1", 200, 1000)}, 0, "size 100 -> 200"},
+		{"mtime changed", []Operation{sealedOp("s-t01000-1", "/src1", 100, 2000)}, 0, "mtime 1000 -> 2000"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			ops, drift := sourceDrift(&Plan{Entries: []PlanEntry{planned}}, c.scanned)
+			if len(ops) != c.planned {
+				t.Fatalf("%d ops planned, want %d", len(ops), c.planned)
+			}
+			if c.drift == "" {
+				if len(drift) != 0 {
+					t.Fatalf("drift %v", drift)
+				}
+				return
+			}
+			if len(drift) != 1 || !strings.Contains(drift[0], c.drift) {
+				t.Fatalf("drift %v, want %q", drift, c.drift)
+			}
+		})
+	}
+}
+
+func TestDstDrift(t *testing.T) {
+	location := t.TempDir()
+	avail, _ := getDiskSpace(location)
+	if avail < 1<<20 {
+		t.Skip("not enough free space in the temp dir")
+	}
+	saved := dstComputersMapSingleton.CMap
+	defer func() { dstComputersMapSingleton.CMap = saved }()
+
+	cases := []struct {
+		name  string
+		cmp   Computer
+		path  string // where the plan puts the sectors
+		sizes []int64
+		drift string
+	}{
+		{"fits", Computer{}, location, []int64{1 << 20, 1 << 20}, ""},
+		{"trailing slash", Computer{}, location + "/", []int64{1 << 20}, ""},
+		{"computer gone", Computer{Ip: "10.0.0.9"}, location, []int64{1 << 20}, "not configured anymore"},
+		{"path gone", Computer{}, location + "/gone", []int64{1 << 20}, "not configured anymore"},
+		{"draining", Computer{Draining: true}, location, []int64{1 << 20}, "is draining"},
+		// each fits alone, not all of them
+		{"the sum does not fit", Computer{}, location, []int64{int64(avail / 2), int64(avail / 2), 1 << 20}, "the plan needs"},
+		{"min free kept", Computer{CapacityPolicy: CapacityPolicy{MinFreeBytes: int64(avail)}}, location, []int64{1 << 20}, "the plan needs"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if c.cmp.Ip == "" {
+				c.cmp.Ip = testDstIp
+			}
+			c.cmp.Paths = []Path{{Location: location}}
+			dstComputersMapSingleton.CMap = map[string]Computer{c.cmp.Ip: c.cmp}
+			entries := make(map[Operation]PlanEntry)
+			for i, size := range c.sizes {
+				op := sealedOp("s-t01000-"+string(rune('1'+i)), "/src1", size, 1000)
+				entries[op] = PlanEntry{SectorID: op.ID, DstIp: testDstIp, DstPath: c.path, Size: size}
+			}
+			drift := dstDrift(entries)
+			if c.drift == "" {
+				if len(drift) != 0 {
+					t.Fatalf("drift %v", drift)
+				}
+				return
+			}
+			if len(drift) != 1 || !strings.Contains(drift[0], c.drift) {
+				t.Fatalf("drift %v, want %q", drift, c.drift)
+			}
+		})
+	}
+}
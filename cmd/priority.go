@@ -0,0 +1,175 @@
+package main
+
+import (
+	"fmt"
+	"move_sectors/move_common"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	RuleOldestMtime   = "oldest-mtime"
+	RuleLowestSector  = "lowest-sector"
+	RuleFullestSource = "fullest-source"
+
+	// priority of the tasks whose sector the list file gives none
+	defaultPriority = 0
+)
+
+// sectorPriorities holds the priorities set in the sector list file, the
+// file is watched so priorities could be changed while running
+type sectorPriorities struct {
+	File       string
+	Priorities map[string]int
+	mtime      time.Time
+	lock       *sync.Mutex
+}
+
+var sectorPrioritiesSingleton = sectorPriorities{
+	Priorities: make(map[string]int),
+	lock:       new(sync.Mutex),
+}
+
+func checkPriorityRules(rules []string) error {
+	for _, r := range rules {
+		switch r {
+		case RuleOldestMtime, RuleLowestSector, RuleFullestSource:
+		default:
+			return fmt.Errorf("unknown priority rule %s,options: %s,%s,%s", r, RuleOldestMtime, RuleLowestSector, RuleFullestSource)
+		}
+	}
+	return nil
+}
+
+// sectorNumber parses the number of a sector id like s-t01000-123
+func sectorNumber(id string) int64 {
+	n, err := strconv.ParseInt(id[strings.LastIndex(id, "-")+1:], 10, 64)
+	if err != nil {
+		return -1
+	}
+	return n
+}
+
+// sourceUsage returns the used ratio of the filesystem of every source path
+// of ops, taken once before sorting them
+func sourceUsage(ops []Operation) map[string]float64 {
+	usage := make(map[string]float64)
+	for _, op := range ops {
+		location := op.getSrcPath()
+		if _, ok := usage[location]; ok {
+			continue
+		}
+		avail, total := getDiskSpace(location)
+		u := 0.0
+		if total > 0 {
+			u = 1 - float64(avail)/float64(total)
+		}
+		usage[location] = u
+	}
+	return usage
+}
+
+// sortByPriority puts the tasks to start first at the head: higher priority
+// first, then the configured rules in order, then the discovery order
+func sortByPriority(ops []Operation, rules []string) {
+	var usage map[string]float64
+	for _, r := range rules {
+		if r == RuleFullestSource {
+			usage = sourceUsage(ops)
+		}
+	}
+	sort.SliceStable(ops, func(i, j int) bool {
+		a, b := ops[i], ops[j]
+		if pa, pb := a.getPriority(), b.getPriority(); pa != pb {
+			return pa > pb
+		}
+		for _, r := range rules {
+			switch r {
+			case RuleOldestMtime:
+				if ma, mb := a.getSrcMtime(), b.getSrcMtime(); ma != mb {
+					return ma < mb
+				}
+			case RuleLowestSector:
+				if na, nb := sectorNumber(a.getSectorID()), sectorNumber(b.getSectorID()); na != nb {
+					return na < nb
+				}
+			case RuleFullestSource:
+				if ua, ub := usage[a.getSrcPath()], usage[b.getSrcPath()]; ua != ub {
+					return ua > ub
+				}
+			}
+		}
+		return false
+	})
+	groupSectorParts(ops)
+}
+
+// groupSectorParts moves the parts of a sector next to its first one, in the
+// order of move_common.FileTypes so cache comes right after its sealed file
+func groupSectorParts(ops []Operation) {
+	kindOrder := make(map[move_common.FileType]int)
+	for i, ft := range move_common.FileTypes {
+		kindOrder[ft] = i
+	}
+	first := make(map[string]int)
+	for i, op := range ops {
+		if _, ok := first[op.getSectorID()]; !ok {
+			first[op.getSectorID()] = i
+		}
+	}
+	sort.SliceStable(ops, func(i, j int) bool {
+		a, b := ops[i], ops[j]
+		if fa, fb := first[a.getSectorID()], first[b.getSectorID()]; fa != fb {
+			return fa < fb
+		}
+		return kindOrder[a.getFileType()] < kindOrder[b.getFileType()]
+	})
+}
+
+// applyPriorities sets the priorities from the sector list file on ops, the
+// ones the file does not list anymore go back to the default
+func (sp *sectorPriorities) applyPriorities(ops []Operation) {
+	sp.lock.Lock()
+	defer sp.lock.Unlock()
+	for _, op := range ops {
+		if p, ok := taskControlSingleton.priority(op); ok {
+			op.setPriority(p)
+		} else if p, ok := sp.Priorities[op.getSectorID()]; ok {
+			op.setPriority(p)
+		} else {
+			op.setPriority(defaultPriority)
+		}
+	}
+}
+
+// reloadIfChanged re-reads the priorities when the sector list file was modified
+func (sp *sectorPriorities) reloadIfChanged() bool {
+	if sp.File == "" {
+		return false
+	}
+	info, err := os.Stat(sp.File)
+	if err != nil {
+		return false
+	}
+	sp.lock.Lock()
+	changed := !info.ModTime().Equal(sp.mtime)
+	sp.lock.Unlock()
+	if !changed {
+		return false
+	}
+	_, priorities, err := readSectorListFile(sp.File, false)
+	if err != nil {
+		log.Warnf("reload priorities from %s failed: %v", sp.File, err)
+		return false
+	}
+	sp.lock.Lock()
+	sp.Priorities = priorities
+	sp.mtime = info.ModTime()
+	sp.lock.Unlock()
+	log.Infof("priorities reloaded from %s, %d sectors", sp.File, len(priorities))
+	return true
+}
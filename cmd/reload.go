@@ -0,0 +1,191 @@
+package main
+
+import (
+	"strings"
+)
+
+type pathRef struct {
+	Ip   string
+	Path Path
+}
+
+// reloadConfig re-reads the config file on SIGHUP and applies it to the running
+// process: limits change at once, new paths are added and removed paths are
+// drained, copies already running are never cancelled
+func reloadConfig(cfg *Config) error {
+	newCfg, err := loadConfig(cfg.filePath)
+	if err != nil {
+		return err
+	}
+	newSrc, err := makeComputersMap(newCfg.SrcComputers, newCfg.SingleThreadMBPS, false)
+	if err != nil {
+		return err
+	}
+	newDst, err := makeComputersMap(newCfg.DstComputers, newCfg.SingleThreadMBPS, true)
+	if err != nil {
+		return err
+	}
+	policy := placementPolicySingleton
+	if newCfg.PlacementPolicy != cfg.PlacementPolicy {
+		if policy, err = newPlacementPolicy(newCfg.PlacementPolicy); err != nil {
+			return err
+		}
+	}
+
+	// a dst path added here may be used by another job meanwhile
+	if err = updateJob(newCfg, pathLeasesSingleton.JobID); err != nil {
+		return err
+	}
+
+	// all checks passed, apply the differences
+	addedSrc := mergeComputersMap(&srcComputersMapSingleton, newSrc, "src")
+	addedDst := mergeComputersMap(&dstComputersMapSingleton, newDst, "dst")
+	for _, v := range newCfg.SrcComputers {
+		fairShareSingleton.setWeights(v)
+	}
+	dstComputersMapSingleton.CLock.Lock()
+	for _, added := range addedDst {
+		dstOrderSingleton[dstPathKey(added.Ip, added.Path.Location)] = len(dstOrderSingleton)
+	}
+	dstComputersMapSingleton.CLock.Unlock()
+	configLock.Lock()
+	cfg.SingleThreadMBPS = newCfg.SingleThreadMBPS
+	cfg.Chunks = newCfg.Chunks
+	cfg.PriorityRules = newCfg.PriorityRules
+	cfg.PlacementPolicy = newCfg.PlacementPolicy
+	cfg.MaxRetries = newCfg.MaxRetries
+	cfg.Adaptive = newCfg.Adaptive
+	cfg.LoadGuard = newCfg.LoadGuard
+	cfg.SrcComputers = newCfg.SrcComputers
+	cfg.DstComputers = newCfg.DstComputers
+	cfg.Schedule = newCfg.Schedule
+	placementPolicySingleton = policy
+	configLock.Unlock()
+	if err = capacityUsageSingleton.seed(newCfg); err != nil {
+		log.Warnf("capacity usage of added dst paths not seeded from history: %v", err)
+	}
+	sectorStoreSingleton.load(cfg)
+	// the window in force overrides the limits just merged
+	scheduleSingleton.apply(cfg)
+
+	// waiting tasks of removed src paths would never start
+	dropped := schedulerSingleton.drop(func(op Operation) bool {
+		return !srcPathConfigured(op.getSrcIp(), op.getSrcPath())
+	})
+	if dropped > 0 {
+		log.Warnf("%d waiting tasks dropped because their src path was removed", dropped)
+	}
+
+	if len(addedSrc) > 0 || len(addedDst) > 0 {
+		schedulerSingleton.addScanning(1)
+		go func() {
+			defer schedulerSingleton.addScanning(-1)
+			scanAddedPaths(cfg, addedSrc, addedDst)
+		}()
+	}
+	log.Infof("config %s reloaded, %d src paths and %d dst paths added", cfg.filePath, len(addedSrc), len(addedDst))
+	return nil
+}
+
+// mergeComputersMap applies newMap to cm and returns the paths newly added
+func mergeComputersMap(cm *ComputersMap, newMap map[string]Computer, side string) []pathRef {
+	cm.CLock.Lock()
+	defer cm.CLock.Unlock()
+	added := make([]pathRef, 0)
+	for ip, old := range cm.CMap {
+		nc, ok := newMap[ip]
+		if !ok {
+			if !old.Draining {
+				log.Warnf("%s computer %s removed, draining it", side, ip)
+			}
+			old.Draining = true
+			for idx := range old.Paths {
+				old.Paths[idx].Draining = true
+			}
+			cm.CMap[ip] = old
+			continue
+		}
+		old.BandWidth = nc.BandWidth
+		old.LimitThread = nc.LimitThread
+		old.Weight = nc.Weight
+		old.CapacityPolicy = nc.CapacityPolicy
+		old.Draining = false
+		for idx, p := range old.Paths {
+			found := false
+			for _, np := range nc.Paths {
+				if strings.TrimRight(np.Location, "/") == strings.TrimRight(p.Location, "/") {
+					p.SinglePathThreadLimit = np.SinglePathThreadLimit
+					p.Weight = np.Weight
+					p.CapacityPolicy = np.CapacityPolicy
+					p.Draining = false
+					found = true
+				}
+			}
+			if !found && !p.Draining {
+				log.Warnf("%s path %s of %s removed, draining it", side, p.Location, ip)
+				p.Draining = true
+			}
+			old.Paths[idx] = p
+		}
+		for _, np := range nc.Paths {
+			found := false
+			for _, p := range old.Paths {
+				found = found || strings.TrimRight(np.Location, "/") == strings.TrimRight(p.Location, "/")
+			}
+			if !found {
+				old.Paths = append(old.Paths, np)
+				added = append(added, pathRef{Ip: ip, Path: np})
+			}
+		}
+		cm.CMap[ip] = old
+	}
+	for ip, nc := range newMap {
+		if _, ok := cm.CMap[ip]; ok {
+			continue
+		}
+		for idx := range nc.Paths {
+			added = append(added, pathRef{Ip: ip, Path: nc.Paths[idx]})
+		}
+		cm.CMap[ip] = nc
+	}
+	return added
+}
+
+func srcPathConfigured(ip, location string) bool {
+	srcComputersMapSingleton.CLock.Lock()
+	defer srcComputersMapSingleton.CLock.Unlock()
+	cmp, ok := srcComputersMapSingleton.CMap[ip]
+	if !ok || cmp.Draining {
+		return false
+	}
+	for _, p := range cmp.Paths {
+		if p.Location == location || strings.TrimRight(p.Location, "/") == location {
+			return !p.Draining
+		}
+	}
+	return false
+}
+
+// scanAddedPaths indexes new dst paths and makes tasks of new src paths
+func scanAddedPaths(cfg *Config, addedSrc, addedDst []pathRef) {
+	for _, added := range addedDst {
+		if err := indexDstPath(strings.TrimRight(added.Path.Location, "/")); err != nil {
+			log.Warnf("index new dst path %s failed: %v", added.Path.Location, err)
+		}
+	}
+	for _, added := range addedSrc {
+		ops, err := scanSrcPath(added.Ip, added.Path)
+		if err != nil {
+			log.Warnf("scan new src path %s failed: %v", added.Path.Location, err)
+			continue
+		}
+		accepted, err := checkSourceSizeAndIsExistedInDst(ops, cfg)
+		if err != nil {
+			log.Warnf("check new src path %s failed: %v", added.Path.Location, err)
+			continue
+		}
+		sectorPrioritiesSingleton.applyPriorities(accepted)
+		schedulerSingleton.push(accepted...)
+		log.Infof("new src path %s of %s added %d tasks", added.Path.Location, added.Ip, len(accepted))
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"move_sectors/move_common"
+	"move_sectors/mv_utils"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// CopyRun is one running copy of a task, Written grows while the copy goes on
+type CopyRun struct {
+	SectorID string
+	DstIp    string
+	DstPath  string
+	Size     int64
+	Written  int64
+	Resumed  int64 // bytes an interrupted copy left on dst and this one kept, part of Written
+
+	ctx      context.Context
+	cancel   context.CancelFunc
+	cancelAs string // status to give the task when a control command cancelled the copy
+	failure  string // error the copy ended with, kept for the history
+	slot     *Slot
+	resume   *mv_utils.HashOption // how the partial dst files of an interrupted copy are checked, nil to start over
+}
+
+// err tells the copy why it must give up, nil while it may go on
+func (r *CopyRun) err() error {
+	if r == nil || r.ctx == nil || r.ctx.Err() == nil {
+		return nil
+	}
+	if stop {
+		return errors.New(move_common.StoppedBySyscall)
+	}
+	return errors.New(move_common.CancelledByControl)
+}
+
+// fail records the error the copy ended with
+func (r *CopyRun) fail(err error) {
+	if r != nil && err != nil {
+		r.failure = err.Error()
+	}
+}
+
+// addWritten counts n bytes copied in cost of reading and writing
+func (r *CopyRun) addWritten(n int, cost time.Duration) {
+	if r != nil {
+		atomic.AddInt64(&r.Written, int64(n))
+		adaptiveSingleton.record(r.slot, n, cost)
+	}
+}
+
+// resumed counts n bytes kept from an interrupted copy as written
+func (r *CopyRun) resumed(n int64) {
+	if r != nil {
+		atomic.AddInt64(&r.Written, n)
+		atomic.AddInt64(&r.Resumed, n)
+	}
+}
+
+// keepPartial tells whether the copy leaves its partial dst files for run
+// --resume, it was stopped in a job with a journal
+func (r *CopyRun) keepPartial() bool {
+	return r != nil && r.failure == move_common.StoppedBySyscall && journalSingleton != nil
+}
+
+func (r *CopyRun) remain() int64 {
+	remain := r.Size - atomic.LoadInt64(&r.Written)
+	if remain < 0 {
+		return 0
+	}
+	return remain
+}
+
+// ReservationLedger holds the bytes still to be written by in-flight copies
+// on each dst path, statfs does not see them until the tmp files grew
+type ReservationLedger struct {
+	Paths map[string]map[*CopyRun]struct{}
+	RLock *sync.Mutex
+}
+
+var reservationLedgerSingleton = ReservationLedger{
+	Paths: make(map[string]map[*CopyRun]struct{}),
+	RLock: new(sync.Mutex),
+}
+
+func (l *ReservationLedger) reserve(r *CopyRun) {
+	l.RLock.Lock()
+	defer l.RLock.Unlock()
+	key := dstPathKey(r.DstIp, r.DstPath)
+	if _, ok := l.Paths[key]; !ok {
+		l.Paths[key] = make(map[*CopyRun]struct{})
+	}
+	l.Paths[key][r] = struct{}{}
+}
+
+func (l *ReservationLedger) release(r *CopyRun) {
+	l.RLock.Lock()
+	defer l.RLock.Unlock()
+	key := dstPathKey(r.DstIp, r.DstPath)
+	delete(l.Paths[key], r)
+	if len(l.Paths[key]) == 0 {
+		delete(l.Paths, key)
+	}
+}
+
+// reserved returns the bytes in-flight copies will still write on the path
+func (l *ReservationLedger) reserved(ip, location string) uint64 {
+	l.RLock.Lock()
+	defer l.RLock.Unlock()
+	var sum int64
+	for r := range l.Paths[dstPathKey(ip, location)] {
+		sum += r.remain()
+	}
+	return uint64(sum)
+}
+
+// inFlight returns the full size and the sectors of in-flight copies on the path
+func (l *ReservationLedger) inFlight(ip, location string) (int64, map[string]struct{}) {
+	l.RLock.Lock()
+	defer l.RLock.Unlock()
+	var sum int64
+	sectors := make(map[string]struct{})
+	for r := range l.Paths[dstPathKey(ip, location)] {
+		sum += r.Size
+		sectors[r.SectorID] = struct{}{}
+	}
+	return sum, sectors
+}
+
+// count returns the number of in-flight copies on the path
+func (l *ReservationLedger) count(ip, location string) int {
+	l.RLock.Lock()
+	defer l.RLock.Unlock()
+	return len(l.Paths[dstPathKey(ip, location)])
+}
+
+// getDstAvail is the free space of a dst path minus what is reserved on it
+func getDstAvail(ip, location string) uint64 {
+	avail := getDiskAvail(location)
+	reserved := reservationLedgerSingleton.reserved(ip, location)
+	if reserved >= avail {
+		return 0
+	}
+	return avail - reserved
+}
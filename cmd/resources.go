@@ -0,0 +1,429 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	SideSrc = "src"
+	SideDst = "dst"
+)
+
+// Slot is the thread one copy holds on its src host, src path, dst host and dst path
+type Slot struct {
+	SrcIp    string
+	SrcPath  string
+	DstIp    string
+	DstPath  string
+	SectorID string
+	Owner    Operation
+	Acquired time.Time
+	released bool
+	exited   bool       // the goroutine running the copy returned
+	leases   []*os.File // path leases shared with other jobs of the host
+}
+
+// ResourceManager counts the threads in use on every host and path. Limits
+// stay in the computers maps, the counters only change by acquire and
+// release of whole slots so they can not drift from the copies running
+type ResourceManager struct {
+	Hosts  map[string]int64 // side:ip -> threads in use
+	Paths  map[string]int64 // side:ip:location -> threads in use
+	Slots  map[*Slot]struct{}
+	Limits map[string]int64 // limits tuned by the adaptive mode, instead of the configured ones
+	RLock  *sync.Mutex
+}
+
+var resourceManagerSingleton = ResourceManager{
+	Hosts:  make(map[string]int64),
+	Paths:  make(map[string]int64),
+	Slots:  make(map[*Slot]struct{}),
+	Limits: make(map[string]int64),
+	RLock:  new(sync.Mutex),
+}
+
+func hostKey(side, ip string) string {
+	return side + ":" + ip
+}
+
+func pathKey(side, ip, location string) string {
+	return side + ":" + ip + ":" + strings.TrimRight(location, "/")
+}
+
+func findPath(cmp Computer, location string) (Path, bool) {
+	for _, p := range cmp.Paths {
+		if strings.TrimRight(p.Location, "/") == strings.TrimRight(location, "/") {
+			return p, true
+		}
+	}
+	return Path{}, false
+}
+
+// limit returns the effective limit of key, must be called with RLock held
+func (rm *ResourceManager) limit(key string, configured int64) int64 {
+	if l, ok := rm.Limits[key]; ok {
+		return l
+	}
+	return configured
+}
+
+// effectiveLimit is the limit of key after the load guard, must be called with RLock held
+func (rm *ResourceManager) effectiveLimit(key string, configured int64) int64 {
+	return loadGuardSingleton.adjust(key, rm.limit(key, configured))
+}
+
+func (rm *ResourceManager) setLimit(key string, limit int64) {
+	rm.RLock.Lock()
+	defer rm.RLock.Unlock()
+	rm.Limits[key] = limit
+}
+
+// capLimit lowers the tuned limit of key to max if it is above
+func (rm *ResourceManager) capLimit(key string, max int64) {
+	rm.RLock.Lock()
+	defer rm.RLock.Unlock()
+	if l, ok := rm.Limits[key]; ok && l > max {
+		log.Infof("adaptive: %s threads %d -> %d, capped by the schedule", key, l, max)
+		rm.Limits[key] = max
+	}
+}
+
+func (rm *ResourceManager) clearLimits() {
+	rm.RLock.Lock()
+	defer rm.RLock.Unlock()
+	rm.Limits = make(map[string]int64)
+}
+
+// limitAndUse returns the effective limit and the threads in use of a host or path key
+func (rm *ResourceManager) limitAndUse(key string, configured int64) (int64, int64) {
+	rm.RLock.Lock()
+	defer rm.RLock.Unlock()
+	inUse := rm.Paths[key]
+	if h, ok := rm.Hosts[key]; ok {
+		inUse = h
+	}
+	return rm.limit(key, configured), inUse
+}
+
+func (rm *ResourceManager) hostThreads(side, ip string) int64 {
+	rm.RLock.Lock()
+	defer rm.RLock.Unlock()
+	return rm.Hosts[hostKey(side, ip)]
+}
+
+func (rm *ResourceManager) pathThreads(side, ip, location string) int64 {
+	rm.RLock.Lock()
+	defer rm.RLock.Unlock()
+	return rm.Paths[pathKey(side, ip, location)]
+}
+
+// hasFree reports whether one more thread fits on the host and the path
+func (rm *ResourceManager) hasFree(side string, cmp Computer, p Path) bool {
+	rm.RLock.Lock()
+	defer rm.RLock.Unlock()
+	host, path := hostKey(side, cmp.Ip), pathKey(side, cmp.Ip, p.Location)
+	pathLimit := rm.effectiveLimit(path, p.SinglePathThreadLimit)
+	return rm.Hosts[host] < rm.effectiveLimit(host, int64(cmp.LimitThread)) &&
+		rm.Paths[path] < pathLimit && pathLeasesSingleton.free(cmp.Ip, p.Location, pathLimit)
+}
+
+// acquire takes a slot for the copy of t from its src path to the dst path,
+// either all four counters are taken or none of them
+func (rm *ResourceManager) acquire(t Operation, dstIp, dstPath string) (*Slot, error) {
+	slot := &Slot{
+		SrcIp:    t.getSrcIp(),
+		SrcPath:  strings.TrimRight(t.getSrcPath(), "/"),
+		DstIp:    dstIp,
+		DstPath:  strings.TrimRight(dstPath, "/"),
+		SectorID: t.getSectorID(),
+		Owner:    t,
+		Acquired: time.Now(),
+	}
+	srcComputersMapSingleton.CLock.Lock()
+	defer srcComputersMapSingleton.CLock.Unlock()
+	dstComputersMapSingleton.CLock.Lock()
+	defer dstComputersMapSingleton.CLock.Unlock()
+	srcCmp, ok := srcComputersMapSingleton.CMap[slot.SrcIp]
+	if !ok {
+		return nil, fmt.Errorf("src computer %s is not configured", slot.SrcIp)
+	}
+	srcP, ok := findPath(srcCmp, slot.SrcPath)
+	if !ok {
+		return nil, fmt.Errorf("src path %s of %s is not configured", slot.SrcPath, slot.SrcIp)
+	}
+	dstCmp, ok := dstComputersMapSingleton.CMap[dstIp]
+	if !ok {
+		return nil, fmt.Errorf("dst computer %s is not configured", dstIp)
+	}
+	dstP, ok := findPath(dstCmp, slot.DstPath)
+	if !ok {
+		return nil, fmt.Errorf("dst path %s of %s is not configured", slot.DstPath, dstIp)
+	}
+
+	rm.RLock.Lock()
+	defer rm.RLock.Unlock()
+	keys := []struct {
+		key   string
+		count map[string]int64
+		limit int64
+		ip    string
+		path  string // leased across jobs if set
+	}{
+		{hostKey(SideSrc, slot.SrcIp), rm.Hosts, int64(srcCmp.LimitThread), slot.SrcIp, ""},
+		{pathKey(SideSrc, slot.SrcIp, slot.SrcPath), rm.Paths, srcP.SinglePathThreadLimit, slot.SrcIp, slot.SrcPath},
+		{hostKey(SideDst, dstIp), rm.Hosts, int64(dstCmp.LimitThread), dstIp, ""},
+		{pathKey(SideDst, dstIp, slot.DstPath), rm.Paths, dstP.SinglePathThreadLimit, dstIp, slot.DstPath},
+	}
+	for i := range keys {
+		k := &keys[i]
+		k.limit = rm.effectiveLimit(k.key, k.limit)
+		if k.count[k.key] >= k.limit {
+			return nil, fmt.Errorf("no free thread on %s, %d of %d in use", k.key, k.count[k.key], k.limit)
+		}
+	}
+	for _, k := range keys {
+		if k.path == "" {
+			continue
+		}
+		lease, err := pathLeasesSingleton.take(k.ip, k.path, k.limit)
+		if err != nil {
+			log.Warnf("lease %s failed, not limited across jobs: %v", k.key, err)
+			continue
+		}
+		if lease == nil {
+			for _, l := range slot.leases {
+				pathLeasesSingleton.give(l)
+			}
+			return nil, fmt.Errorf("no free thread on %s, %d leased by all jobs", k.key, k.limit)
+		}
+		slot.leases = append(slot.leases, lease)
+	}
+	for _, k := range keys {
+		k.count[k.key]++
+	}
+	rm.Slots[slot] = struct{}{}
+	log.Debugf("slot acquired for %s: %s %s -> %s %s", slot.SectorID, slot.SrcIp, slot.SrcPath, dstIp, slot.DstPath)
+	return slot, nil
+}
+
+// release gives the threads of slot back, a slot is released only once
+func (rm *ResourceManager) release(slot *Slot) {
+	if slot == nil {
+		return
+	}
+	rm.RLock.Lock()
+	defer rm.RLock.Unlock()
+	if slot.released {
+		log.Errorf("slot of %s to %s %s released twice", slot.SectorID, slot.DstIp, slot.DstPath)
+		return
+	}
+	rm.releaseLocked(slot)
+}
+
+// releaseLocked must be called with RLock held on a slot not released yet
+func (rm *ResourceManager) releaseLocked(slot *Slot) {
+	slot.released = true
+	for _, l := range slot.leases {
+		pathLeasesSingleton.give(l)
+	}
+	delete(rm.Slots, slot)
+	rm.decrease(rm.Hosts, hostKey(SideSrc, slot.SrcIp))
+	rm.decrease(rm.Paths, pathKey(SideSrc, slot.SrcIp, slot.SrcPath))
+	rm.decrease(rm.Hosts, hostKey(SideDst, slot.DstIp))
+	rm.decrease(rm.Paths, pathKey(SideDst, slot.DstIp, slot.DstPath))
+	log.Debugf("slot released for %s: %s %s -> %s %s", slot.SectorID, slot.SrcIp, slot.SrcPath, slot.DstIp, slot.DstPath)
+}
+
+// exited marks that the goroutine copying through slot returned, the copy
+// released the slot before unless it leaked
+func (rm *ResourceManager) exited(slot *Slot) {
+	if slot == nil {
+		return
+	}
+	rm.RLock.Lock()
+	slot.exited = true
+	rm.RLock.Unlock()
+}
+
+// decrease must be called with RLock held
+func (rm *ResourceManager) decrease(count map[string]int64, key string) {
+	count[key]--
+	if count[key] < 0 {
+		log.Errorf("thread counter of %s went negative, reset to 0", key)
+		count[key] = 0
+	}
+	if count[key] == 0 {
+		delete(count, key)
+	}
+}
+
+// checkLeaks releases slots whose copy goroutine returned without releasing
+// them and rebuilds the counters from the held slots if they drifted. Slots of
+// copies still running are never touched, whatever the status of their task
+func (rm *ResourceManager) checkLeaks() int {
+	rm.RLock.Lock()
+	defer rm.RLock.Unlock()
+	leaked := 0
+	for slot := range rm.Slots {
+		if !slot.exited || slot.released {
+			continue
+		}
+		log.Errorf("slot of %s %s to %s %s leaked for %v, releasing it",
+			slot.SectorID, slot.Owner.getFileType(), slot.DstIp, slot.DstPath, time.Now().Sub(slot.Acquired))
+		rm.releaseLocked(slot)
+		leaked++
+	}
+
+	hosts := make(map[string]int64)
+	paths := make(map[string]int64)
+	for slot := range rm.Slots {
+		hosts[hostKey(SideSrc, slot.SrcIp)]++
+		paths[pathKey(SideSrc, slot.SrcIp, slot.SrcPath)]++
+		hosts[hostKey(SideDst, slot.DstIp)]++
+		paths[pathKey(SideDst, slot.DstIp, slot.DstPath)]++
+	}
+	if !sameCounts(hosts, rm.Hosts) || !sameCounts(paths, rm.Paths) {
+		log.Errorf("thread counters drifted from the held slots, rebuilt them")
+		rm.Hosts, rm.Paths = hosts, paths
+	}
+	return leaked
+}
+
+func sameCounts(a, b map[string]int64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		if b[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+type PathUsage struct {
+	Location string
+	InUse    int64
+	Limit    int64
+	Draining bool
+	Reserved uint64 // dst only, bytes in-flight copies will still write
+	Copies   int    // dst only, in-flight copies holding a reservation
+}
+
+type HostUsage struct {
+	Side     string
+	Ip       string
+	InUse    int64
+	Limit    int64
+	Draining bool
+	Paths    []PathUsage
+}
+
+type SlotInfo struct {
+	SectorID string
+	FileType string
+	SrcIp    string
+	SrcPath  string
+	DstIp    string
+	DstPath  string
+	Since    time.Duration
+}
+
+// ResourceSnapshot is the usage of every host and path at one moment
+type ResourceSnapshot struct {
+	Hosts []HostUsage
+	Slots []SlotInfo
+}
+
+// snapshot takes all the locks once, so limits, counters and slots agree
+func (rm *ResourceManager) snapshot() ResourceSnapshot {
+	srcComputersMapSingleton.CLock.Lock()
+	defer srcComputersMapSingleton.CLock.Unlock()
+	dstComputersMapSingleton.CLock.Lock()
+	defer dstComputersMapSingleton.CLock.Unlock()
+	rm.RLock.Lock()
+	defer rm.RLock.Unlock()
+	var snap ResourceSnapshot
+	for _, side := range []string{SideSrc, SideDst} {
+		cm := srcComputersMapSingleton.CMap
+		if side == SideDst {
+			cm = dstComputersMapSingleton.CMap
+		}
+		for ip, cmp := range cm {
+			h := HostUsage{
+				Side:     side,
+				Ip:       ip,
+				InUse:    rm.Hosts[hostKey(side, ip)],
+				Limit:    rm.effectiveLimit(hostKey(side, ip), int64(cmp.LimitThread)),
+				Draining: cmp.Draining,
+			}
+			for _, p := range cmp.Paths {
+				pu := PathUsage{
+					Location: p.Location,
+					InUse:    rm.Paths[pathKey(side, ip, p.Location)],
+					Limit:    rm.effectiveLimit(pathKey(side, ip, p.Location), p.SinglePathThreadLimit),
+					Draining: p.Draining,
+				}
+				if side == SideDst {
+					pu.Reserved = reservationLedgerSingleton.reserved(ip, p.Location)
+					pu.Copies = reservationLedgerSingleton.count(ip, p.Location)
+				}
+				h.Paths = append(h.Paths, pu)
+			}
+			snap.Hosts = append(snap.Hosts, h)
+		}
+	}
+	sort.Slice(snap.Hosts, func(i, j int) bool {
+		if snap.Hosts[i].Side != snap.Hosts[j].Side {
+			return snap.Hosts[i].Side > snap.Hosts[j].Side
+		}
+		return snap.Hosts[i].Ip < snap.Hosts[j].Ip
+	})
+	now := time.Now()
+	for slot := range rm.Slots {
+		snap.Slots = append(snap.Slots, SlotInfo{
+			SectorID: slot.SectorID,
+			FileType: string(slot.Owner.getFileType()),
+			SrcIp:    slot.SrcIp,
+			SrcPath:  slot.SrcPath,
+			DstIp:    slot.DstIp,
+			DstPath:  slot.DstPath,
+			Since:    now.Sub(slot.Acquired).Truncate(time.Second),
+		})
+	}
+	sort.Slice(snap.Slots, func(i, j int) bool {
+		return snap.Slots[i].Since > snap.Slots[j].Since
+	})
+	return snap
+}
+
+func (snap ResourceSnapshot) String() string {
+	var b strings.Builder
+	for _, h := range snap.Hosts {
+		fmt.Fprintf(&b, "%s computer %s: threads %d/%d", h.Side, h.Ip, h.InUse, h.Limit)
+		if h.Draining {
+			b.WriteString(" draining")
+		}
+		b.WriteString("\n")
+		for _, p := range h.Paths {
+			fmt.Fprintf(&b, "  path %s: threads %d/%d", p.Location, p.InUse, p.Limit)
+			if h.Side == SideDst {
+				fmt.Fprintf(&b, ", reserved %.1f GiB by %d copies", gib(p.Reserved), p.Copies)
+			}
+			if p.Draining {
+				b.WriteString(" draining")
+			}
+			b.WriteString("\n")
+		}
+	}
+	fmt.Fprintf(&b, "running copies: %d\n", len(snap.Slots))
+	for _, s := range snap.Slots {
+		fmt.Fprintf(&b, "  %s %s: %s %s -> %s %s, %v\n", s.SectorID, s.FileType, s.SrcIp, s.SrcPath, s.DstIp, s.DstPath, s.Since)
+	}
+	return b.String()
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+const (
+	testSrcIp = "10.0.0.1"
+	testDstIp = "10.0.0.2"
+)
+
+// setupResources configures one src and one dst computer with two paths
+// each and empties the resource manager, all restored when t ends
+func setupResources(t *testing.T, srcHost, srcPath, dstHost, dstPath int) {
+	t.Helper()
+	savedSrc, savedDst := srcComputersMapSingleton.CMap, dstComputersMapSingleton.CMap
+	savedRm, savedLeases := resourceManagerSingleton, pathLeasesSingleton
+	t.Cleanup(func() {
+		srcComputersMapSingleton.CMap, dstComputersMapSingleton.CMap = savedSrc, savedDst
+		resourceManagerSingleton, pathLeasesSingleton = savedRm, savedLeases
+	})
+	paths := func(limit int, locations ...string) []Path {
+		ps := make([]Path, 0, len(locations))
+		for _, l := range locations {
+			ps = append(ps, Path{Location: l, SinglePathThreadLimit: int64(limit)})
+		}
+		return ps
+	}
+	srcComputersMapSingleton.CMap = map[string]Computer{
+		testSrcIp: {Ip: testSrcIp, LimitThread: srcHost, Paths: paths(srcPath, "/src1", "/src2")},
+	}
+	dstComputersMapSingleton.CMap = map[string]Computer{
+		testDstIp: {Ip: testDstIp, LimitThread: dstHost, Paths: paths(dstPath, "/dst1", "/dst2")},
+	}
+	resourceManagerSingleton.Hosts = make(map[string]int64)
+	resourceManagerSingleton.Paths = make(map[string]int64)
+	resourceManagerSingleton.Slots = make(map[*Slot]struct{})
+	resourceManagerSingleton.Limits = make(map[string]int64)
+	pathLeasesSingleton.Dir = t.TempDir()
+	pathLeasesSingleton.JobID = "test"
+	pathLeasesSingleton.held = make(map[string]int64)
+	pathLeasesSingleton.busy = make(map[string]time.Time)
+	pathLeasesSingleton.files = make(map[*os.File]string)
+}
+
+func testTask(id, srcPath string) *SealedTask {
+	return &SealedTask{SectorID: SectorID{ID: id}, SrcIp: testSrcIp, OriSrc: srcPath}
+}
+
+func TestAcquire(t *testing.T) {
+	type copyTo struct {
+		src, dst string
+	}
+	cases := []struct {
+		name                               string
+		srcHost, srcPath, dstHost, dstPath int
+		limits                             map[string]int64 // tuned by the adaptive mode
+		copies                             []copyTo
+		acquired                           int
+	}{
+		{"all fit", 4, 2, 4, 2, nil, []copyTo{{"/src1", "/dst1"}, {"/src1", "/dst2"}, {"/src2", "/dst1"}}, 3},
+		{"src path limit", 4, 1, 4, 2, nil, []copyTo{{"/src1", "/dst1"}, {"/src1", "/dst2"}}, 1},
+		{"src host limit", 1, 2, 4, 2, nil, []copyTo{{"/src1", "/dst1"}, {"/src2", "/dst2"}}, 1},
+		{"dst path limit", 4, 2, 4, 1, nil, []copyTo{{"/src1", "/dst1"}, {"/src2", "/dst1"}, {"/src2", "/dst2"}}, 2},
+		{"dst host limit", 4, 2, 2, 2, nil, []copyTo{{"/src1", "/dst1"}, {"/src2", "/dst2"}, {"/src2", "/dst1"}}, 2},
+		{"tuned limit wins", 4, 2, 4, 2, map[string]int64{pathKey(SideDst, testDstIp, "/dst1"): 1}, []copyTo{{"/src1", "/dst1"}, {"/src2", "/dst1"}}, 1},
+		{"unconfigured src path", 4, 2, 4, 2, nil, []copyTo{{"/src3", "/dst1"}}, 0},
+		{"unconfigured dst path", 4, 2, 4, 2, nil, []copyTo{{"/src1", "/dst3"}}, 0},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			setupResources(t, c.srcHost, c.srcPath, c.dstHost, c.dstPath)
+			for k, v := range c.limits {
+				resourceManagerSingleton.Limits[k] = v
+			}
+			slots := make([]*Slot, 0)
+			for _, cp := range c.copies {
+				slot, err := resourceManagerSingleton.acquire(testTask("s-t01000-1", cp.src), testDstIp, cp.dst)
+				if err == nil {
+					slots = append(slots, slot)
+				}
+			}
+			if len(slots) != c.acquired {
+				t.Fatalf("acquired %d slots, want %d", len(slots), c.acquired)
+			}
+			// a refused acquire takes no counter and no lease
+			var srcThreads, dstThreads int64
+			for key, n := range resourceManagerSingleton.Hosts {
+				if key == hostKey(SideSrc, testSrcIp) {
+					srcThreads = n
+				} else {
+					dstThreads = n
+				}
+			}
+			if srcThreads != int64(c.acquired) || dstThreads != int64(c.acquired) {
+				t.Fatalf("host threads src %d dst %d, want %d", srcThreads, dstThreads, c.acquired)
+			}
+			if len(pathLeasesSingleton.files) != 2*c.acquired {
+				t.Fatalf("%d leases held, want %d", len(pathLeasesSingleton.files), 2*c.acquired)
+			}
+
+			for _, slot := range slots {
+				resourceManagerSingleton.release(slot)
+				// released twice is logged and ignored
+				resourceManagerSingleton.release(slot)
+			}
+			if len(resourceManagerSingleton.Hosts) != 0 || len(resourceManagerSingleton.Paths) != 0 ||
+				len(resourceManagerSingleton.Slots) != 0 || len(pathLeasesSingleton.files) != 0 || len(pathLeasesSingleton.held) != 0 {
+				t.Fatalf("left after release: %+v %+v %d slots %d leases", resourceManagerSingleton.Hosts,
+					resourceManagerSingleton.Paths, len(resourceManagerSingleton.Slots), len(pathLeasesSingleton.files))
+			}
+		})
+	}
+}
+
+func TestCheckLeaks(t *testing.T) {
+	cases := []struct {
+		name   string
+		exited []bool // whether the copy of each slot returned
+		drift  bool   // a counter was changed behind the slots
+		leaked int
+		held   int
+	}{
+		{"running copies are kept", []bool{false, false}, false, 0, 2},
+		{"returned without release", []bool{true, false}, false, 1, 1},
+		{"all leaked", []bool{true, true}, false, 2, 0},
+		{"drifted counters are rebuilt", []bool{false}, true, 0, 1},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			setupResources(t, 4, 4, 4, 4)
+			for i, exited := range c.exited {
+				slot, err := resourceManagerSingleton.acquire(testTask("s-t01000-1", "/src1"), testDstIp, "/dst1")
+				if err != nil {
+					t.Fatalf("slot %d: %v", i, err)
+				}
+				if exited {
+					resourceManagerSingleton.exited(slot)
+				}
+			}
+			if c.drift {
+				resourceManagerSingleton.Hosts[hostKey(SideDst, testDstIp)] += 3
+				resourceManagerSingleton.Paths[pathKey(SideSrc, testSrcIp, "/src2")] = 1
+			}
+			if leaked := resourceManagerSingleton.checkLeaks(); leaked != c.leaked {
+				t.Fatalf("released %d leaked slots, want %d", leaked, c.leaked)
+			}
+			if len(resourceManagerSingleton.Slots) != c.held {
+				t.Fatalf("%d slots held, want %d", len(resourceManagerSingleton.Slots), c.held)
+			}
+			want := map[string]int64{}
+			wantPaths := map[string]int64{}
+			if c.held > 0 {
+				want = map[string]int64{hostKey(SideSrc, testSrcIp): int64(c.held), hostKey(SideDst, testDstIp): int64(c.held)}
+				wantPaths = map[string]int64{pathKey(SideSrc, testSrcIp, "/src1"): int64(c.held), pathKey(SideDst, testDstIp, "/dst1"): int64(c.held)}
+			}
+			if !sameCounts(resourceManagerSingleton.Hosts, want) || !sameCounts(resourceManagerSingleton.Paths, wantPaths) {
+				t.Fatalf("counters %+v %+v, want %+v %+v", resourceManagerSingleton.Hosts, resourceManagerSingleton.Paths, want, wantPaths)
+			}
+			if len(pathLeasesSingleton.files) != 2*c.held {
+				t.Fatalf("%d leases held, want %d", len(pathLeasesSingleton.files), 2*c.held)
+			}
+		})
+	}
+}
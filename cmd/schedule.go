@@ -0,0 +1,240 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+// TimeWindow changes the rate and concurrency limits during some hours of
+// some weekdays, the first window matching the current time applies
+type TimeWindow struct {
+	Name             string
+	Days             []string // mon, tue, wed, thu, fri, sat or sun, empty means every day
+	Start            string   // HH:MM
+	End              string   // HH:MM, not after Start means the window ends the next day
+	SingleThreadMBPS int      // rate of one thread in the window, default to singlethreadmbps
+	BandWidthPercent int      // part of the bandwidth of every computer to use, default 100
+	MaxPathThreads   int64    // cap of singlepaththreadlimit of every path, 0 means no cap
+	NoNewTasks       bool     // running copies finish but no new one starts
+
+	start, end int // minutes of the day
+	days       map[time.Weekday]struct{}
+}
+
+func parseClock(s string) (int, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("wrong time %s, should be HH:MM", s)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+func checkSchedule(windows []TimeWindow) error {
+	for i := range windows {
+		w := &windows[i]
+		if w.Name == "" {
+			w.Name = fmt.Sprintf("%s-%s", w.Start, w.End)
+		}
+		var err error
+		if w.start, err = parseClock(w.Start); err != nil {
+			return fmt.Errorf("schedule %s: %v", w.Name, err)
+		}
+		if w.end, err = parseClock(w.End); err != nil {
+			return fmt.Errorf("schedule %s: %v", w.Name, err)
+		}
+		w.days = make(map[time.Weekday]struct{})
+		for _, d := range w.Days {
+			d3 := strings.ToLower(d)
+			if len(d3) > 3 {
+				d3 = d3[:3]
+			}
+			wd, ok := weekdays[d3]
+			if !ok {
+				return fmt.Errorf("schedule %s: unknown day %s", w.Name, d)
+			}
+			w.days[wd] = struct{}{}
+		}
+		if w.SingleThreadMBPS < 0 || w.MaxPathThreads < 0 || w.BandWidthPercent < 0 || w.BandWidthPercent > 100 {
+			return fmt.Errorf("schedule %s: singlethreadmbps and maxpaththreads should not be negative, bandwidthpercent should be in [0,100]", w.Name)
+		}
+		if w.BandWidthPercent == 0 {
+			w.BandWidthPercent = 100
+		}
+	}
+	return nil
+}
+
+func (w *TimeWindow) onDay(d time.Weekday) bool {
+	if len(w.days) == 0 {
+		return true
+	}
+	_, ok := w.days[d]
+	return ok
+}
+
+// active reports whether now is in the window, the days are the days the window starts
+func (w *TimeWindow) active(now time.Time) bool {
+	m := now.Hour()*60 + now.Minute()
+	if w.start < w.end {
+		return w.onDay(now.Weekday()) && m >= w.start && m < w.end
+	}
+	yesterday := now.AddDate(0, 0, -1).Weekday()
+	return (w.onDay(now.Weekday()) && m >= w.start) || (w.onDay(yesterday) && m < w.end)
+}
+
+func activeWindow(windows []TimeWindow, now time.Time) *TimeWindow {
+	for i := range windows {
+		if windows[i].active(now) {
+			return &windows[i]
+		}
+	}
+	return nil
+}
+
+// Schedule keeps the window in force and the limits it sets
+type Schedule struct {
+	Window           string // name of the active window, empty outside all windows
+	SingleThreadMBPS int
+	NoNewTasks       bool
+	SLock            *sync.Mutex
+}
+
+var scheduleSingleton = Schedule{
+	SLock: new(sync.Mutex),
+}
+
+// WindowLimits are the limits in force at some time, the configured values
+// outside all windows
+type WindowLimits struct {
+	Name             string
+	SingleThreadMBPS int
+	BandWidthPercent int
+	MaxPathThreads   int64
+	NoNewTasks       bool
+}
+
+func limitsAt(cfg *Config, at time.Time) WindowLimits {
+	l := WindowLimits{SingleThreadMBPS: cfg.SingleThreadMBPS, BandWidthPercent: 100}
+	if w := activeWindow(cfg.Schedule, at); w != nil {
+		if w.SingleThreadMBPS > 0 {
+			l.SingleThreadMBPS = w.SingleThreadMBPS
+		}
+		l.Name, l.BandWidthPercent, l.MaxPathThreads, l.NoNewTasks = w.Name, w.BandWidthPercent, w.MaxPathThreads, w.NoNewTasks
+	}
+	return l
+}
+
+// nextLimitsChange returns the first minute after at whose limits differ from
+// the ones at at, false if none does within a week
+func nextLimitsChange(cfg *Config, at time.Time) (time.Time, bool) {
+	if len(cfg.Schedule) == 0 {
+		return time.Time{}, false
+	}
+	cur := limitsAt(cfg, at)
+	t := at.Truncate(time.Minute)
+	for end := at.AddDate(0, 0, 7); t.Before(end); {
+		t = t.Add(time.Minute)
+		if limitsAt(cfg, t) != cur {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// apply writes the limits of the window active now into the computers maps,
+// the configured values of cfg apply outside all windows
+func (s *Schedule) apply(config *Config) {
+	cfg := config.snapshot()
+	l := limitsAt(&cfg, time.Now())
+	mbps, percent, pathCap, noNew, name := l.SingleThreadMBPS, l.BandWidthPercent, l.MaxPathThreads, l.NoNewTasks, l.Name
+	s.SLock.Lock()
+	changed := s.Window != name || s.SingleThreadMBPS != mbps || s.NoNewTasks != noNew
+	s.Window, s.SingleThreadMBPS, s.NoNewTasks = name, mbps, noNew
+	s.SLock.Unlock()
+
+	applyWindowLimits(&srcComputersMapSingleton, SideSrc, cfg.SrcComputers, mbps, percent, pathCap)
+	applyWindowLimits(&dstComputersMapSingleton, SideDst, cfg.DstComputers, mbps, percent, pathCap)
+	if changed {
+		if name == "" {
+			log.Infof("schedule: no window active, %d MB/s per thread", mbps)
+		} else {
+			log.Infof("schedule: window %s active, %d MB/s per thread, %d%% bandwidth, path threads cap %d, no new tasks %v",
+				name, mbps, percent, pathCap, noNew)
+		}
+		schedulerSingleton.notify()
+	}
+}
+
+// applyWindowLimits sets the limits of the window on the computers map, the
+// adaptive limits above them are lowered to them
+func applyWindowLimits(cm *ComputersMap, side string, computers []Computer, mbps, percent int, pathCap int64) {
+	cm.CLock.Lock()
+	defer cm.CLock.Unlock()
+	for _, c := range computers {
+		cmp, ok := cm.CMap[c.Ip]
+		if !ok {
+			continue
+		}
+		cmp.LimitThread = calThreadLimit(c.BandWidth*percent/100, mbps)
+		if cmp.LimitThread < 1 {
+			cmp.LimitThread = 1
+		}
+		resourceManagerSingleton.capLimit(hostKey(side, c.Ip), int64(cmp.LimitThread))
+		for idx, p := range cmp.Paths {
+			if cp, ok := findPath(c, p.Location); ok {
+				p.SinglePathThreadLimit = cp.SinglePathThreadLimit
+				if pathCap > 0 && p.SinglePathThreadLimit > pathCap {
+					p.SinglePathThreadLimit = pathCap
+				}
+				resourceManagerSingleton.capLimit(pathKey(side, c.Ip, p.Location), p.SinglePathThreadLimit)
+				cmp.Paths[idx] = p
+			}
+		}
+		cm.CMap[c.Ip] = cmp
+	}
+}
+
+// singleThreadMBPS is the rate of one thread in force now
+func (s *Schedule) singleThreadMBPS() int {
+	s.SLock.Lock()
+	defer s.SLock.Unlock()
+	return s.SingleThreadMBPS
+}
+
+// window is the name of the active window, empty outside all windows
+func (s *Schedule) window() string {
+	s.SLock.Lock()
+	defer s.SLock.Unlock()
+	return s.Window
+}
+
+func (s *Schedule) noNewTasks() bool {
+	s.SLock.Lock()
+	defer s.SLock.Unlock()
+	return s.NoNewTasks
+}
+
+// run applies the schedule at every minute until the process exits
+func (s *Schedule) run(cfg *Config) {
+	for !stop {
+		s.apply(cfg)
+		now := time.Now()
+		time.Sleep(now.Truncate(time.Minute).Add(time.Minute).Sub(now))
+	}
+}
+
+func (s *Schedule) String() string {
+	s.SLock.Lock()
+	defer s.SLock.Unlock()
+	if s.Window == "" {
+		return fmt.Sprintf("schedule: no window active, %d MB/s per thread\n", s.SingleThreadMBPS)
+	}
+	return fmt.Sprintf("schedule: window %s active, %d MB/s per thread, no new tasks %v\n", s.Window, s.SingleThreadMBPS, s.NoNewTasks)
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// at is a time of the week from Sunday 2026-10-18 to Saturday 2026-10-24
+func at(day time.Weekday, clock string) time.Time {
+	c, err := time.Parse("15:04", clock)
+	if err != nil {
+		panic(err)
+	}
+	return time.Date(2026, 10, 19+int(day-time.Monday), c.Hour(), c.Minute(), 0, 0, time.UTC)
+}
+
+func TestTimeWindowActive(t *testing.T) {
+	cases := []struct {
+		name   string
+		window TimeWindow
+		at     time.Time
+		want   bool
+	}{
+		{"inside a day window", TimeWindow{Start: "09:00", End: "18:00"}, at(time.Tuesday, "09:00"), true},
+		{"end is not in the window", TimeWindow{Start: "09:00", End: "18:00"}, at(time.Tuesday, "18:00"), false},
+		{"before a day window", TimeWindow{Start: "09:00", End: "18:00"}, at(time.Tuesday, "08:59"), false},
+		{"weekday listed", TimeWindow{Days: []string{"Mon", "tuesday"}, Start: "09:00", End: "18:00"}, at(time.Tuesday, "12:00"), true},
+		{"weekday not listed", TimeWindow{Days: []string{"mon", "tue"}, Start: "09:00", End: "18:00"}, at(time.Wednesday, "12:00"), false},
+		{"night window before midnight", TimeWindow{Start: "22:00", End: "06:00"}, at(time.Monday, "23:30"), true},
+		{"night window after midnight", TimeWindow{Start: "22:00", End: "06:00"}, at(time.Tuesday, "05:59"), true},
+		{"night window during the day", TimeWindow{Start: "22:00", End: "06:00"}, at(time.Tuesday, "12:00"), false},
+		// the days are the days a window starts
+		{"friday night goes on on saturday", TimeWindow{Days: []string{"fri"}, Start: "22:00", End: "06:00"}, at(time.Saturday, "03:00"), true},
+		{"friday night does not start on saturday", TimeWindow{Days: []string{"fri"}, Start: "22:00", End: "06:00"}, at(time.Saturday, "23:00"), false},
+		{"sunday night goes on on monday", TimeWindow{Days: []string{"sun"}, Start: "22:00", End: "06:00"}, at(time.Monday, "01:00"), true},
+		{"thursday night is over on saturday", TimeWindow{Days: []string{"thu"}, Start: "22:00", End: "06:00"}, at(time.Saturday, "01:00"), false},
+		// start == end is a whole day from start
+		{"whole day window at start", TimeWindow{Days: []string{"mon"}, Start: "08:00", End: "08:00"}, at(time.Monday, "08:00"), true},
+		{"whole day window the next morning", TimeWindow{Days: []string{"mon"}, Start: "08:00", End: "08:00"}, at(time.Tuesday, "07:59"), true},
+		{"whole day window is over", TimeWindow{Days: []string{"mon"}, Start: "08:00", End: "08:00"}, at(time.Tuesday, "08:00"), false},
+		{"whole day window not started", TimeWindow{Days: []string{"mon"}, Start: "08:00", End: "08:00"}, at(time.Monday, "07:59"), false},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			windows := []TimeWindow{c.window}
+			if err := checkSchedule(windows); err != nil {
+				t.Fatal(err)
+			}
+			if got := windows[0].active(c.at); got != c.want {
+				t.Fatalf("active at %v: %v, want %v", c.at, got, c.want)
+			}
+		})
+	}
+}
+
+func TestCheckSchedule(t *testing.T) {
+	cases := []struct {
+		name   string
+		window TimeWindow
+		err    bool
+	}{
+		{"valid", TimeWindow{Days: []string{"Sat", "sunday"}, Start: "00:00", End: "23:59", BandWidthPercent: 50}, false},
+		{"wrong time", TimeWindow{Start: "25:00", End: "06:00"}, true},
+		{"unknown day", TimeWindow{Days: []string{"someday"}, Start: "22:00", End: "06:00"}, true},
+		{"bandwidth above 100", TimeWindow{Start: "22:00", End: "06:00", BandWidthPercent: 120}, true},
+		{"negative path cap", TimeWindow{Start: "22:00", End: "06:00", MaxPathThreads: -1}, true},
+	}
+	for _, c := range cases {
+		if err := checkSchedule([]TimeWindow{c.window}); (err != nil) != c.err {
+			t.Errorf("%s: error %v, want error %v", c.name, err, c.err)
+		}
+	}
+}
+
+func TestNextLimitsChange(t *testing.T) {
+	night := TimeWindow{Name: "night", Start: "22:00", End: "06:00", SingleThreadMBPS: 200}
+	weekend := TimeWindow{Name: "weekend", Days: []string{"sat", "sun"}, Start: "00:00", End: "00:00", NoNewTasks: true}
+	// the same limits as outside all windows, the window in force still changes
+	same := TimeWindow{Name: "same", Start: "12:00", End: "13:00"}
+	cases := []struct {
+		name    string
+		windows []TimeWindow
+		at      time.Time
+		want    time.Time
+		ok      bool
+	}{
+		{"no schedule", nil, at(time.Monday, "12:00"), time.Time{}, false},
+		{"window starts", []TimeWindow{night}, at(time.Monday, "12:00"), at(time.Monday, "22:00"), true},
+		{"window ends after midnight", []TimeWindow{night}, at(time.Monday, "23:00"), at(time.Tuesday, "06:00"), true},
+		{"seconds are ignored", []TimeWindow{night}, at(time.Monday, "21:59").Add(30 * time.Second), at(time.Monday, "22:00"), true},
+		{"weekly window", []TimeWindow{weekend}, at(time.Wednesday, "10:00"), at(time.Saturday, "00:00"), true},
+		{"whole day windows of two days end once", []TimeWindow{weekend}, at(time.Saturday, "10:00"), at(time.Monday, "00:00").AddDate(0, 0, 7), true},
+		{"the first window applies", []TimeWindow{weekend, night}, at(time.Friday, "23:00"), at(time.Saturday, "00:00"), true},
+		{"a window with the same limits", []TimeWindow{same}, at(time.Monday, "10:00"), at(time.Monday, "12:00"), true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			cfg := &Config{SingleThreadMBPS: 100, Schedule: c.windows}
+			if err := checkSchedule(cfg.Schedule); err != nil {
+				t.Fatal(err)
+			}
+			got, ok := nextLimitsChange(cfg, c.at)
+			if ok != c.ok || !got.Equal(c.want) {
+				t.Fatalf("next change %v %v, want %v %v", got, ok, c.want, c.ok)
+			}
+		})
+	}
+}
+
+func TestApplyWindowLimits(t *testing.T) {
+	setupResources(t, 8, 8, 8, 8)
+	host, path := hostKey(SideDst, testDstIp), pathKey(SideDst, testDstIp, "/dst1")
+	other := pathKey(SideDst, testDstIp, "/dst2")
+	// tuned by the adaptive mode above what the window allows, or below it
+	resourceManagerSingleton.Limits[host] = 8
+	resourceManagerSingleton.Limits[path] = 6
+	resourceManagerSingleton.Limits[other] = 1
+	configured := []Computer{{Ip: testDstIp, BandWidth: 1000, Paths: []Path{
+		{Location: "/dst1", SinglePathThreadLimit: 8},
+		{Location: "/dst2", SinglePathThreadLimit: 8},
+	}}}
+	applyWindowLimits(&dstComputersMapSingleton, SideDst, configured, 100, 50, 2)
+
+	cmp := dstComputersMapSingleton.CMap[testDstIp]
+	if cmp.LimitThread != 5 {
+		t.Fatalf("host limit %d, want 5 of 50%% of 1000 MB/s at 100 MB/s", cmp.LimitThread)
+	}
+	for _, p := range cmp.Paths {
+		if p.SinglePathThreadLimit != 2 {
+			t.Fatalf("path %s limit %d, want the cap 2", p.Location, p.SinglePathThreadLimit)
+		}
+	}
+	want := map[string]int64{host: 5, path: 2, other: 1}
+	for key, limit := range want {
+		if got := resourceManagerSingleton.Limits[key]; got != limit {
+			t.Fatalf("tuned limit of %s %d, want %d", key, got, limit)
+		}
+	}
+}
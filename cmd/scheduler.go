@@ -0,0 +1,341 @@
+package main
+
+import (
+	"fmt"
+	"move_sectors/move_common"
+	"sync"
+	"time"
+)
+
+// recheck waiting tasks at least this often, dst paths may get free space
+// without any task of ours finishing
+const schedulerRecheckInterval = time.Second * 30
+
+// Scheduler keeps the waiting tasks in a ready queue and dispatches them as
+// soon as a task finishes, a thread is freed or the recheck interval passes
+type Scheduler struct {
+	Ready    []Operation
+	Queued   map[Operation]struct{} // tasks in Ready or in the dispatch pass
+	Running  int
+	Scanning int       // scans of paths added by a reload still making tasks
+	Held     bool      // set by the hold command, running copies finish but no new one starts
+	Stopping bool      // set by stop --graceful, exit once running copies finish
+	NextDue  time.Time // the earliest failed task backing off in Ready
+	SLock    *sync.Mutex
+	wake     chan struct{}
+}
+
+var schedulerSingleton = Scheduler{
+	Ready:  make([]Operation, 0),
+	Queued: make(map[Operation]struct{}),
+	SLock:  new(sync.Mutex),
+	wake:   make(chan struct{}, 1),
+}
+
+// notify wakes the scheduler up, never blocks
+func (s *Scheduler) notify() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (s *Scheduler) push(ops ...Operation) {
+	s.SLock.Lock()
+	for _, op := range ops {
+		if _, ok := s.Queued[op]; ok {
+			continue
+		}
+		s.Queued[op] = struct{}{}
+		s.Ready = append(s.Ready, op)
+	}
+	s.SLock.Unlock()
+	s.notify()
+}
+
+func (s *Scheduler) notDoneNum() int {
+	s.SLock.Lock()
+	defer s.SLock.Unlock()
+	return len(s.Ready) + s.Running + s.Scanning
+}
+
+func (s *Scheduler) addScanning(n int) {
+	s.SLock.Lock()
+	s.Scanning += n
+	s.SLock.Unlock()
+	s.notify()
+}
+
+// drop removes the waiting tasks matched by fn, returns the removed num
+func (s *Scheduler) drop(fn func(op Operation) bool) int {
+	s.SLock.Lock()
+	defer s.SLock.Unlock()
+	remain := make([]Operation, 0, len(s.Ready))
+	for _, op := range s.Ready {
+		if !fn(op) {
+			remain = append(remain, op)
+		} else {
+			delete(s.Queued, op)
+		}
+	}
+	dropped := len(s.Ready) - len(remain)
+	s.Ready = remain
+	return dropped
+}
+
+func (s *Scheduler) setHeld(held bool) {
+	s.SLock.Lock()
+	s.Held = held
+	s.SLock.Unlock()
+	s.notify()
+}
+
+func (s *Scheduler) stopGracefully() {
+	s.SLock.Lock()
+	s.Stopping = true
+	s.SLock.Unlock()
+	s.notify()
+}
+
+// paused reports whether new tasks may not be started now
+func (s *Scheduler) paused() bool {
+	s.SLock.Lock()
+	defer s.SLock.Unlock()
+	return s.Held || s.Stopping || scheduleSingleton.noNewTasks()
+}
+
+func (s *Scheduler) runningNum() int {
+	s.SLock.Lock()
+	defer s.SLock.Unlock()
+	return s.Running
+}
+
+// hasFreeDstThread is a cheap check to end a dispatch pass early
+func hasFreeDstThread() bool {
+	dstComputersMapSingleton.CLock.Lock()
+	defer dstComputersMapSingleton.CLock.Unlock()
+	for _, cmp := range dstComputersMapSingleton.CMap {
+		if resourceManagerSingleton.hostThreads(SideDst, cmp.Ip) < int64(cmp.LimitThread) {
+			return true
+		}
+	}
+	return false
+}
+
+// dispatch walks the ready queue once and starts every task that can run now
+func (s *Scheduler) dispatch(cfg *Config) {
+	if s.paused() {
+		return
+	}
+	s.SLock.Lock()
+	ready := s.Ready
+	s.Ready = make([]Operation, 0, len(ready))
+	s.SLock.Unlock()
+	if sectorPrioritiesSingleton.reloadIfChanged() {
+		sectorPrioritiesSingleton.applyPriorities(ready)
+	}
+	// always try the highest priority runnable task first
+	sortByPriority(ready, cfg.snapshot().PriorityRules)
+
+	remain := make([]Operation, 0, len(ready))
+	var nextDue time.Time
+	sealedWaiting := waitingSealedSectors(ready)
+	queues := groupBySource(ready)
+	for {
+		q := fairShareSingleton.nextQueue(queues)
+		if q == nil {
+			break
+		}
+		if stop || !hasFreeDstThread() {
+			break
+		}
+		t := q.ops[0]
+		// cancelled or skipped by a control command
+		if t.getStatus() != StatusOnWaiting {
+			q.ops = q.ops[1:]
+			s.unqueue(t)
+			continue
+		}
+		// failed lately, backing off
+		if due := taskControlSingleton.notBefore(t); time.Now().Before(due) {
+			q.ops = q.ops[1:]
+			remain = append(remain, t)
+			if nextDue.IsZero() || due.Before(nextDue) {
+				nextDue = due
+			}
+			continue
+		}
+		// the source path or host is full, none of its tasks could run
+		if !t.canDo() {
+			q.blocked = true
+			continue
+		}
+		q.ops = q.ops[1:]
+		// a cache goes after its sealed file, to the group dir the sealed one chose
+		if _, ok := sealedWaiting[t.getSectorID()]; ok && t.getFileType() == move_common.Cache {
+			remain = append(remain, t)
+			continue
+		}
+		// get one best dst
+		dst, dstIp, err := taskControlSingleton.getBestDst(t)
+		if err != nil {
+			if e := err.Error(); e == move_common.NoDstSuitableForNow || e == move_common.GroupDirFull {
+				log.Debug(err.Error())
+			} else if e != move_common.FondGroupButTooMuchThread {
+				log.Warn(err)
+			}
+			remain = append(remain, t)
+			continue
+		}
+		if err = s.start(cfg, t, dst, dstIp); err != nil {
+			log.Warn(err)
+			remain = append(remain, t)
+			continue
+		}
+		fairShareSingleton.served(q.ip, q.location, t.getTotalSize())
+		if t.getFileType() == move_common.Sealed {
+			delete(sealedWaiting, t.getSectorID())
+		}
+	}
+	for _, q := range queues {
+		remain = append(remain, q.ops...)
+	}
+
+	s.SLock.Lock()
+	s.Ready = append(remain, s.Ready...)
+	s.NextDue = nextDue
+	s.SLock.Unlock()
+}
+
+// waitingSealedSectors returns the sectors whose sealed file is still waiting in ops
+func waitingSealedSectors(ops []Operation) map[string]struct{} {
+	sectors := make(map[string]struct{})
+	for _, op := range ops {
+		if op.getFileType() == move_common.Sealed && op.getStatus() == StatusOnWaiting {
+			sectors[op.getSectorID()] = struct{}{}
+		}
+	}
+	return sectors
+}
+
+func (s *Scheduler) unqueue(t Operation) {
+	s.SLock.Lock()
+	delete(s.Queued, t)
+	s.SLock.Unlock()
+}
+
+// start takes the threads of t and runs its copy, an error leaves t waiting
+func (s *Scheduler) start(cfg *Config, t Operation, dst, dstIp string) error {
+	slot, err := resourceManagerSingleton.acquire(t, dstIp, dst)
+	if err != nil {
+		return err
+	}
+	if err := placementMapSingleton.assign(t.getSectorID(), t.getFileType(), dstIp, dst); err != nil {
+		resourceManagerSingleton.release(slot)
+		return fmt.Errorf("record placement of %s failed: %v", t.getSectorID(), err)
+	}
+	s.unqueue(t)
+	run := &CopyRun{
+		SectorID: t.getSectorID(),
+		DstIp:    dstIp,
+		DstPath:  dst,
+		Size:     t.getTotalSize(),
+		slot:     slot,
+	}
+	if !taskControlSingleton.newRun(t, run) {
+		resourceManagerSingleton.release(slot)
+		unassign(t, dstIp, dst)
+		return nil
+	}
+	t.fullInfo(dst, dstIp)
+	if journalSingleton.placed(t, dstIp, dst) {
+		check := cfg.snapshot().ExistCheck
+		opt := check.hashOption()
+		run.resume = &opt
+	}
+	reservationLedgerSingleton.reserve(run)
+	s.SLock.Lock()
+	s.Running++
+	s.SLock.Unlock()
+	go func() {
+		idleIOIfNeed(cfg)
+		t.startCopy(cfg, run)
+		resourceManagerSingleton.exited(slot)
+		taskControlSingleton.finishRun(t, run, cfg.snapshot().MaxRetries)
+		journalSingleton.finished(t, run)
+		historySingleton.finished(t, run, cfg)
+		if t.getStatus() == StatusDone {
+			capacityUsageSingleton.add(run)
+			throughputSingleton.record(run)
+		} else if !run.keepPartial() {
+			// failed or cancelled, nothing of t stays on the dst path; a
+			// stopped copy keeps it to resume there
+			unassign(t, dstIp, dst)
+		}
+		reservationLedgerSingleton.release(run)
+		s.finish(t)
+	}()
+	return nil
+}
+
+// unassign rolls back the placement of t to the dst path
+func unassign(t Operation, dstIp, dst string) {
+	if err := placementMapSingleton.unassign(t.getSectorID(), t.getFileType(), dstIp, dst); err != nil {
+		log.Warnf("roll back placement of %s failed: %v", t.getSectorID(), err)
+	}
+}
+
+// finish puts failed tasks back to the ready queue and wakes the scheduler,
+// dispatch leaves them there until their backoff passed
+func (s *Scheduler) finish(t Operation) {
+	s.SLock.Lock()
+	s.Running--
+	if _, ok := s.Queued[t]; !ok && t.getStatus() == StatusOnWaiting {
+		s.Queued[t] = struct{}{}
+		s.Ready = append(s.Ready, t)
+	}
+	s.SLock.Unlock()
+	s.notify()
+}
+
+func (s *Scheduler) run(cfg *Config) {
+	since := time.Now()
+	for {
+		if stop {
+			log.Warn(move_common.StoppedBySyscall)
+			waitingForAllTaskStop()
+			return
+		}
+		if s.paused() && s.runningNum() == 0 {
+			s.SLock.Lock()
+			stopping, waiting := s.Stopping, len(s.Ready)
+			s.SLock.Unlock()
+			if stopping {
+				log.Warnf("stopped gracefully, %d waiting tasks not started", waiting)
+				return
+			}
+		}
+		if leaked := resourceManagerSingleton.checkLeaks(); leaked > 0 {
+			log.Warnf("%d leaked slots released", leaked)
+		}
+		s.dispatch(cfg)
+		if s.notDoneNum() == 0 {
+			break
+		}
+		if time.Now().Sub(since) > time.Minute*5 {
+			since = time.Now()
+			printDetail()
+		}
+		wait := schedulerRecheckInterval
+		s.SLock.Lock()
+		if !s.NextDue.IsZero() && time.Until(s.NextDue) < wait {
+			wait = time.Until(s.NextDue)
+		}
+		s.SLock.Unlock()
+		select {
+		case <-s.wake:
+		case <-time.After(wait):
+		}
+	}
+	log.Infof("all task done for %s file", fileTypesString(fileTypes))
+}
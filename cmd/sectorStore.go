@@ -0,0 +1,271 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/urfave/cli/v2"
+	"move_sectors/mv_utils"
+	"os"
+	"strings"
+	"sync"
+)
+
+// PathStore is the lotus metadata of a dst path and what its files took on
+// disk when it was loaded, copies finished since are counted by capacity usage
+type PathStore struct {
+	Meta   *mv_utils.LocalStorageMeta // nil if the path has no sectorstore.json
+	Used   int64
+	Copied int64 // capacity usage of the path at load, in Used already
+}
+
+// SectorStores honours the sectorstore.json of the dst paths like lotus:
+// paths which can not store or weigh 0 (readonly) are skipped, MaxStorage is
+// kept and the weight is taken by the weighted policy if the config sets none
+type SectorStores struct {
+	Paths  map[string]*PathStore // dstPathKey -> store
+	SSLock *sync.Mutex
+}
+
+var sectorStoreSingleton = SectorStores{
+	Paths:  make(map[string]*PathStore),
+	SSLock: new(sync.Mutex),
+}
+
+// load reads the metadata of every path of cfg and warns what lotus would
+// not do with them, used at start and on reload
+func (ss *SectorStores) load(config *Config) {
+	cfg := config.snapshot()
+	ids := make(map[string]string)
+	checkID := func(side, ip, location string, meta *mv_utils.LocalStorageMeta) {
+		where := side + " " + ip + ":" + location
+		if other, ok := ids[meta.ID]; ok {
+			log.Warnf("%s has the storage id %s of %s, lotus refuses to attach both", where, meta.ID, other)
+		}
+		ids[meta.ID] = where
+	}
+
+	srcAllowTo := make(map[string][]string)
+	for _, cmp := range cfg.SrcComputers {
+		for _, p := range cmp.Paths {
+			meta, err := mv_utils.ReadSectorStore(p.Location)
+			if err != nil {
+				if !os.IsNotExist(err) {
+					log.Warnf("src %s %s: %v", cmp.Ip, p.Location, err)
+				}
+				continue
+			}
+			checkID(SideSrc, cmp.Ip, p.Location, meta)
+			if len(meta.AllowTo) > 0 {
+				srcAllowTo[cmp.Ip+":"+p.Location] = meta.AllowTo
+			}
+		}
+	}
+
+	paths := make(map[string]*PathStore)
+	for _, cmp := range cfg.DstComputers {
+		for _, p := range cmp.Paths {
+			key := dstPathKey(cmp.Ip, p.Location)
+			meta, err := mv_utils.ReadSectorStore(p.Location)
+			if err != nil {
+				if os.IsNotExist(err) {
+					log.Warnf("dst %s %s has no %s, lotus will not find the sectors copied there, run init-dst to create it",
+						cmp.Ip, p.Location, mv_utils.SectorStoreFile)
+				} else {
+					log.Warnf("dst %s %s: %v", cmp.Ip, p.Location, err)
+				}
+				paths[key] = &PathStore{}
+				continue
+			}
+			checkID(SideDst, cmp.Ip, p.Location, meta)
+			if !meta.CanStore {
+				log.Warnf("dst %s %s can not store by its %s, no sector will be copied there", cmp.Ip, p.Location, mv_utils.SectorStoreFile)
+			} else if meta.Weight == 0 {
+				log.Warnf("dst %s %s has weight 0 in its %s, lotus takes it as readonly, no sector will be copied there",
+					cmp.Ip, p.Location, mv_utils.SectorStoreFile)
+			}
+			for src, allowTo := range srcAllowTo {
+				if !groupsIntersect(meta.Groups, allowTo) {
+					log.Warnf("src %s only allows moving to groups %v, dst %s %s is in %v", src, allowTo, cmp.Ip, p.Location, meta.Groups)
+				}
+			}
+			store := &PathStore{Meta: meta}
+			ss.SSLock.Lock()
+			old, ok := ss.Paths[key]
+			ss.SSLock.Unlock()
+			if ok && old.Meta != nil {
+				// what this process copied since is in the capacity usage already
+				store.Used, store.Copied = old.Used, old.Copied
+			} else if meta.MaxStorage > 0 {
+				store.Copied = capacityUsageSingleton.copied(cmp.Ip, p.Location)
+				if store.Used, err = mv_utils.DiskUsage(p.Location); err != nil {
+					log.Warnf("disk usage of dst %s %s: %v", cmp.Ip, p.Location, err)
+				}
+			}
+			paths[key] = store
+		}
+	}
+	ss.SSLock.Lock()
+	ss.Paths = paths
+	ss.SSLock.Unlock()
+}
+
+func groupsIntersect(a, b []string) bool {
+	for _, x := range a {
+		for _, y := range b {
+			if x == y {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (ss *SectorStores) get(ip, location string) *PathStore {
+	ss.SSLock.Lock()
+	defer ss.SSLock.Unlock()
+	return ss.Paths[dstPathKey(ip, location)]
+}
+
+// limits returns whether the path can store and is not readonly, its MaxStorage and the bytes
+// used at load but not by the copies capacity usage counts
+func (ss *SectorStores) limits(ip, location string) (bool, int64, int64) {
+	store := ss.get(ip, location)
+	if store == nil || store.Meta == nil {
+		return true, 0, 0
+	}
+	return store.Meta.CanStore && store.Meta.Weight > 0, int64(store.Meta.MaxStorage), store.Used - store.Copied
+}
+
+// allows reports whether size more bytes may go to the path by its metadata
+func (ss *SectorStores) allows(ip, location string, size int64) bool {
+	canStore, maxStorage, used := ss.limits(ip, location)
+	if !canStore {
+		return false
+	}
+	if maxStorage > 0 {
+		copied, _ := capacityUsageSingleton.used(ip, location)
+		if used+copied+size > maxStorage {
+			log.Debugf("dst %s %s reached MaxStorage %d of its %s", ip, location, maxStorage, mv_utils.SectorStoreFile)
+			return false
+		}
+	}
+	return true
+}
+
+// weight is the lotus weight of the path, 0 if it has no metadata
+func (ss *SectorStores) weight(ip, location string) int {
+	store := ss.get(ip, location)
+	if store == nil || store.Meta == nil {
+		return 0
+	}
+	return int(store.Meta.Weight)
+}
+
+// pathWeight is the weight of a dst path for the weighted policy: the
+// config first, then sectorstore.json, default to 1. A readonly path of
+// weight 0 in sectorstore.json never gets here, allows refuses it
+func pathWeight(ip string, p Path) int {
+	if p.Weight > 0 {
+		return p.Weight
+	}
+	if w := sectorStoreSingleton.weight(ip, p.Location); w > 0 {
+		return w
+	}
+	return 1
+}
+
+var InitDstCmd = &cli.Command{
+	Name:  "init-dst",
+	Usage: "create the lotus sectorstore.json of dst paths without one",
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:  "path",
+			Usage: "special the config file paths",
+			Value: "~/mv_sectors.yaml",
+		},
+		&cli.StringSliceFlag{
+			Name:  "location",
+			Usage: "only these dst paths of the config, default to all",
+		},
+		&cli.Uint64Flag{
+			Name:  "weight",
+			Usage: "weight of the paths in lotus",
+			Value: 10,
+		},
+		&cli.Uint64Flag{
+			Name:  "max-storage",
+			Usage: "bytes lotus may store on each path, 0 means no limit",
+		},
+		&cli.StringSliceFlag{
+			Name:  "groups",
+			Usage: "storage groups of the paths",
+		},
+		&cli.BoolFlag{
+			Name:  "dry-run",
+			Usage: "only show what would be created",
+		},
+	},
+	Action: func(cctx *cli.Context) error {
+		if cctx.Uint64("weight") == 0 {
+			return errors.New("weight 0 makes the paths readonly in lotus, nothing could be stored there")
+		}
+		config, err := getConfig(cctx)
+		if err != nil {
+			return err
+		}
+		only := make(map[string]struct{})
+		for _, l := range cctx.StringSlice("location") {
+			only[strings.TrimRight(l, "/")] = struct{}{}
+		}
+		created, failed := 0, 0
+		for _, cmp := range config.DstComputers {
+			for _, p := range cmp.Paths {
+				location := strings.TrimRight(p.Location, "/")
+				if _, ok := only[location]; len(only) > 0 && !ok {
+					continue
+				}
+				if meta, err := mv_utils.ReadSectorStore(location); err == nil {
+					fmt.Printf("%s %s: has %s already, id %s, can store %v, weight %d\n",
+						cmp.Ip, location, mv_utils.SectorStoreFile, meta.ID, meta.CanStore, meta.Weight)
+					continue
+				} else if !os.IsNotExist(err) {
+					fmt.Printf("%s %s: %v\n", cmp.Ip, location, err)
+					failed++
+					continue
+				}
+				id, err := mv_utils.NewStorageID()
+				if err != nil {
+					return err
+				}
+				meta := &mv_utils.LocalStorageMeta{
+					ID:         id,
+					Weight:     cctx.Uint64("weight"),
+					CanSeal:    false,
+					CanStore:   true,
+					MaxStorage: cctx.Uint64("max-storage"),
+					Groups:     cctx.StringSlice("groups"),
+				}
+				if cctx.Bool("dry-run") {
+					fmt.Printf("%s %s: would create %s, id %s\n", cmp.Ip, location, mv_utils.SectorStoreFile, id)
+					continue
+				}
+				err = mv_utils.MakeDirIfNotExists(location)
+				if err == nil {
+					err = mv_utils.WriteSectorStore(location, meta)
+				}
+				if err != nil {
+					fmt.Printf("%s %s: %v\n", cmp.Ip, location, err)
+					failed++
+					continue
+				}
+				fmt.Printf("%s %s: created %s, id %s, attach it by lotus-miner storage attach %s\n",
+					cmp.Ip, location, mv_utils.SectorStoreFile, id, location)
+				created++
+			}
+		}
+		if failed > 0 {
+			return errors.New(fmt.Sprintf("%d paths failed, %d created", failed, created))
+		}
+		return nil
+	},
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"move_sectors/move_common"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// a failed task waits retryBackoffMin before its next attempt, doubled by
+// every failure up to retryBackoffMax
+const (
+	retryBackoffMin = time.Second * 10
+	retryBackoffMax = time.Minute * 10
+)
+
+// TaskControl keeps what control commands set on single tasks while running
+type TaskControl struct {
+	Runs       map[Operation]*CopyRun
+	Pins       map[Operation]pathRef
+	Attempts   map[Operation]int
+	NotBefore  map[Operation]time.Time // failed tasks do not start again before
+	Priorities map[Operation]int       // set by the priority command, win over the sector list file
+	CLock      *sync.Mutex
+}
+
+var taskControlSingleton = TaskControl{
+	Runs:       make(map[Operation]*CopyRun),
+	Pins:       make(map[Operation]pathRef),
+	Attempts:   make(map[Operation]int),
+	NotBefore:  make(map[Operation]time.Time),
+	Priorities: make(map[Operation]int),
+	CLock:      new(sync.Mutex),
+}
+
+// newRun gives the copy of t a context of its own, so it can be cancelled
+// alone, and marks t working; false if a command took t away meanwhile
+func (tc *TaskControl) newRun(t Operation, run *CopyRun) bool {
+	tc.CLock.Lock()
+	defer tc.CLock.Unlock()
+	if t.getStatus() != StatusOnWaiting {
+		return false
+	}
+	run.ctx, run.cancel = context.WithCancel(rootCtx)
+	tc.Runs[t] = run
+	t.setStatus(StatusOnWorking)
+	return true
+}
+
+// finishRun sets the status of t after its copy returned
+func (tc *TaskControl) finishRun(t Operation, run *CopyRun, maxRetries int) {
+	run.cancel()
+	tc.CLock.Lock()
+	defer tc.CLock.Unlock()
+	delete(tc.Runs, t)
+	switch run.cancelAs {
+	case "":
+		if t.getStatus() != StatusOnWaiting || stop {
+			return
+		}
+		tc.Attempts[t]++
+		if maxRetries > 0 && tc.Attempts[t] >= maxRetries {
+			log.Errorf("%s %s failed %d times, give it up", t.getSectorID(), t.getFileType(), tc.Attempts[t])
+			t.setStatus(StatusFailed)
+			return
+		}
+		tc.NotBefore[t] = time.Now().Add(retryBackoff(tc.Attempts[t]))
+	case StatusOnWaiting:
+		tc.Attempts[t] = 0
+		delete(tc.NotBefore, t)
+		t.setStatus(StatusOnWaiting)
+	default:
+		t.setStatus(run.cancelAs)
+	}
+}
+
+func retryBackoff(attempts int) time.Duration {
+	backoff := retryBackoffMin
+	for i := 1; i < attempts && backoff < retryBackoffMax; i++ {
+		backoff *= 2
+	}
+	if backoff > retryBackoffMax {
+		backoff = retryBackoffMax
+	}
+	return backoff
+}
+
+// notBefore returns when t may start again, zero if it has not failed
+func (tc *TaskControl) notBefore(t Operation) time.Time {
+	tc.CLock.Lock()
+	defer tc.CLock.Unlock()
+	return tc.NotBefore[t]
+}
+
+func (tc *TaskControl) priority(t Operation) (int, bool) {
+	tc.CLock.Lock()
+	defer tc.CLock.Unlock()
+	p, ok := tc.Priorities[t]
+	return p, ok
+}
+
+// getBestDst returns the pinned dst path of t if any, or the best dst by the usual rules
+func (tc *TaskControl) getBestDst(t Operation) (string, string, error) {
+	tc.CLock.Lock()
+	pin, ok := tc.Pins[t]
+	tc.CLock.Unlock()
+	if !ok {
+		return t.getBestDst()
+	}
+	dstComputersMapSingleton.CLock.Lock()
+	defer dstComputersMapSingleton.CLock.Unlock()
+	cmp := dstComputersMapSingleton.CMap[pin.Ip]
+	for _, p := range cmp.Paths {
+		if strings.TrimRight(p.Location, "/") != strings.TrimRight(pin.Path.Location, "/") {
+			continue
+		}
+		if !resourceManagerSingleton.hasFree(SideDst, cmp, p) {
+			return "", "", errors.New(move_common.FondGroupButTooMuchThread)
+		}
+		if !capacityAllows(cmp, p, t.getSectorID(), t.getTotalSize()) {
+			log.Debugf("%s is pinned to %s, but disk has not enough space for now", t.getSectorID(), p.Location)
+			return "", "", errors.New(move_common.NoDstSuitableForNow)
+		}
+		return p.Location, cmp.Ip, nil
+	}
+	return "", "", fmt.Errorf("%s is pinned to %s %s which is not configured anymore", t.getSectorID(), pin.Ip, pin.Path.Location)
+}
+
+// findTask returns the task of sectorID, kind may be empty when only one kind matches
+func findTask(sectorID, kind string) (Operation, error) {
+	taskListSingleton.TLock.Lock()
+	ops := taskListSingleton.Ops
+	taskListSingleton.TLock.Unlock()
+	var found Operation
+	for _, op := range ops {
+		if op.getSectorID() != sectorID {
+			continue
+		}
+		if kind != "" && !strings.EqualFold(kind, string(op.getFileType())) {
+			continue
+		}
+		if found != nil {
+			return nil, fmt.Errorf("%s has more than one kind of task, please tell the kind", sectorID)
+		}
+		found = op
+	}
+	if found == nil {
+		return nil, fmt.Errorf("no task of %s in this run", strings.TrimSpace(sectorID+" "+kind))
+	}
+	return found, nil
+}
+
+// stopTask cancels the copy of t if running, or takes it out of the ready
+// queue; the task gets status as soon as its copy cleaned up
+func (tc *TaskControl) stopTask(t Operation, status string) (string, error) {
+	tc.CLock.Lock()
+	defer tc.CLock.Unlock()
+	if run, ok := tc.Runs[t]; ok {
+		run.cancelAs = status
+		run.cancel()
+		return fmt.Sprintf("copy of %s %s to %s cancelled", t.getSectorID(), t.getFileType(), run.DstPath), nil
+	}
+	if st := t.getStatus(); st != StatusOnWaiting {
+		return "", fmt.Errorf("%s %s is %s already", t.getSectorID(), t.getFileType(), st)
+	}
+	t.setStatus(status)
+	journalSingleton.setStatus(t)
+	historySingleton.stopped(t)
+	schedulerSingleton.drop(func(op Operation) bool { return op == t })
+	return fmt.Sprintf("%s %s will not be copied", t.getSectorID(), t.getFileType()), nil
+}
+
+func taskFromRequest(req *ControlRequest) (Operation, error) {
+	if req.Args["sector"] == "" {
+		return nil, errors.New("sector is required")
+	}
+	return findTask(req.Args["sector"], req.Args["kind"])
+}
+
+func cancelTask(req *ControlRequest) (string, error) {
+	t, err := taskFromRequest(req)
+	if err != nil {
+		return "", err
+	}
+	return taskControlSingleton.stopTask(t, StatusCancelled)
+}
+
+func skipTask(req *ControlRequest) (string, error) {
+	t, err := taskFromRequest(req)
+	if err != nil {
+		return "", err
+	}
+	return taskControlSingleton.stopTask(t, StatusSkipped)
+}
+
+// retryTask restarts a running copy from scratch, or puts a failed, cancelled
+// or skipped task back to the ready queue
+func retryTask(req *ControlRequest) (string, error) {
+	t, err := taskFromRequest(req)
+	if err != nil {
+		return "", err
+	}
+	tc := &taskControlSingleton
+	tc.CLock.Lock()
+	defer tc.CLock.Unlock()
+	tc.Attempts[t] = 0
+	delete(tc.NotBefore, t)
+	if run, ok := tc.Runs[t]; ok {
+		run.cancelAs = StatusOnWaiting
+		run.cancel()
+		return fmt.Sprintf("copy of %s %s restarts", t.getSectorID(), t.getFileType()), nil
+	}
+	switch st := t.getStatus(); st {
+	case StatusOnWaiting:
+		schedulerSingleton.notify()
+		return fmt.Sprintf("%s %s is waiting already", t.getSectorID(), t.getFileType()), nil
+	case StatusDone:
+		return "", fmt.Errorf("%s %s is done already", t.getSectorID(), t.getFileType())
+	}
+	t.setStatus(StatusOnWaiting)
+	journalSingleton.setStatus(t)
+	schedulerSingleton.push(t)
+	return fmt.Sprintf("%s %s will be copied again", t.getSectorID(), t.getFileType()), nil
+}
+
+func pinTask(req *ControlRequest) (string, error) {
+	t, err := taskFromRequest(req)
+	if err != nil {
+		return "", err
+	}
+	ip, location := req.Args["dst-ip"], strings.TrimRight(req.Args["dst-path"], "/")
+	configured := false
+	dstComputersMapSingleton.CLock.Lock()
+	for _, p := range dstComputersMapSingleton.CMap[ip].Paths {
+		configured = configured || strings.TrimRight(p.Location, "/") == location
+	}
+	dstComputersMapSingleton.CLock.Unlock()
+	if !configured {
+		return "", fmt.Errorf("dst path %s of %s is not configured", location, ip)
+	}
+	tc := &taskControlSingleton
+	tc.CLock.Lock()
+	tc.Pins[t] = pathRef{Ip: ip, Path: Path{Location: location}}
+	_, running := tc.Runs[t]
+	tc.CLock.Unlock()
+	schedulerSingleton.notify()
+	if running {
+		return fmt.Sprintf("%s %s pinned to %s, the running copy goes on, retry it to move now", t.getSectorID(), t.getFileType(), location), nil
+	}
+	return fmt.Sprintf("%s %s pinned to %s", t.getSectorID(), t.getFileType(), location), nil
+}
+
+func prioritizeTask(req *ControlRequest) (string, error) {
+	t, err := taskFromRequest(req)
+	if err != nil {
+		return "", err
+	}
+	p, err := strconv.Atoi(req.Args["priority"])
+	if err != nil {
+		return "", fmt.Errorf("wrong priority %s: %w", req.Args["priority"], err)
+	}
+	taskControlSingleton.CLock.Lock()
+	taskControlSingleton.Priorities[t] = p
+	taskControlSingleton.CLock.Unlock()
+	t.setPriority(p)
+	schedulerSingleton.notify()
+	return fmt.Sprintf("priority of %s %s set to %d", t.getSectorID(), t.getFileType(), p), nil
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+// throughputWeight is the weight of the newest copy in the moving average
+const throughputWeight = 0.3
+
+// PathThroughput is the measured MB/s of one thread on a path
+type PathThroughput struct {
+	MBPS    float64
+	Copies  int
+	Updated int64
+}
+
+// ThroughputLog keeps the speed of finished copies per src and dst path
+// across runs, forecast takes it as the measured bandwidth model
+type ThroughputLog struct {
+	File  string
+	Paths map[string]*PathThroughput // path keys of the resource manager
+	TLock *sync.Mutex
+}
+
+var throughputSingleton = ThroughputLog{
+	Paths: make(map[string]*PathThroughput),
+	TLock: new(sync.Mutex),
+}
+
+func (tl *ThroughputLog) load() error {
+	if tl.File == "" {
+		return nil
+	}
+	raw, err := ioutil.ReadFile(tl.File)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	paths := make(map[string]*PathThroughput)
+	if err := json.Unmarshal(raw, &paths); err != nil {
+		return err
+	}
+	tl.TLock.Lock()
+	tl.Paths = paths
+	tl.TLock.Unlock()
+	return nil
+}
+
+// record adds the speed of a finished copy to its src and dst path
+func (tl *ThroughputLog) record(run *CopyRun) {
+	if tl.File == "" || run.slot == nil {
+		return
+	}
+	elapsed := time.Now().Sub(run.slot.Acquired).Seconds()
+	copied := run.Size - run.Resumed
+	if elapsed <= 0 || copied <= 0 {
+		return
+	}
+	mbps := float64(copied) / float64(1<<20) / elapsed
+	tl.TLock.Lock()
+	defer tl.TLock.Unlock()
+	for _, key := range []string{
+		pathKey(SideSrc, run.slot.SrcIp, run.slot.SrcPath),
+		pathKey(SideDst, run.slot.DstIp, run.slot.DstPath),
+	} {
+		pt, ok := tl.Paths[key]
+		if !ok {
+			pt = &PathThroughput{MBPS: mbps}
+			tl.Paths[key] = pt
+		}
+		pt.MBPS = pt.MBPS*(1-throughputWeight) + mbps*throughputWeight
+		pt.Copies++
+		pt.Updated = time.Now().Unix()
+	}
+	raw, err := json.MarshalIndent(tl.Paths, "", "  ")
+	if err == nil {
+		tmp := tl.File + ".tmp"
+		if err = ioutil.WriteFile(tmp, raw, 0644); err == nil {
+			err = os.Rename(tmp, tl.File)
+		}
+	}
+	if err != nil {
+		log.Warnf("save throughput to %s failed: %v", tl.File, err)
+	}
+}
+
+// mbps returns the measured speed of one thread on a path
+func (tl *ThroughputLog) mbps(key string) (float64, bool) {
+	tl.TLock.Lock()
+	defer tl.TLock.Unlock()
+	pt, ok := tl.Paths[key]
+	if !ok || pt.MBPS <= 0 {
+		return 0, false
+	}
+	return pt.MBPS, true
+}
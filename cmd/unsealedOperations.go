@@ -8,13 +8,9 @@ package main
 
 import (
 	"errors"
-	"github.com/filecoin-project/go-state-types/big"
 	"move_sectors/move_common"
-	"move_sectors/mv_utils"
 	"os"
-	"sort"
 	"strings"
-	"syscall"
 	"time"
 )
 
@@ -28,6 +24,8 @@ type UnSealedTask struct {
 	TotalSize     int64
 	Status        string
 	SealProofType string
+	SrcMtime      int64
+	Priority      int
 }
 
 var _ Operation = &UnSealedTask{}
@@ -52,6 +50,7 @@ func newUnSealedTask(unSealedSrc, oriSrc, srcIP, sId string) (*UnSealedTask, err
 	task.UnSealedSrc = unSealedSrc
 	task.TotalSize = stat.Size()
 	task.Status = StatusOnWaiting
+	task.SrcMtime = stat.ModTime().Unix()
 	return task, nil
 }
 
@@ -59,17 +58,17 @@ func (t *UnSealedTask) canDo() bool {
 	srcComputersMapSingleton.CLock.Lock()
 	defer srcComputersMapSingleton.CLock.Unlock()
 	srcComputer := srcComputersMapSingleton.CMap[t.SrcIp]
-	var pathCurrentThread int64
-	var pathLimitThread int64
+	if srcComputer.Draining {
+		return false
+	}
 	for _, loc := range srcComputer.Paths {
-		if t.OriSrc == loc.Location {
-			pathCurrentThread = loc.CurrentThreads
-			pathLimitThread = loc.SinglePathThreadLimit
+		if t.OriSrc == strings.TrimRight(loc.Location, "/") {
+			if loc.Draining {
+				return false
+			}
+			return resourceManagerSingleton.hasFree(SideSrc, srcComputer, loc)
 		}
 	}
-	if srcComputer.CurrentThreads < srcComputer.LimitThread && pathCurrentThread < pathLimitThread {
-		return true
-	}
 	return false
 }
 
@@ -78,40 +77,11 @@ func (t *UnSealedTask) getBestDst() (string, string, error) {
 
 	dir, s, err := t.tryToFindGroupDir()
 	if err != nil {
-		if err.Error() == move_common.FondGroupButTooMuchThread {
-			return "", "", err
-		}
-
-		dstC, err := getOneFreeDstComputer()
-		if err != nil {
+		if e := err.Error(); e == move_common.FondGroupButTooMuchThread || e == move_common.GroupDirFull {
 			return "", "", err
 		}
-
-		log.Debugf("sorting dst paths")
-		paths := dstC.Paths
-		sort.Slice(dstC.Paths, func(i, j int) bool {
-			var statI = new(syscall.Statfs_t)
-			_ = syscall.Statfs(paths[i].Location, statI)
-			var statJ = new(syscall.Statfs_t)
-			_ = syscall.Statfs(paths[j].Location, statJ)
-
-			iw := big.NewInt(int64(statI.Bavail*uint64(statI.Bsize)) / (paths[i].CurrentThreads + 1))
-			jw := big.NewInt(int64(statJ.Bavail*uint64(statJ.Bsize)) / (paths[j].CurrentThreads + 1))
-
-			return iw.GreaterThanEqual(jw)
-		})
-
-		log.Debugf("selecting dst paths for %s", t.SectorID)
-		for _, p := range paths {
-			var stat = new(syscall.Statfs_t)
-			_ = syscall.Statfs(p.Location, stat)
-			if stat.Bavail*uint64(stat.Bsize) > uint64(t.TotalSize) && p.CurrentThreads < p.SinglePathThreadLimit {
-				return p.Location, dstC.Ip, nil
-			}
-		}
-		return "", "", errors.New(move_common.NoDstSuitableForNow)
+		return getBestDstByPolicy(t.getSectorID(), t.TotalSize)
 	}
-
 	return dir, s, nil
 }
 
@@ -122,19 +92,23 @@ func (t *UnSealedTask) fullInfo(dstOri, dstIp string) {
 	t.DstIp = dstIp
 }
 
-func (t *UnSealedTask) startCopy(cfg *Config, dstPath string) {
+func (t *UnSealedTask) startCopy(cfg *Config, run *CopyRun) {
 	log.Infof("start to copying %v", *t)
+	cur := cfg.snapshot()
 	// copying unsealed
-	err := copying(t.UnSealedSrc, t.UnSealedDst, cfg.SingleThreadMBPS, cfg.Chunks)
-	freeThreads(dstPath, t.DstIp, t.SrcIp, t.OriSrc)
+	err := copying(t.UnSealedSrc, t.UnSealedDst, cur.SingleThreadMBPS, cur.Chunks, run)
+	resourceManagerSingleton.release(run.slot)
 	if err != nil {
-		if err.Error() == move_common.StoppedBySyscall {
+		run.fail(err)
+		if err.Error() == move_common.StoppedBySyscall || err.Error() == move_common.CancelledByControl {
 			log.Warn(err)
 		} else {
 			log.Error(err)
 		}
-		os.Remove(t.UnSealedDst)
-		os.Remove(t.UnSealedDst + ".tmp")
+		if !run.keepPartial() {
+			os.Remove(t.UnSealedDst)
+			os.Remove(t.UnSealedDst + ".tmp")
+		}
 		if os.Getenv("SKIP_FAILED") == "1" {
 			t.setStatus(StatusDone)
 		} else {
@@ -149,6 +123,10 @@ func (t *UnSealedTask) startCopy(cfg *Config, dstPath string) {
 func (t *UnSealedTask) tryToFindGroupDir() (string, string, error) {
 	dstComputersMapSingleton.CLock.Lock()
 	defer dstComputersMapSingleton.CLock.Unlock()
+	// the persistent placement map goes first, it also knows parts still copying
+	if dir, ip, found, err := findAssignedDir(t.getSectorID(), t.getFileType(), t.TotalSize); found {
+		return dir, ip, err
+	}
 	log.Debugf("trying to find group dir for %s unsealed", t.getSectorID())
 	// search sealed at first
 	for _, cmp := range dstComputersMapSingleton.CMap {
@@ -156,11 +134,9 @@ func (t *UnSealedTask) tryToFindGroupDir() (string, string, error) {
 			dstSealed := strings.TrimRight(p.Location, "/") + "/sealed/" + t.getSectorID()
 			_, err := os.Stat(dstSealed)
 			if err == nil {
-				if cmp.CurrentThreads < cmp.LimitThread && p.CurrentThreads < p.SinglePathThreadLimit {
+				if resourceManagerSingleton.hasFree(SideDst, cmp, p) {
 
-					var stat = new(syscall.Statfs_t)
-					_ = syscall.Statfs(p.Location, stat)
-					if stat.Bavail*uint64(stat.Bsize) <= uint64(t.TotalSize) {
+					if !capacityAllows(cmp, p, t.getSectorID(), t.TotalSize) {
 						log.Debugf("%v fond same group dir on %s, but disk has not enough space, will chose new dst", *t, p.Location)
 						return "", "", errors.New(move_common.NotEnoughSpace)
 					}
@@ -179,11 +155,9 @@ func (t *UnSealedTask) tryToFindGroupDir() (string, string, error) {
 			dstCache := strings.TrimRight(p.Location, "/") + "/cache/" + t.getSectorID()
 			_, err := os.Stat(dstCache)
 			if err == nil {
-				if cmp.CurrentThreads < cmp.LimitThread && p.CurrentThreads < p.SinglePathThreadLimit {
+				if resourceManagerSingleton.hasFree(SideDst, cmp, p) {
 
-					var stat = new(syscall.Statfs_t)
-					_ = syscall.Statfs(p.Location, stat)
-					if stat.Bavail*uint64(stat.Bsize) <= uint64(t.TotalSize) {
+					if !capacityAllows(cmp, p, t.getSectorID(), t.TotalSize) {
 						log.Debugf("%v fond same group dir on %s, but disk has not enough space, will chose new dst", *t, p.Location)
 						return "", "", errors.New(move_common.NotEnoughSpace)
 					}
@@ -240,40 +214,12 @@ func (t *UnSealedTask) checkSourceSize() ([]string, error) {
 }
 
 func (t *UnSealedTask) checkIsExistedInDst(srcPaths []string, cfg *Config) bool {
-	dstComputersMapSingleton.CLock.Lock()
-	defer dstComputersMapSingleton.CLock.Unlock()
 	sinceTime := time.Now()
-	for _, v := range dstComputersMapSingleton.CMap {
-		for _, p := range v.Paths {
-			tag := 1
-			for _, singleUnSealedPath := range srcPaths {
-				dst := strings.Replace(singleUnSealedPath, t.OriSrc, p.Location, 1)
-				statSrc, _ := os.Stat(singleUnSealedPath)
-				statDst, err := os.Stat(dst)
-				// if existed,check hash
-				if err == nil {
-					if statDst.Size() == statSrc.Size() {
-						srcHash, _ := recordCalLogIfNeed(mv_utils.CalFileHash, singleUnSealedPath, statSrc.Size(), cfg.Chunks)
-						dstHash, _ := recordCalLogIfNeed(mv_utils.CalFileHash, dst, statDst.Size(), cfg.Chunks)
-						if srcHash == dstHash && srcHash != "" && dstHash != "" {
-							tag = 1
-						} else {
-							tag = 0
-						}
-					} else {
-						tag = 0
-					}
-				} else {
-					tag = 0
-				}
-			}
-			if tag == 1 {
-				log.Debugf("src unsealed file: %v already existed in dst %s,unSealedTask done,check cost %v",
-					*t, p.Location, time.Now().Sub(sinceTime))
-				log.Debugf("task %v is existed in dst", *t)
-				return true
-			}
-		}
+	if loc, ok := isExistedInDst(t.OriSrc, srcPaths, cfg); ok {
+		log.Debugf("src unsealed file: %v already existed in dst %s,unSealedTask done,check cost %v",
+			*t, loc, time.Now().Sub(sinceTime))
+		log.Debugf("task %v is existed in dst", *t)
+		return true
 	}
 	return false
 }
@@ -283,3 +229,27 @@ func (t *UnSealedTask) getSrcPath() string {
 	defer taskListSingleton.TLock.Unlock()
 	return t.OriSrc
 }
+
+func (t *UnSealedTask) getTotalSize() int64 {
+	return t.TotalSize
+}
+
+func (t *UnSealedTask) getSrcMtime() int64 {
+	return t.SrcMtime
+}
+
+func (t *UnSealedTask) getPriority() int {
+	taskListSingleton.TLock.Lock()
+	defer taskListSingleton.TLock.Unlock()
+	return t.Priority
+}
+
+func (t *UnSealedTask) setPriority(p int) {
+	taskListSingleton.TLock.Lock()
+	defer taskListSingleton.TLock.Unlock()
+	t.Priority = p
+}
+
+func (t *UnSealedTask) getFileType() move_common.FileType {
+	return move_common.UnSealed
+}
@@ -9,6 +9,7 @@ require (
 	github.com/ipfs/go-log v1.0.5
 	github.com/mitchellh/go-homedir v1.1.0
 	github.com/urfave/cli/v2 v2.3.0
+	go.etcd.io/bbolt v1.3.5
 	golang.org/x/xerrors v0.0.0-20200804184101-5ec99f83aff1
 	gopkg.in/yaml.v2 v2.3.0
 )
@@ -7,4 +7,6 @@ const (
 	StoppedBySyscall          = "stopped by syscall"
 	FondGroupButTooMuchThread = "FondGroupButTooMuchThread"
 	NotEnoughSpace            = "NotEnoughSpace"
+	GroupDirFull              = "GroupDirFull"
+	CancelledByControl        = "cancelled by control command"
 )
@@ -13,3 +13,7 @@ const (
 	UnSealed FileType = "UnSealed"
 	Cache    FileType = "Cache"
 )
+
+// FileTypes lists every kind in the order the parts of one sector are copied,
+// cache right after sealed so it lands in the same group dir
+var FileTypes = []FileType{Sealed, Cache, UnSealed}
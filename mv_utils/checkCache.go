@@ -0,0 +1,215 @@
+package mv_utils
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"os"
+)
+
+const (
+	NodeSize = 32
+	PAuxSize = 2 * NodeSize
+)
+
+// bls12-381 scalar field modulus, every node of a sector tree must be lower than it
+var frModulus, _ = new(big.Int).SetString("73eda753299d7d483339d80809a1d80553bda402fffe5bfeffffffff00000001", 16)
+
+// PAux is the content of the p_aux file in a sector cache dir
+type PAux struct {
+	CommC     [NodeSize]byte
+	CommRLast [NodeSize]byte
+}
+
+// StoreConfig is one merkle store config written by rust-fil-proofs into t_aux
+type StoreConfig struct {
+	Path          string
+	ID            string
+	Size          *uint64
+	RowsToDiscard uint64
+}
+
+// TAux is the content of the t_aux file in a sector cache dir
+type TAux struct {
+	Labels          []StoreConfig
+	TreeDConfig     StoreConfig
+	TreeRLastConfig StoreConfig
+	TreeCConfig     StoreConfig
+}
+
+// IsValidNode reports whether b is a little-endian encoded field element
+func IsValidNode(b []byte) bool {
+	if len(b) != NodeSize {
+		return false
+	}
+	be := make([]byte, NodeSize)
+	for i := range b {
+		be[NodeSize-1-i] = b[i]
+	}
+	return new(big.Int).SetBytes(be).Cmp(frModulus) < 0
+}
+
+func isZeroNode(b []byte) bool {
+	for _, v := range b {
+		if v != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func DecodePAux(filePath string) (*PAux, error) {
+	raw, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		return nil, err
+	}
+	if len(raw) != PAuxSize {
+		return nil, fmt.Errorf("wrong p_aux size,path: %s,required size: %d, got size: %d", filePath, PAuxSize, len(raw))
+	}
+	var pAux PAux
+	copy(pAux.CommC[:], raw[:NodeSize])
+	copy(pAux.CommRLast[:], raw[NodeSize:])
+	if isZeroNode(pAux.CommC[:]) || !IsValidNode(pAux.CommC[:]) {
+		return nil, fmt.Errorf("invalid comm_c in p_aux: %s", filePath)
+	}
+	if isZeroNode(pAux.CommRLast[:]) || !IsValidNode(pAux.CommRLast[:]) {
+		return nil, fmt.Errorf("invalid comm_r_last in p_aux: %s", filePath)
+	}
+	return &pAux, nil
+}
+
+// t_aux is bincode encoded: integers are little-endian u64, strings are
+// prefixed with their u64 length and options with a one byte tag
+type bincodeReader struct {
+	raw []byte
+	off int
+}
+
+func (r *bincodeReader) u64() (uint64, error) {
+	if len(r.raw)-r.off < 8 {
+		return 0, io.ErrUnexpectedEOF
+	}
+	v := binary.LittleEndian.Uint64(r.raw[r.off:])
+	r.off += 8
+	return v, nil
+}
+
+func (r *bincodeReader) str() (string, error) {
+	l, err := r.u64()
+	if err != nil {
+		return "", err
+	}
+	if uint64(len(r.raw)-r.off) < l {
+		return "", io.ErrUnexpectedEOF
+	}
+	s := string(r.raw[r.off : r.off+int(l)])
+	r.off += int(l)
+	return s, nil
+}
+
+func (r *bincodeReader) storeConfig() (StoreConfig, error) {
+	var sc StoreConfig
+	var err error
+	if sc.Path, err = r.str(); err != nil {
+		return sc, err
+	}
+	if sc.ID, err = r.str(); err != nil {
+		return sc, err
+	}
+	if len(r.raw)-r.off < 1 {
+		return sc, io.ErrUnexpectedEOF
+	}
+	tag := r.raw[r.off]
+	r.off++
+	switch tag {
+	case 0:
+	case 1:
+		size, err := r.u64()
+		if err != nil {
+			return sc, err
+		}
+		sc.Size = &size
+	default:
+		return sc, fmt.Errorf("invalid option tag %d", tag)
+	}
+	if sc.RowsToDiscard, err = r.u64(); err != nil {
+		return sc, err
+	}
+	return sc, nil
+}
+
+func DecodeTAux(filePath string) (*TAux, error) {
+	raw, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		return nil, err
+	}
+	if len(raw) == 0 {
+		return nil, fmt.Errorf("empty t_aux: %s", filePath)
+	}
+	r := &bincodeReader{raw: raw}
+	var tAux TAux
+	layers, err := r.u64()
+	if err != nil {
+		return nil, fmt.Errorf("decode t_aux %s: %w", filePath, err)
+	}
+	// no seal proof has more than a few dozen layers, a huge count means garbage
+	if layers == 0 || layers > 64 {
+		return nil, fmt.Errorf("decode t_aux %s: invalid layers count %d", filePath, layers)
+	}
+	for i := uint64(0); i < layers; i++ {
+		sc, err := r.storeConfig()
+		if err != nil {
+			return nil, fmt.Errorf("decode t_aux %s: label %d: %w", filePath, i, err)
+		}
+		tAux.Labels = append(tAux.Labels, sc)
+	}
+	for _, sc := range []*StoreConfig{&tAux.TreeDConfig, &tAux.TreeRLastConfig, &tAux.TreeCConfig} {
+		if *sc, err = r.storeConfig(); err != nil {
+			return nil, fmt.Errorf("decode t_aux %s: %w", filePath, err)
+		}
+	}
+	if r.off != len(raw) {
+		return nil, fmt.Errorf("decode t_aux %s: %d trailing bytes", filePath, len(raw)-r.off)
+	}
+	if tAux.TreeRLastConfig.ID != "tree-r-last" {
+		return nil, fmt.Errorf("decode t_aux %s: unexpected tree-r-last id %q", filePath, tAux.TreeRLastConfig.ID)
+	}
+	return &tAux, nil
+}
+
+// CheckTreeRLast checks the size of a tree-r-last file and that its first
+// node and its root (the last node) are valid field elements
+func CheckTreeRLast(filePath string, size int64) error {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	stat, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if stat.Size() != size {
+		return fmt.Errorf("wrong tree-r-last size,path: %s,required size: %d, got size: %d", filePath, size, stat.Size())
+	}
+	if size%NodeSize != 0 || size < NodeSize {
+		return fmt.Errorf("tree-r-last size %d is not a multiple of node size: %s", size, filePath)
+	}
+	head := make([]byte, NodeSize)
+	if _, err = f.ReadAt(head, 0); err != nil {
+		return err
+	}
+	root := make([]byte, NodeSize)
+	if _, err = f.ReadAt(root, size-NodeSize); err != nil {
+		return err
+	}
+	if !IsValidNode(head) {
+		return fmt.Errorf("invalid tree-r-last header: %s", filePath)
+	}
+	if isZeroNode(root) || !IsValidNode(root) {
+		return fmt.Errorf("invalid tree-r-last root: %s", filePath)
+	}
+	return nil
+}
@@ -0,0 +1,177 @@
+package mv_utils
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// node returns a valid little-endian field element filled with v
+func node(v byte) []byte {
+	b := make([]byte, NodeSize)
+	for i := range b {
+		b[i] = v
+	}
+	// keep it below the modulus
+	b[NodeSize-1] = 0x01
+	return b
+}
+
+func invalidNode() []byte {
+	b := make([]byte, NodeSize)
+	for i := range b {
+		b[i] = 0xff
+	}
+	return b
+}
+
+func writeTemp(t *testing.T, name string, raw []byte) string {
+	t.Helper()
+	file := filepath.Join(t.TempDir(), name)
+	if err := ioutil.WriteFile(file, raw, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func concat(parts ...[]byte) []byte {
+	var raw []byte
+	for _, p := range parts {
+		raw = append(raw, p...)
+	}
+	return raw
+}
+
+func TestDecodePAux(t *testing.T) {
+	cases := []struct {
+		name string
+		raw  []byte
+		err  string
+	}{
+		{"valid", concat(node(1), node(2)), ""},
+		{"short", node(1), "wrong p_aux size"},
+		{"long", concat(node(1), node(2), []byte{0}), "wrong p_aux size"},
+		{"zero comm_c", concat(make([]byte, NodeSize), node(2)), "invalid comm_c"},
+		{"comm_c above modulus", concat(invalidNode(), node(2)), "invalid comm_c"},
+		{"zero comm_r_last", concat(node(1), make([]byte, NodeSize)), "invalid comm_r_last"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			pAux, err := DecodePAux(writeTemp(t, "p_aux", c.raw))
+			if c.err != "" {
+				if err == nil || !strings.Contains(err.Error(), c.err) {
+					t.Fatalf("want error %q, got %v", c.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(pAux.CommC[:]) != string(c.raw[:NodeSize]) || string(pAux.CommRLast[:]) != string(c.raw[NodeSize:]) {
+				t.Fatalf("decoded %x, want %x", concat(pAux.CommC[:], pAux.CommRLast[:]), c.raw)
+			}
+		})
+	}
+}
+
+func u64(v uint64) []byte {
+	b := make([]byte, 8)
+	binary.LittleEndian.PutUint64(b, v)
+	return b
+}
+
+func str(s string) []byte {
+	return concat(u64(uint64(len(s))), []byte(s))
+}
+
+func storeConfig(id string, size *uint64) []byte {
+	raw := concat(str("/cache/s-t01000-1"), str(id))
+	if size == nil {
+		raw = append(raw, 0)
+	} else {
+		raw = concat(raw, []byte{1}, u64(*size))
+	}
+	return concat(raw, u64(0))
+}
+
+func tAux(layers uint64, rLastID string) []byte {
+	size := uint64(1 << 20)
+	raw := u64(layers)
+	for i := uint64(0); i < layers; i++ {
+		raw = concat(raw, storeConfig("layer", &size))
+	}
+	return concat(raw, storeConfig("tree-d", &size), storeConfig(rLastID, nil), storeConfig("tree-c", &size))
+}
+
+func TestDecodeTAux(t *testing.T) {
+	valid := tAux(2, "tree-r-last")
+	cases := []struct {
+		name   string
+		raw    []byte
+		layers int
+		err    string
+	}{
+		{"valid", valid, 2, ""},
+		{"empty", nil, 0, "empty t_aux"},
+		{"no layers", tAux(0, "tree-r-last"), 0, "invalid layers count 0"},
+		{"garbage layers count", concat(u64(1<<40), valid[8:]), 0, "invalid layers count"},
+		{"truncated", valid[:len(valid)-3], 0, "unexpected EOF"},
+		{"trailing bytes", concat(valid, []byte{0}), 0, "1 trailing bytes"},
+		{"bad option tag", concat(u64(1), str("/p"), str("layer"), []byte{7}), 0, "invalid option tag 7"},
+		{"wrong tree-r-last id", tAux(2, "tree-q"), 0, "unexpected tree-r-last id"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			ta, err := DecodeTAux(writeTemp(t, "t_aux", c.raw))
+			if c.err != "" {
+				if err == nil || !strings.Contains(err.Error(), c.err) {
+					t.Fatalf("want error %q, got %v", c.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(ta.Labels) != c.layers {
+				t.Fatalf("decoded %d labels, want %d", len(ta.Labels), c.layers)
+			}
+			if ta.TreeRLastConfig.Size != nil || ta.TreeDConfig.Size == nil || *ta.TreeDConfig.Size != 1<<20 {
+				t.Fatalf("decoded options wrong: %+v", ta)
+			}
+		})
+	}
+}
+
+func TestCheckTreeRLast(t *testing.T) {
+	middle := make([]byte, 2*NodeSize)
+	cases := []struct {
+		name string
+		raw  []byte
+		size int64
+		err  string
+	}{
+		{"valid", concat(node(1), middle, node(2)), 4 * NodeSize, ""},
+		{"one node", node(3), NodeSize, ""},
+		{"wrong size", concat(node(1), node(2)), 3 * NodeSize, "wrong tree-r-last size"},
+		{"not a multiple of node size", concat(node(1), []byte{1}), NodeSize + 1, "not a multiple of node size"},
+		{"invalid header", concat(invalidNode(), node(2)), 2 * NodeSize, "invalid tree-r-last header"},
+		{"zero root", concat(node(1), make([]byte, NodeSize)), 2 * NodeSize, "invalid tree-r-last root"},
+		{"root above modulus", concat(node(1), invalidNode()), 2 * NodeSize, "invalid tree-r-last root"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			err := CheckTreeRLast(writeTemp(t, "tree-r-last-0.dat", c.raw), c.size)
+			if c.err == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), c.err) {
+				t.Fatalf("want error %q, got %v", c.err, err)
+			}
+		})
+	}
+}
@@ -8,16 +8,48 @@ package mv_utils
 
 import (
 	"bufio"
+	"bytes"
 	"crypto/md5"
 	"crypto/sha1"
 	"crypto/sha256"
 	"encoding/hex"
+	"fmt"
+	"hash"
 	"hash/crc32"
 	"io"
 	"io/ioutil"
 	"os"
 )
 
+const (
+	HashCrc32  = "crc32"
+	HashMd5    = "md5"
+	HashSha1   = "sha1"
+	HashSha256 = "sha256"
+
+	CheckModeSize   = "size"
+	CheckModeSample = "sample"
+	CheckModeFull   = "full"
+
+	DefaultBlockSize = 1024 * 4
+)
+
+// HashOption describes how a file is hashed when checking if it already existed in dst
+type HashOption struct {
+	Mode      string
+	BlockSize int64
+	Blocks    int64
+	Algorithm string
+}
+
+// Key identifies the hashes made with this option in the hash cache
+func (opt HashOption) Key() string {
+	if opt.Mode == CheckModeFull {
+		return fmt.Sprintf("%s-%s", opt.Mode, opt.Algorithm)
+	}
+	return fmt.Sprintf("%s-%s-%d-%d", opt.Mode, opt.Algorithm, opt.BlockSize, opt.Blocks)
+}
+
 func CalFileHash(filePath string, size int64, chunks int64) (string, error) {
 	raw, err := MakeCalData(filePath, size, chunks)
 	if err != nil {
@@ -26,22 +58,149 @@ func CalFileHash(filePath string, size int64, chunks int64) (string, error) {
 	return fileCrc32(raw)
 }
 
+// CalFileHashWithOption hashes the sampled blocks or the whole file, reading through budget
+func CalFileHashWithOption(filePath string, size int64, opt HashOption, budget *IOBudget) (string, error) {
+	switch opt.Mode {
+	case CheckModeFull:
+		h, err := newHasher(opt.Algorithm)
+		if err != nil {
+			return "", err
+		}
+		file, err := os.Open(filePath)
+		if err != nil {
+			return "", err
+		}
+		defer file.Close()
+		if _, err = io.Copy(h, budget.Reader(file)); err != nil {
+			return "", err
+		}
+		return hex.EncodeToString(h.Sum([]byte(""))), nil
+	case CheckModeSample:
+		budget.Wait(opt.BlockSize * (opt.Blocks + 1))
+		raw, err := MakeSampleData(filePath, size, opt.BlockSize, opt.Blocks)
+		if err != nil {
+			return "", err
+		}
+		return HashData(opt.Algorithm, raw)
+	default:
+		return "", fmt.Errorf("mode %s does not hash files", opt.Mode)
+	}
+}
+
+// SamePrefix reports whether the first size bytes of files a and b are the
+// same, comparing the blocks opt samples over them, every byte in full mode
+// and nothing in size mode
+func SamePrefix(a, b string, size int64, opt HashOption, budget *IOBudget) (bool, error) {
+	if size <= 0 || opt.Mode == CheckModeSize {
+		return true, nil
+	}
+	fa, err := os.Open(a)
+	if err != nil {
+		return false, err
+	}
+	defer fa.Close()
+	fb, err := os.Open(b)
+	if err != nil {
+		return false, err
+	}
+	defer fb.Close()
+	blockSize := opt.BlockSize
+	if blockSize <= 0 {
+		blockSize = DefaultBlockSize
+	}
+	var offsets []int64
+	if opt.Mode == CheckModeFull {
+		blockSize = 1 << 20
+		for off := int64(0); off < size; off += blockSize {
+			offsets = append(offsets, off)
+		}
+	} else {
+		blocks := opt.Blocks
+		if blocks <= 0 {
+			blocks = 1
+		}
+		step := size / blocks
+		if step < blockSize {
+			step = blockSize
+		}
+		for off := int64(0); off < size; off += step {
+			offsets = append(offsets, off)
+		}
+		// the tail written last is the likeliest to differ
+		if tail := size - blockSize; tail > 0 {
+			offsets = append(offsets, tail)
+		}
+	}
+	bufA, bufB := make([]byte, blockSize), make([]byte, blockSize)
+	for _, off := range offsets {
+		n := blockSize
+		if off+n > size {
+			n = size - off
+		}
+		budget.Wait(2 * n)
+		if _, err := fa.ReadAt(bufA[:n], off); err != nil {
+			return false, err
+		}
+		if _, err := fb.ReadAt(bufB[:n], off); err != nil {
+			return false, err
+		}
+		if !bytes.Equal(bufA[:n], bufB[:n]) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+func HashData(algorithm string, data []byte) (string, error) {
+	switch algorithm {
+	case HashCrc32:
+		return fileCrc32(data)
+	case HashMd5:
+		return fileMd5(data)
+	case HashSha1:
+		return fileSha1(data)
+	case HashSha256:
+		return fileSha256(data)
+	default:
+		return "", fmt.Errorf("unsupported hash algorithm: %s", algorithm)
+	}
+}
+
+func newHasher(algorithm string) (hash.Hash, error) {
+	switch algorithm {
+	case HashCrc32:
+		return crc32.NewIEEE(), nil
+	case HashMd5:
+		return md5.New(), nil
+	case HashSha1:
+		return sha1.New(), nil
+	case HashSha256:
+		return sha256.New(), nil
+	default:
+		return nil, fmt.Errorf("unsupported hash algorithm: %s", algorithm)
+	}
+}
+
 func MakeCalData(filePath string, size int64, chunks int64) ([]byte, error) {
-	const BUFFER_SIZE = 1024 * 4
+	return MakeSampleData(filePath, size, DefaultBlockSize, chunks)
+}
+
+// MakeSampleData reads chunks blocks of blockSize spread over the file and its tail
+func MakeSampleData(filePath string, size int64, blockSize int64, chunks int64) ([]byte, error) {
 	var sample []byte
 	file, err := os.Open(filePath)
 	if err != nil {
 		return nil, err
 	}
 	defer file.Close()
-	if size <= BUFFER_SIZE*chunks {
+	if size <= blockSize*chunks {
 		reader := bufio.NewReader(file)
 		sample, err = ioutil.ReadAll(reader)
 		if err != nil {
 			return nil, err
 		}
 	} else {
-		buf := make([]byte, BUFFER_SIZE)
+		buf := make([]byte, blockSize)
 		chunk := size / chunks
 		for point := int64(0); point < size; point += chunk {
 			file.Seek(point, 0)
@@ -53,9 +212,9 @@ func MakeCalData(filePath string, size int64, chunks int64) ([]byte, error) {
 				break
 			}
 			// read the tail of file
-			if point+BUFFER_SIZE < size && point+chunk >= size {
-				bufTail := make([]byte, BUFFER_SIZE)
-				if remain := size - (point + BUFFER_SIZE); remain < BUFFER_SIZE {
+			if point+blockSize < size && point+chunk >= size {
+				bufTail := make([]byte, blockSize)
+				if remain := size - (point + blockSize); remain < blockSize {
 					bufTail = make([]byte, remain)
 				}
 				file.Seek(size-int64(len(bufTail)), 0)
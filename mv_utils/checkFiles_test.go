@@ -0,0 +1,188 @@
+package mv_utils
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"hash/crc32"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHashOptionKey(t *testing.T) {
+	cases := []struct {
+		opt  HashOption
+		want string
+	}{
+		{HashOption{Mode: CheckModeFull, Algorithm: HashMd5, BlockSize: 4096, Blocks: 10}, "full-md5"},
+		{HashOption{Mode: CheckModeFull, Algorithm: HashSha256}, "full-sha256"},
+		{HashOption{Mode: CheckModeSample, Algorithm: HashCrc32, BlockSize: 4096, Blocks: 10}, "sample-crc32-4096-10"},
+		{HashOption{Mode: CheckModeSample, Algorithm: HashCrc32, BlockSize: 8192, Blocks: 10}, "sample-crc32-8192-10"},
+	}
+	for _, c := range cases {
+		if got := c.opt.Key(); got != c.want {
+			t.Errorf("%+v: key %s, want %s", c.opt, got, c.want)
+		}
+	}
+}
+
+func TestCalFileHashWithOption(t *testing.T) {
+	data := make([]byte, 64<<10)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	file := writeTemp(t, "sealed", data)
+	// the same size with one byte changed in the middle, between the sampled blocks
+	changed := append([]byte(nil), data...)
+	changed[len(data)/2+5000] ^= 0xff
+	changedFile := writeTemp(t, "changed", changed)
+
+	crc := crc32.NewIEEE()
+	crc.Write(data)
+	md := md5.Sum(data)
+	cases := []struct {
+		name string
+		file string
+		opt  HashOption
+		want string
+		err  string
+	}{
+		{"full crc32", file, HashOption{Mode: CheckModeFull, Algorithm: HashCrc32}, hex.EncodeToString(crc.Sum(nil)), ""},
+		{"full md5", file, HashOption{Mode: CheckModeFull, Algorithm: HashMd5}, hex.EncodeToString(md[:]), ""},
+		{"sample of a small file hashes all of it", file, HashOption{Mode: CheckModeSample, Algorithm: HashMd5, BlockSize: 64 << 10, Blocks: 2}, hex.EncodeToString(md[:]), ""},
+		{"size mode does not hash", file, HashOption{Mode: CheckModeSize, Algorithm: HashMd5}, "", "does not hash"},
+		{"unknown algorithm", file, HashOption{Mode: CheckModeFull, Algorithm: "sha3"}, "", "unsupported hash algorithm"},
+		{"missing file", file + ".gone", HashOption{Mode: CheckModeFull, Algorithm: HashMd5}, "", "no such file"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got, err := CalFileHashWithOption(c.file, int64(len(data)), c.opt, nil)
+			if c.err != "" {
+				if err == nil || !strings.Contains(err.Error(), c.err) {
+					t.Fatalf("want error %q, got %v", c.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != c.want {
+				t.Fatalf("hash %s, want %s", got, c.want)
+			}
+		})
+	}
+
+	// sampling only sees its blocks, full mode sees every byte
+	sample := HashOption{Mode: CheckModeSample, Algorithm: HashCrc32, BlockSize: 1024, Blocks: 4}
+	a, _ := CalFileHashWithOption(file, int64(len(data)), sample, nil)
+	b, _ := CalFileHashWithOption(changedFile, int64(len(data)), sample, nil)
+	if a != b {
+		t.Errorf("sampled hashes differ for a byte outside the sampled blocks")
+	}
+	full := HashOption{Mode: CheckModeFull, Algorithm: HashCrc32}
+	a, _ = CalFileHashWithOption(file, int64(len(data)), full, nil)
+	b, _ = CalFileHashWithOption(changedFile, int64(len(data)), full, nil)
+	if a == b {
+		t.Errorf("full hashes equal for different files")
+	}
+}
+
+func TestIOBudget(t *testing.T) {
+	if NewIOBudget(0) != nil || NewIOBudget(-1) != nil {
+		t.Fatal("a budget of 0 or less must be nil, no limit")
+	}
+	var unlimited *IOBudget
+	since := time.Now()
+	unlimited.Wait(1 << 40)
+	if r := unlimited.Reader(bytes.NewReader([]byte("abc"))); r == nil {
+		t.Fatal("nil budget must return the reader itself")
+	}
+	if time.Now().Sub(since) > 100*time.Millisecond {
+		t.Fatal("nil budget must not wait")
+	}
+
+	cases := []struct {
+		name  string
+		mbps  int
+		reads []int64
+		min   time.Duration
+		max   time.Duration
+	}{
+		// the first read goes at once, the next waits for what the first took
+		{"one read goes at once", 1, []int64{1 << 20}, 0, 200 * time.Millisecond},
+		{"second read waits", 4, []int64{1 << 20, 1 << 20}, 200 * time.Millisecond, time.Second},
+		{"zero bytes never wait", 1, []int64{1 << 20, 0}, 0, 200 * time.Millisecond},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			b := NewIOBudget(c.mbps)
+			since := time.Now()
+			for _, n := range c.reads {
+				b.Wait(n)
+			}
+			if took := time.Now().Sub(since); took < c.min || took > c.max {
+				t.Fatalf("took %v, want between %v and %v", took, c.min, c.max)
+			}
+		})
+	}
+
+	// the reader waits for what it read
+	b := NewIOBudget(4)
+	since = time.Now()
+	raw, err := ioutil.ReadAll(b.Reader(bytes.NewReader(make([]byte, 2<<20))))
+	if err != nil || len(raw) != 2<<20 {
+		t.Fatalf("read %d bytes, %v", len(raw), err)
+	}
+	if took := time.Now().Sub(since); took < 200*time.Millisecond {
+		t.Fatalf("reading 2 MiB at 4 MB/s took %v", took)
+	}
+}
+
+func TestSamePrefix(t *testing.T) {
+	data := make([]byte, 64<<10)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	src := writeTemp(t, "src", data)
+	// a partial copy of the first 48 KiB
+	partial := writeTemp(t, "partial", data[:48<<10])
+	changedAt := func(off int) string {
+		raw := append([]byte(nil), data[:48<<10]...)
+		raw[off] ^= 0xff
+		return writeTemp(t, "changed", raw)
+	}
+	sample := HashOption{Mode: CheckModeSample, Algorithm: HashCrc32, BlockSize: 1024, Blocks: 4}
+	cases := []struct {
+		name string
+		dst  string
+		size int64
+		opt  HashOption
+		same bool
+		err  bool
+	}{
+		{"full, same", partial, 48 << 10, HashOption{Mode: CheckModeFull}, true, false},
+		{"full, one byte differs", changedAt(30000), 48 << 10, HashOption{Mode: CheckModeFull}, false, false},
+		{"sample, same", partial, 48 << 10, sample, true, false},
+		{"sample, the first block differs", changedAt(10), 48 << 10, sample, false, false},
+		// the tail written last is always compared
+		{"sample, the tail differs", changedAt(48<<10 - 1), 48 << 10, sample, false, false},
+		{"sample, between the blocks is not read", changedAt(2000), 48 << 10, sample, true, false},
+		{"size mode reads nothing", changedAt(10), 48 << 10, HashOption{Mode: CheckModeSize}, true, false},
+		{"nothing to compare", changedAt(10), 0, HashOption{Mode: CheckModeFull}, true, false},
+		{"dst shorter than size", partial, 64 << 10, HashOption{Mode: CheckModeFull}, false, true},
+		{"dst gone", partial + ".gone", 48 << 10, HashOption{Mode: CheckModeFull}, false, true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			same, err := SamePrefix(src, c.dst, c.size, c.opt, nil)
+			if (err != nil) != c.err {
+				t.Fatalf("error %v, want error %v", err, c.err)
+			}
+			if same != c.same {
+				t.Fatalf("same %v, want %v", same, c.same)
+			}
+		})
+	}
+}
@@ -0,0 +1,125 @@
+package mv_utils
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// DiskStat is one line of /proc/diskstats, times in milliseconds
+type DiskStat struct {
+	Name      string
+	Reads     uint64
+	ReadMs    uint64
+	Writes    uint64
+	WriteMs   uint64
+	IoMs      uint64 // time the device had io in flight
+	SampledAt int64  // unix nano
+}
+
+// DevOfPath returns major:minor of the block device holding path, ok is
+// false for filesystems without one like nfs or tmpfs
+func DevOfPath(path string) (string, bool) {
+	var st syscall.Stat_t
+	if err := syscall.Stat(path, &st); err != nil {
+		return "", false
+	}
+	dev := uint64(st.Dev)
+	major := (dev>>8)&0xfff | (dev>>32)&^0xfff
+	minor := dev&0xff | (dev>>12)&^0xff
+	if major == 0 {
+		return "", false
+	}
+	return fmt.Sprintf("%d:%d", major, minor), true
+}
+
+// ReadDiskStats reads /proc/diskstats keyed by major:minor
+func ReadDiskStats(now int64) (map[string]DiskStat, error) {
+	f, err := os.Open("/proc/diskstats")
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	stats := make(map[string]DiskStat)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 14 {
+			continue
+		}
+		var v [14]uint64
+		for _, i := range []int{3, 6, 7, 10, 12} {
+			if v[i], err = strconv.ParseUint(fields[i], 10, 64); err != nil {
+				return nil, fmt.Errorf("parse /proc/diskstats line %q: %w", scanner.Text(), err)
+			}
+		}
+		stats[fields[0]+":"+fields[1]] = DiskStat{
+			Name:      fields[2],
+			Reads:     v[3],
+			ReadMs:    v[6],
+			Writes:    v[7],
+			WriteMs:   v[10],
+			IoMs:      v[12],
+			SampledAt: now,
+		}
+	}
+	return stats, scanner.Err()
+}
+
+// UtilAndAwait computes the utilization in percent and the average await in
+// milliseconds of the device between two samples
+func UtilAndAwait(prev, cur DiskStat) (float64, float64) {
+	elapsedMs := float64(cur.SampledAt-prev.SampledAt) / 1e6
+	if elapsedMs <= 0 {
+		return 0, 0
+	}
+	util := float64(cur.IoMs-prev.IoMs) / elapsedMs * 100
+	if util > 100 {
+		util = 100
+	}
+	var await float64
+	if ios := (cur.Reads - prev.Reads) + (cur.Writes - prev.Writes); ios > 0 {
+		await = float64((cur.ReadMs-prev.ReadMs)+(cur.WriteMs-prev.WriteMs)) / float64(ios)
+	}
+	return util, await
+}
+
+// ReadIOPressure returns "some avg10" of /proc/pressure/io
+func ReadIOPressure() (float64, error) {
+	raw, err := ioutil.ReadFile("/proc/pressure/io")
+	if err != nil {
+		return 0, err
+	}
+	for _, line := range strings.Split(string(raw), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 || fields[0] != "some" {
+			continue
+		}
+		for _, f := range fields[1:] {
+			if strings.HasPrefix(f, "avg10=") {
+				return strconv.ParseFloat(strings.TrimPrefix(f, "avg10="), 64)
+			}
+		}
+	}
+	return 0, fmt.Errorf("no some avg10 in /proc/pressure/io")
+}
+
+const (
+	ioprioWhoProcess = 1
+	ioprioClassIdle  = 3
+	ioprioClassShift = 13
+)
+
+// SetIdleIOPriority puts the calling thread into the idle io class, the
+// caller should hold its os thread with runtime.LockOSThread
+func SetIdleIOPriority() error {
+	_, _, errno := syscall.Syscall(syscall.SYS_IOPRIO_SET, ioprioWhoProcess, 0, ioprioClassIdle<<ioprioClassShift)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
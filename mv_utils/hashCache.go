@@ -0,0 +1,148 @@
+package mv_utils
+
+import (
+	"encoding/json"
+	"fmt"
+	bolt "go.etcd.io/bbolt"
+	"os"
+	"syscall"
+	"time"
+)
+
+// HashCache keeps file hashes on disk so a hash is only recalculated when
+// the file changed; entries are keyed by device and inode per hash option
+type HashCache struct {
+	db *bolt.DB
+}
+
+type hashCacheEntry struct {
+	Path    string
+	Size    int64
+	MtimeNs int64
+	Hash    string
+}
+
+type fileIdentity struct {
+	dev, ino uint64
+	size     int64
+	mtimeNs  int64
+}
+
+func OpenHashCache(dbPath string) (*HashCache, error) {
+	db, err := bolt.Open(dbPath, 0644, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("open hash cache %s: %w", dbPath, err)
+	}
+	return &HashCache{db: db}, nil
+}
+
+func (c *HashCache) Close() error {
+	return c.db.Close()
+}
+
+func statIdentity(filePath string) (*fileIdentity, error) {
+	info, err := os.Stat(filePath)
+	if err != nil {
+		return nil, err
+	}
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return nil, fmt.Errorf("can not get inode of %s", filePath)
+	}
+	return &fileIdentity{
+		dev:     uint64(st.Dev),
+		ino:     uint64(st.Ino),
+		size:    info.Size(),
+		mtimeNs: info.ModTime().UnixNano(),
+	}, nil
+}
+
+func (id *fileIdentity) key() []byte {
+	return []byte(fmt.Sprintf("%d:%d", id.dev, id.ino))
+}
+
+// Get returns the cached hash of filePath under optKey if the file did not change since
+func (c *HashCache) Get(filePath, optKey string) (string, bool) {
+	id, err := statIdentity(filePath)
+	if err != nil {
+		return "", false
+	}
+	var entry hashCacheEntry
+	found := false
+	_ = c.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(optKey))
+		if b == nil {
+			return nil
+		}
+		raw := b.Get(id.key())
+		if raw == nil {
+			return nil
+		}
+		if err := json.Unmarshal(raw, &entry); err != nil {
+			return nil
+		}
+		found = entry.Size == id.size && entry.MtimeNs == id.mtimeNs
+		return nil
+	})
+	if !found {
+		return "", false
+	}
+	return entry.Hash, true
+}
+
+func (c *HashCache) Put(filePath, optKey, hash string) error {
+	id, err := statIdentity(filePath)
+	if err != nil {
+		return err
+	}
+	raw, err := json.Marshal(hashCacheEntry{
+		Path:    filePath,
+		Size:    id.size,
+		MtimeNs: id.mtimeNs,
+		Hash:    hash,
+	})
+	if err != nil {
+		return err
+	}
+	return c.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(optKey))
+		if err != nil {
+			return err
+		}
+		return b.Put(id.key(), raw)
+	})
+}
+
+// Prune removes the entries whose file was deleted or changed, returns the removed num
+func (c *HashCache) Prune() (int, error) {
+	removed := 0
+	err := c.db.Update(func(tx *bolt.Tx) error {
+		return tx.ForEach(func(name []byte, b *bolt.Bucket) error {
+			stale := make([][]byte, 0)
+			err := b.ForEach(func(k, v []byte) error {
+				var entry hashCacheEntry
+				if err := json.Unmarshal(v, &entry); err != nil {
+					stale = append(stale, k)
+					return nil
+				}
+				id, err := statIdentity(entry.Path)
+				if err != nil || string(id.key()) != string(k) ||
+					id.size != entry.Size || id.mtimeNs != entry.MtimeNs {
+					stale = append(stale, k)
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			for _, k := range stale {
+				if err := b.Delete(k); err != nil {
+					return err
+				}
+			}
+			removed += len(stale)
+			return nil
+		})
+	})
+	return removed, err
+}
@@ -0,0 +1,117 @@
+package mv_utils
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func openTestCache(t *testing.T) *HashCache {
+	t.Helper()
+	c, err := OpenHashCache(filepath.Join(t.TempDir(), "hash_cache.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+func TestHashCacheGet(t *testing.T) {
+	cases := []struct {
+		name   string
+		change func(t *testing.T, file string)
+		optKey string
+		hit    bool
+	}{
+		{"unchanged file hits", func(t *testing.T, file string) {}, "full-md5", true},
+		{"another option misses", func(t *testing.T, file string) {}, "full-sha256", false},
+		{"size change misses", func(t *testing.T, file string) {
+			if err := ioutil.WriteFile(file, []byte("sealed data, longer"), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}, "full-md5", false},
+		{"mtime change misses", func(t *testing.T, file string) {
+			later := time.Now().Add(time.Hour)
+			if err := os.Chtimes(file, later, later); err != nil {
+				t.Fatal(err)
+			}
+		}, "full-md5", false},
+		{"replaced file misses", func(t *testing.T, file string) {
+			// same name and content but a new inode
+			tmp := file + ".new"
+			if err := ioutil.WriteFile(tmp, []byte("sealed data"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			info, _ := os.Stat(file)
+			if err := os.Chtimes(tmp, info.ModTime(), info.ModTime()); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Rename(tmp, file); err != nil {
+				t.Fatal(err)
+			}
+		}, "full-md5", false},
+		{"deleted file misses", func(t *testing.T, file string) {
+			if err := os.Remove(file); err != nil {
+				t.Fatal(err)
+			}
+		}, "full-md5", false},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			cache := openTestCache(t)
+			file := writeTemp(t, "sealed", []byte("sealed data"))
+			if err := cache.Put(file, "full-md5", "abcd"); err != nil {
+				t.Fatal(err)
+			}
+			c.change(t, file)
+			hash, ok := cache.Get(file, c.optKey)
+			if ok != c.hit {
+				t.Fatalf("hit %v, want %v", ok, c.hit)
+			}
+			if ok && hash != "abcd" {
+				t.Fatalf("hash %s, want abcd", hash)
+			}
+		})
+	}
+}
+
+func TestHashCachePrune(t *testing.T) {
+	cache := openTestCache(t)
+	dir := t.TempDir()
+	files := map[string]string{}
+	for _, name := range []string{"kept", "deleted", "changed"} {
+		file := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(file, []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+		files[name] = file
+		for _, key := range []string{"full-md5", "sample-crc32-4096-10"} {
+			if err := cache.Put(file, key, name); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := os.Remove(files["deleted"]); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(files["changed"], []byte("changed later"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	removed, err := cache.Prune()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// two stale files in both buckets
+	if removed != 4 {
+		t.Fatalf("removed %d entries, want 4", removed)
+	}
+	if hash, ok := cache.Get(files["kept"], "full-md5"); !ok || hash != "kept" {
+		t.Fatalf("kept entry lost: %s %v", hash, ok)
+	}
+	if removed, err = cache.Prune(); err != nil || removed != 0 {
+		t.Fatalf("second prune removed %d, %v", removed, err)
+	}
+}
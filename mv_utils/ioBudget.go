@@ -0,0 +1,56 @@
+package mv_utils
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// IOBudget limits the bytes per second read by all the users sharing it,
+// a nil IOBudget means no limit
+type IOBudget struct {
+	lock        sync.Mutex
+	bytesPerSec int64
+	next        time.Time
+}
+
+func NewIOBudget(mbps int) *IOBudget {
+	if mbps <= 0 {
+		return nil
+	}
+	return &IOBudget{bytesPerSec: int64(mbps) << 20}
+}
+
+// Wait blocks until n bytes could be read without exceeding the budget
+func (b *IOBudget) Wait(n int64) {
+	if b == nil || n <= 0 {
+		return
+	}
+	b.lock.Lock()
+	now := time.Now()
+	if b.next.Before(now) {
+		b.next = now
+	}
+	sleep := b.next.Sub(now)
+	b.next = b.next.Add(time.Duration(n * int64(time.Second) / b.bytesPerSec))
+	b.lock.Unlock()
+	time.Sleep(sleep)
+}
+
+func (b *IOBudget) Reader(r io.Reader) io.Reader {
+	if b == nil {
+		return r
+	}
+	return &budgetReader{r: r, budget: b}
+}
+
+type budgetReader struct {
+	r      io.Reader
+	budget *IOBudget
+}
+
+func (br *budgetReader) Read(p []byte) (int, error) {
+	n, err := br.r.Read(p)
+	br.budget.Wait(int64(n))
+	return n, err
+}
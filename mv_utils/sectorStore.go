@@ -0,0 +1,84 @@
+package mv_utils
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// SectorStoreFile is the metadata lotus keeps in the root of every storage path
+const SectorStoreFile = "sectorstore.json"
+
+// LocalStorageMeta is the content of sectorstore.json, field names as lotus writes them
+type LocalStorageMeta struct {
+	ID         string
+	Weight     uint64 // 0 = readonly
+	CanSeal    bool
+	CanStore   bool
+	MaxStorage uint64 // 0 = unlimited
+	Groups     []string
+	AllowTo    []string
+}
+
+// ReadSectorStore reads the metadata of a storage path, the error is
+// os.ErrNotExist like if the path has none
+func ReadSectorStore(location string) (*LocalStorageMeta, error) {
+	raw, err := ioutil.ReadFile(filepath.Join(location, SectorStoreFile))
+	if err != nil {
+		return nil, err
+	}
+	var meta LocalStorageMeta
+	if err = json.Unmarshal(raw, &meta); err != nil {
+		return nil, fmt.Errorf("parse %s of %s: %w", SectorStoreFile, location, err)
+	}
+	return &meta, nil
+}
+
+// WriteSectorStore creates the metadata of a storage path, it never
+// overwrites one lotus may already know by its ID
+func WriteSectorStore(location string, meta *LocalStorageMeta) error {
+	raw, err := json.MarshalIndent(meta, "", "  ")
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(filepath.Join(location, SectorStoreFile), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(raw); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// NewStorageID returns a random uuid as lotus uses for storage IDs
+func NewStorageID() (string, error) {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:]), nil
+}
+
+// DiskUsage sums the bytes the files under root take on disk, like du and
+// lotus do when checking MaxStorage
+func DiskUsage(root string) (int64, error) {
+	var used int64
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if st, ok := info.Sys().(*syscall.Stat_t); ok {
+			used += st.Blocks * 512
+		}
+		return nil
+	})
+	return used, err
+}